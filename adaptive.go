@@ -0,0 +1,238 @@
+package shuttle
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	// AdaptiveMaxErrorRate is the share of failed posts in an interval above
+	// which the adaptive controller backs off.
+	AdaptiveMaxErrorRate = 0.05
+	// AdaptiveBacklog is the inbox fill ratio at or above which the adaptive
+	// controller grows the outlets and batch size.
+	AdaptiveBacklog = 0.25
+
+	// How often parked outlets check whether they became active again
+	adaptiveParkInterval = 100 * time.Millisecond
+)
+
+// adaptiveTargets are the number of active outlets and the size of new
+// batches of a destination. They are fixed unless Config.Adaptive is set.
+type adaptiveTargets struct {
+	outlets   int32 // accessed atomically
+	batchSize int32 // accessed atomically
+}
+
+func newAdaptiveTargets(config Config) *adaptiveTargets {
+	outlets, batchSize := config.NumOutlets, config.BatchSize
+	if config.Adaptive {
+		minOutlets, maxOutlets, minBatchSize, maxBatchSize := config.adaptiveBounds()
+		outlets = clamp(outlets, minOutlets, maxOutlets)
+		batchSize = clamp(batchSize, minBatchSize, maxBatchSize)
+	}
+	return &adaptiveTargets{outlets: int32(outlets), batchSize: int32(batchSize)}
+}
+
+func (t *adaptiveTargets) getOutlets() int {
+	return int(atomic.LoadInt32(&t.outlets))
+}
+
+func (t *adaptiveTargets) getBatchSize() int {
+	return int(atomic.LoadInt32(&t.batchSize))
+}
+
+// adaptiveBounds returns the bounds of the adaptive controller. A MinOutlets or
+// MinBatchSize of 0 is 1, a MaxOutlets or MaxBatchSize of 0 is NumOutlets or
+// BatchSize.
+func (c *Config) adaptiveBounds() (minOutlets, maxOutlets, minBatchSize, maxBatchSize int) {
+	minOutlets, maxOutlets, minBatchSize, maxBatchSize = c.MinOutlets, c.MaxOutlets, c.MinBatchSize, c.MaxBatchSize
+	if minOutlets == 0 {
+		minOutlets = 1
+	}
+	if maxOutlets == 0 {
+		maxOutlets = c.NumOutlets
+	}
+	if minBatchSize == 0 {
+		minBatchSize = 1
+	}
+	if maxBatchSize == 0 {
+		maxBatchSize = c.BatchSize
+	}
+	return
+}
+
+// ValidateAdaptive returns an error if config's adaptive bounds are empty.
+// Nothing is checked unless Adaptive is set.
+func ValidateAdaptive(config Config) error {
+	if !config.Adaptive {
+		return nil
+	}
+	minOutlets, maxOutlets, minBatchSize, maxBatchSize := config.adaptiveBounds()
+	if minOutlets > maxOutlets {
+		return fmt.Errorf("min outlets (%d) must not be greater than max outlets (%d)", minOutlets, maxOutlets)
+	}
+	if minBatchSize > maxBatchSize {
+		return fmt.Errorf("min batch size (%d) must not be greater than max batch size (%d)", minBatchSize, maxBatchSize)
+	}
+	if config.AdaptiveInterval <= 0 {
+		return fmt.Errorf("adaptive interval must be positive, got %s", config.AdaptiveInterval)
+	}
+	return nil
+}
+
+func clamp(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// adaptiveController adjusts the targets of a destination every interval.
+// Like AIMD, it halves the active outlets and batch size when posts fail, are
+// answered with a 429 or 5xx, or are slower than Config.AdaptiveLatency, adds an outlet and grows the batch
+// size when the inbox backs up, and retires an outlet when the inbox stays
+// empty.
+type adaptiveController struct {
+	route   *Route // nil for the shuttle's default destination
+	inbox   chan Batch
+	targets *adaptiveTargets
+	events  func() EventLogger // the shuttle's, reloaded with its config
+
+	minOutlets, maxOutlets     int
+	minBatchSize, maxBatchSize int
+	batchStep                  int // how much the batch size grows by
+	latency                    time.Duration
+
+	postSuccessTimer metrics.Timer
+	postFailureTimer metrics.Timer
+	outletsGauge     metrics.Gauge
+	batchSizeGauge   metrics.Gauge
+	registry         metrics.Registry // Where the status counters are registered, see countStatus
+
+	// The post counts of the previous interval
+	successes, failures, successSum, overloaded int64
+}
+
+func newAdaptiveController(s *Shuttle, r *Route) *adaptiveController {
+	inbox, targets := s.Batches, s.targets
+	if r != nil {
+		inbox, targets = r.Batches, r.targets
+	}
+	minOutlets, maxOutlets, minBatchSize, maxBatchSize := s.config.adaptiveBounds()
+	step := (maxBatchSize - minBatchSize) / 10
+	if step < 1 {
+		step = 1
+	}
+
+	c := &adaptiveController{
+		route:            r,
+		inbox:            inbox,
+		targets:          targets,
+		events:           s.Events,
+		minOutlets:       minOutlets,
+		maxOutlets:       maxOutlets,
+		minBatchSize:     minBatchSize,
+		maxBatchSize:     maxBatchSize,
+		batchStep:        step,
+		latency:          s.config.AdaptiveLatency,
+		postSuccessTimer: metrics.GetOrRegisterTimer(r.metricName("outlet.post.success"), s.MetricsRegistry),
+		postFailureTimer: metrics.GetOrRegisterTimer(r.metricName("outlet.post.failure"), s.MetricsRegistry),
+		outletsGauge:     metrics.GetOrRegisterGauge(r.metricName("adaptive.outlets"), s.MetricsRegistry),
+		batchSizeGauge:   metrics.GetOrRegisterGauge(r.metricName("adaptive.batch.size"), s.MetricsRegistry),
+		registry:         s.MetricsRegistry,
+	}
+	c.successes, c.failures, c.successSum = c.postSuccessTimer.Count(), c.postFailureTimer.Count(), c.postSuccessTimer.Sum()
+	c.overloaded = c.overloadedCount()
+	c.outletsGauge.Update(int64(targets.getOutlets()))
+	c.batchSizeGauge.Update(int64(targets.getBatchSize()))
+	return c
+}
+
+// run adjusts the targets every interval until stop is closed
+func (c *adaptiveController) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.adjust()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// adjust the targets based on the posts since the previous call and the
+// current inbox depth
+func (c *adaptiveController) adjust() {
+	successes := c.postSuccessTimer.Count() - c.successes
+	failures := c.postFailureTimer.Count() - c.failures
+	successSum := c.postSuccessTimer.Sum() - c.successSum
+	c.successes += successes
+	c.failures += failures
+	c.successSum += successSum
+	// Responses are timed as successful posts, but a 429 or 5xx means the
+	// destination can't keep up, so they count as failures.
+	overloaded := c.overloadedCount() - c.overloaded
+	c.overloaded += overloaded
+
+	var latency time.Duration
+	if successes > 0 {
+		latency = time.Duration(successSum / successes)
+	}
+	var errorRate float64
+	if posts := successes + failures; posts > 0 {
+		errorRate = float64(failures+overloaded) / float64(posts)
+	}
+	var depth float64
+	if cap(c.inbox) > 0 {
+		depth = float64(len(c.inbox)) / float64(cap(c.inbox))
+	}
+
+	outlets, batchSize := c.targets.getOutlets(), c.targets.getBatchSize()
+	newOutlets, newBatchSize := outlets, batchSize
+	switch {
+	case errorRate > AdaptiveMaxErrorRate || (c.latency > 0 && latency > c.latency):
+		newOutlets, newBatchSize = outlets/2, batchSize/2
+	case depth >= AdaptiveBacklog:
+		newOutlets, newBatchSize = outlets+1, batchSize+c.batchStep
+	case len(c.inbox) == 0:
+		newOutlets--
+	}
+	newOutlets = clamp(newOutlets, c.minOutlets, c.maxOutlets)
+	newBatchSize = clamp(newBatchSize, c.minBatchSize, c.maxBatchSize)
+
+	atomic.StoreInt32(&c.targets.outlets, int32(newOutlets))
+	atomic.StoreInt32(&c.targets.batchSize, int32(newBatchSize))
+	c.outletsGauge.Update(int64(newOutlets))
+	c.batchSizeGauge.Update(int64(newBatchSize))
+
+	if newOutlets != outlets || newBatchSize != batchSize {
+		destination := "default"
+		if c.route != nil {
+			destination = c.route.Name
+		}
+		c.events().Info("adaptive", "destination", destination, "outlets", newOutlets, "batch_size", newBatchSize,
+			"latency", latency, "error_rate", math.Round(errorRate*100)/100, "inbox_depth", math.Round(depth*100)/100)
+	}
+}
+
+// overloadedCount returns the number of responses so far with a 429 or 5xx
+// status. The status counters are only registered with their first post.
+func (c *adaptiveController) overloadedCount() int64 {
+	var n int64
+	for _, name := range []string{"outlet.post.status.429", "outlet.post.status.5xx"} {
+		if counter, ok := c.registry.Get(c.route.metricName(name)).(metrics.Counter); ok {
+			n += counter.Count()
+		}
+	}
+	return n
+}
@@ -0,0 +1,177 @@
+package shuttle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveControllerAdjust(t *testing.T) {
+	config := newTestConfig()
+	config.Adaptive = true
+	config.NumOutlets = 4
+	config.MinOutlets = 2
+	config.MaxOutlets = 8
+	config.BatchSize = 100
+	config.MinBatchSize = 10
+	config.MaxBatchSize = 200
+	config.BackBuff = 4
+	config.AdaptiveLatency = time.Second
+
+	s := NewShuttle(config)
+	c := newAdaptiveController(s, nil)
+	success := c.postSuccessTimer
+	failure := c.postFailureTimer
+
+	expect := func(step string, outlets, batchSize int) {
+		t.Helper()
+		c.adjust()
+		if o, b := s.targets.getOutlets(), s.targets.getBatchSize(); o != outlets || b != batchSize {
+			t.Errorf("%s: expected %d outlets & batch size %d, got %d & %d", step, outlets, batchSize, o, b)
+		}
+		if o, b := c.outletsGauge.Value(), c.batchSizeGauge.Value(); o != int64(outlets) || b != int64(batchSize) {
+			t.Errorf("%s: expected gauges of %d & %d, got %d & %d", step, outlets, batchSize, o, b)
+		}
+	}
+
+	// A backlog grows the outlets and batch size additively, up to the bounds
+	s.Batches <- NewBatch(1)
+	success.Update(10 * time.Millisecond)
+	expect("backlog", 5, 119)
+	for i := 0; i < 10; i++ {
+		c.adjust()
+	}
+	expect("backlog at the bounds", 8, 200)
+	<-s.Batches
+
+	// Slow or failing posts back off multiplicatively, down to the bounds
+	success.Update(2 * time.Second)
+	expect("slow posts", 4, 100)
+	success.Update(10 * time.Millisecond)
+	failure.Update(10 * time.Millisecond)
+	expect("failed posts", 2, 50)
+	failure.Update(10 * time.Millisecond)
+	expect("failed posts at the bounds", 2, 25)
+
+	// An empty inbox retires outlets one by one
+	atomic.StoreInt32(&s.targets.outlets, 4)
+	expect("quiet", 3, 25)
+
+	// Responses telling that the destination is overloaded back off too
+	atomic.StoreInt32(&s.targets.outlets, 8)
+	success.Update(10 * time.Millisecond)
+	newHTTPOutlet(s, nil).countStatus(http.StatusServiceUnavailable)
+	expect("overloaded", 4, 12)
+	success.Update(10 * time.Millisecond)
+	newHTTPOutlet(s, nil).countStatus(http.StatusTooManyRequests)
+	expect("rate limited", 2, 10)
+}
+
+func TestAdaptiveTargets(t *testing.T) {
+	config := newTestConfig()
+	config.NumOutlets, config.BatchSize = 4, 500
+	if tg := newAdaptiveTargets(config); tg.getOutlets() != 4 || tg.getBatchSize() != 500 {
+		t.Errorf("expected the fixed settings, got %d & %d", tg.getOutlets(), tg.getBatchSize())
+	}
+
+	config.Adaptive = true
+	config.MaxOutlets, config.MinBatchSize, config.MaxBatchSize = 2, 600, 1000
+	if tg := newAdaptiveTargets(config); tg.getOutlets() != 2 || tg.getBatchSize() != 600 {
+		t.Errorf("expected the settings to be within the bounds, got %d & %d", tg.getOutlets(), tg.getBatchSize())
+	}
+}
+
+func TestValidateAdaptive(t *testing.T) {
+	for _, tc := range []struct {
+		minOutlets, maxOutlets, minBatchSize, maxBatchSize int
+		interval                                           time.Duration
+		err                                                string
+	}{
+		{0, 0, 0, 0, time.Second, ""},
+		{8, 0, 0, 0, time.Second, "min outlets (8) must not be greater than max outlets (4)"},
+		{0, 0, 10, 5, time.Second, "min batch size (10) must not be greater than max batch size (5)"},
+		{0, 0, 0, 0, 0, "adaptive interval must be positive, got 0s"},
+	} {
+		config := newTestConfig()
+		config.Adaptive = true
+		config.NumOutlets = 4
+		config.MinOutlets, config.MaxOutlets = tc.minOutlets, tc.maxOutlets
+		config.MinBatchSize, config.MaxBatchSize = tc.minBatchSize, tc.maxBatchSize
+		config.AdaptiveInterval = tc.interval
+		err := ValidateAdaptive(config)
+		if (err == nil) != (tc.err == "") || (err != nil && err.Error() != tc.err) {
+			t.Errorf("expected error %q, got %v", tc.err, err)
+		}
+	}
+}
+
+func TestAdaptiveIntegration(t *testing.T) {
+	th := new(testHelper)
+	ts := httptest.NewServer(th)
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.Adaptive = true
+	config.NumOutlets = 1
+	config.MaxOutlets = 4
+	config.AdaptiveInterval = time.Millisecond
+
+	s := NewShuttle(config)
+	s.LoadReader(NewTestInput())
+	s.Launch()
+	s.WaitForReadersToFinish()
+
+	// The parked outlets must exit too
+	landed := make(chan struct{})
+	go func() {
+		s.Land()
+		close(landed)
+	}()
+	select {
+	case <-landed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out landing")
+	}
+
+	th.Lock()
+	defer th.Unlock()
+	if th.Called != 1 {
+		t.Errorf("expected 1 request, got %d", th.Called)
+	}
+	if s.MetricsRegistry.Get("adaptive.outlets") == nil || s.MetricsRegistry.Get("adaptive.batch.size") == nil {
+		t.Error("expected the adaptive gauges to be registered")
+	}
+}
+
+func TestAdaptiveLandWhileAdjusting(t *testing.T) {
+	config := newTestConfig()
+	config.Adaptive = true
+	config.NumOutlets = 4
+	config.AdaptiveInterval = time.Hour
+
+	s := NewShuttle(config)
+	s.Launch()
+
+	// A controller that adjusts, and so logs, as the shuttle lands
+	c := newAdaptiveController(s, nil)
+	s.aWaiter.Add(1)
+	go func() {
+		<-s.landing
+		c.adjust()
+		s.aWaiter.Done()
+	}()
+
+	landed := make(chan struct{})
+	go func() {
+		s.Land()
+		close(landed)
+	}()
+	select {
+	case <-landed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out landing")
+	}
+}
@@ -0,0 +1,201 @@
+package shuttle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth2ExpiryDelta is how long before they expire OAuth2 tokens are
+// refreshed, so that they don't expire in flight.
+const OAuth2ExpiryDelta = 30 * time.Second
+
+var errUnauthorized = errors.New("unauthorized")
+
+// AuthProvider authenticates the requests made to HTTP destinations.
+// AuthProviders must be safe for concurrent use by multiple outlets.
+type AuthProvider interface {
+	// Authenticate adds credentials to req.
+	Authenticate(req *http.Request) error
+
+	// Refresh is called when a request was rejected with a 401. It returns
+	// whether retrying may succeed, in which case the request is retried
+	// with the credentials Authenticate adds next.
+	Refresh() bool
+}
+
+// BasicAuth is an AuthProvider using HTTP basic auth
+type BasicAuth struct {
+	Username, Password string
+}
+
+// Authenticate req with basic auth
+func (b BasicAuth) Authenticate(req *http.Request) error {
+	req.SetBasicAuth(b.Username, b.Password)
+	return nil
+}
+
+// Refresh is a no-op, static credentials can't be refreshed
+func (b BasicAuth) Refresh() bool {
+	return false
+}
+
+// BearerToken is an AuthProvider using a static bearer token
+type BearerToken string
+
+// Authenticate req with the bearer token
+func (t BearerToken) Authenticate(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+string(t))
+	return nil
+}
+
+// Refresh is a no-op, static tokens can't be refreshed
+func (t BearerToken) Refresh() bool {
+	return false
+}
+
+// AuthProvider returns the provider that authenticates requests to LogsURL:
+// Auth if set, otherwise a BearerToken for BearerAuthToken or BasicAuth with
+// the credentials of LogsURL, or nil if there are none.
+func (c *Config) AuthProvider() AuthProvider {
+	if c.Auth != nil {
+		return c.Auth
+	}
+	if c.BearerAuthToken != "" {
+		return BearerToken(c.BearerAuthToken)
+	}
+	_, user, pass, err := extractCredentials(c.LogsURL)
+	if err != nil || (user == "" && pass == "") {
+		return nil
+	}
+	return BasicAuth{Username: user, Password: pass}
+}
+
+// OAuth2Config configures an OAuth2ClientCredentials provider
+type OAuth2Config struct {
+	TokenURL         string
+	ClientID         string
+	ClientSecret     string
+	ClientSecretFile string // Re-read when it changes, takes precedence over ClientSecret
+	Scopes           []string
+}
+
+// OAuth2ClientCredentials is an AuthProvider fetching bearer tokens with the
+// OAuth2 client credentials grant (RFC 6749, section 4.4). Tokens are cached
+// until OAuth2ExpiryDelta before they expire, or until a request using them
+// is rejected with a 401.
+type OAuth2ClientCredentials struct {
+	config       OAuth2Config
+	client       *http.Client
+	clientSecret *secretFile
+
+	mu     sync.Mutex // protects the below
+	token  string
+	expiry time.Time // zero if the token doesn't expire
+	now    func() time.Time
+}
+
+// NewOAuth2ClientCredentials returns a provider fetching tokens as described
+// by config using client, or http.DefaultClient if client is nil.
+func NewOAuth2ClientCredentials(config OAuth2Config, client *http.Client) *OAuth2ClientCredentials {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &OAuth2ClientCredentials{
+		config:       config,
+		client:       client,
+		clientSecret: newSecretFile(config.ClientSecretFile),
+		now:          time.Now,
+	}
+}
+
+// oauth2Token is the successful response of a token endpoint
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Authenticate req with the cached token, fetching a new one if needed
+func (o *OAuth2ClientCredentials) Authenticate(req *http.Request) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.token == "" || (!o.expiry.IsZero() && !o.now().Before(o.expiry)) {
+		if err := o.fetch(); err != nil {
+			return err
+		}
+	}
+	req.Header.Set("Authorization", "Bearer "+o.token)
+	return nil
+}
+
+// Refresh discards the cached token so that the next request fetches a new one
+func (o *OAuth2ClientCredentials) Refresh() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.token = ""
+	return true
+}
+
+// fetch a new token, o.mu must be held
+func (o *OAuth2ClientCredentials) fetch() error {
+	secret := o.config.ClientSecret
+	if o.clientSecret != nil {
+		var err error
+		if secret, err = o.clientSecret.get(); err != nil {
+			return fmt.Errorf("oauth2: %s", err)
+		}
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(o.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(o.config.Scopes, " "))
+	}
+	req, err := http.NewRequest("POST", o.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("oauth2: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(secret))
+
+	issued := o.now()
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("oauth2: fetching token: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("oauth2: reading token response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oauth2: token endpoint returned status=%d body=%q", resp.StatusCode, body)
+	}
+
+	var t oauth2Token
+	if err := json.Unmarshal(body, &t); err != nil {
+		return fmt.Errorf("oauth2: decoding token response: %s", err)
+	}
+	if t.AccessToken == "" {
+		return fmt.Errorf("oauth2: token response has no access_token")
+	}
+	if t.TokenType != "" && !strings.EqualFold(t.TokenType, "bearer") {
+		return fmt.Errorf("oauth2: unsupported token_type %q", t.TokenType)
+	}
+
+	o.token = t.AccessToken
+	o.expiry = time.Time{}
+	if t.ExpiresIn > 0 {
+		o.expiry = issued.Add(time.Duration(t.ExpiresIn)*time.Second - OAuth2ExpiryDelta)
+	}
+	return nil
+}
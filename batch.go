@@ -1,27 +1,72 @@
 package shuttle
 
-import "github.com/pborman/uuid"
+import (
+	"time"
+
+	"github.com/pborman/uuid"
+)
 
 // Batch holds incoming log lines and provides some helpers for dealing with
 // their grouping
 type Batch struct {
 	logLines []LogLine
 	UUID     string
+	bytes    int // The formatted length of logLines
+	maxBytes int // The most bytes the batch holds, 0 if unlimited
+
+	enqueued time.Time // When the batch was handed to its outlets, see batch.queue.wait
 }
 
 // NewBatch returns a new batch with a capacity pre-set
 func NewBatch(capacity int) Batch {
+	return NewBatchWithMaxBytes(capacity, 0)
+}
+
+// NewBatchWithMaxBytes returns a new batch with a capacity pre-set, that is
+// also full once it holds maxBytes (unlimited if 0)
+func NewBatchWithMaxBytes(capacity, maxBytes int) Batch {
 	return Batch{
 		logLines: make([]LogLine, 0, capacity),
 		UUID:     uuid.New(),
+		maxBytes: maxBytes,
 	}
 }
 
 // Add a logline to the batch and return a boolean indicating if the batch is
-// full or not
+// full or not. The line's length is counted towards the batch's max bytes.
 func (b *Batch) Add(ll LogLine) bool {
+	return b.add(ll, ll.Length())
+}
+
+// add a logline of formatted length n to the batch and return a boolean
+// indicating if the batch is full or not
+func (b *Batch) add(ll LogLine, n int) bool {
 	b.logLines = append(b.logLines, ll)
-	return len(b.logLines) == cap(b.logLines)
+	b.bytes += n
+	return len(b.logLines) == cap(b.logLines) || (b.maxBytes > 0 && b.bytes >= b.maxBytes)
+}
+
+// fits reports whether a line of formatted length n can be added without
+// going over the batch's max bytes. Lines always fit in empty batches, so
+// that lines longer than the max are still delivered.
+func (b *Batch) fits(n int) bool {
+	return b.maxBytes == 0 || len(b.logLines) == 0 || b.bytes+n <= b.maxBytes
+}
+
+// Bytes returns the formatted length of the lines in the batch
+func (b *Batch) Bytes() int {
+	return b.bytes
+}
+
+// oldest returns when the batch's oldest line was received, zero if it's empty
+func (b *Batch) oldest() time.Time {
+	var oldest time.Time
+	for _, ll := range b.logLines {
+		if oldest.IsZero() || ll.when.Before(oldest) {
+			oldest = ll.when
+		}
+	}
+	return oldest
 }
 
 // MsgCount returns the number of msgs in the batch
@@ -10,7 +10,6 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
 )
@@ -29,7 +28,8 @@ type CloudWatchLogsClient interface {
 
 // CloudWatchLogsFormatter formats a batch of logs for the Amazon Cloud Watch Logs service.
 // NewCloudWatchLogsFormatterFunc should be used to create a HTTPFormatterFunc tied to a specific
-// region/logGroupName/logStreamName.
+// region/logGroupName/logStreamName. Batches are delivered with the AWS SDK,
+// see Deliver.
 type CloudWatchLogsFormatter struct {
 	batch Batch
 	eData []errData
@@ -43,9 +43,10 @@ type CloudWatchLogsFormatter struct {
 }
 
 // NewCloudWatchLogsFormatterFunc that creates a HTTPFormatterFunc for formatting batched into Cloud Watch Logs requests
-// tied to a specific region/host/log group/log stream.
-func NewCloudWatchLogsFormatterFunc(region, host, logGroupName, logStreamName string) (NewHTTPFormatterFunc, error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
+// tied to a specific region/host/log group/log stream. The AWS client uses transport, or the SDK's default
+// when nil.
+func NewCloudWatchLogsFormatterFunc(region, host, logGroupName, logStreamName string, transport *http.Transport) (NewHTTPFormatterFunc, error) {
+	cfg, err := loadAWSConfig(region, transport)
 	if err != nil {
 		return nil, err
 	}
@@ -95,7 +96,9 @@ func (f *CloudWatchLogsFormatter) MsgCount() int {
 	return f.batch.MsgCount() + len(f.eData)
 }
 
-// Request constructs a request for this formatter
+// Request constructs an unsigned PutLogEvents request for this formatter,
+// taking the sequence token until it's handed back by HandleResponse. Outlets
+// deliver the batch with Deliver instead.
 func (f *CloudWatchLogsFormatter) Request() (*http.Request, error) {
 	if f.client == nil {
 		return nil, fmt.Errorf("CloudWatch Logs client is not initialized")
@@ -123,7 +126,24 @@ func (f *CloudWatchLogsFormatter) Request() (*http.Request, error) {
 	req.Header.Add("Content-Type", xAmazonJSON11)
 	req.Header.Add("X-Amz-Target", xAmazonTarget)
 
-	// Use the AWS SDK v2 to put log events
+	f.ReadSeeker = body
+	return req, nil
+}
+
+// Deliver the batch with the AWS SDK's PutLogEvents, using and then updating
+// the log stream's sequence token. See Deliverer.
+func (f *CloudWatchLogsFormatter) Deliver(ctx context.Context) error {
+	if f.client == nil {
+		return fmt.Errorf("CloudWatch Logs client is not initialized")
+	}
+
+	var token string
+	select {
+	case token = <-f.tokens:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
 	events := make([]types.InputLogEvent, 0, len(f.batch.logLines)+len(f.eData))
 
 	// Add error events
@@ -134,6 +154,8 @@ func (f *CloudWatchLogsFormatter) Request() (*http.Request, error) {
 			msg = fmt.Sprintf("log-shuttle dropped %d messages since %s", e.count, e.since.String())
 		case errLost:
 			msg = fmt.Sprintf("log-shuttle lost %d messages since %s", e.count, e.since.String())
+		case errRateLimited:
+			msg = fmt.Sprintf("log-shuttle rate limited %d messages since %s", e.count, e.since.String())
 		default:
 			continue
 		}
@@ -160,13 +182,12 @@ func (f *CloudWatchLogsFormatter) Request() (*http.Request, error) {
 		input.SequenceToken = aws.String(token)
 	}
 
-	_, err = f.client.PutLogEvents(context.TODO(), input)
-	if err != nil {
-		return nil, err
+	out, err := f.client.PutLogEvents(ctx, input)
+	if err == nil && aws.ToString(out.NextSequenceToken) != "" {
+		token = aws.ToString(out.NextSequenceToken)
 	}
-
-	f.ReadSeeker = body
-	return req, nil
+	f.tokens <- token
+	return err
 }
 
 // HandleResponse to the request that was generated. See ResponseHandler for more info.
@@ -227,6 +248,8 @@ func newCloudWatchLogsBody(b Batch, eData []errData, logGroupName, logStreamName
 			msg = fmt.Sprintf("log-shuttle dropped %d messages since %s", e.count, e.since.String())
 		case errLost:
 			msg = fmt.Sprintf("log-shuttle lost %d messages since %s", e.count, e.since.String())
+		case errRateLimited:
+			msg = fmt.Sprintf("log-shuttle rate limited %d messages since %s", e.count, e.since.String())
 		default:
 			continue
 		}
@@ -143,3 +143,38 @@ func TestCloudWatchLogsFormatterErrorCases(t *testing.T) {
 		t.Error("Expected error with empty token, got nil")
 	}
 }
+
+func TestCloudWatchLogsFormatterDeliver(t *testing.T) {
+	b := NewBatch(2)
+	b.Add(LogLineOne)
+	b.Add(LogLineTwo)
+
+	var input *cloudwatchlogs.PutLogEventsInput
+	client := &mockCloudWatchLogsClient{
+		putLogEventsFunc: func(ctx context.Context, params *cloudwatchlogs.PutLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			input = params
+			return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String("next-token")}, nil
+		},
+	}
+	formatter := createTestFormatter(b, noErrData, client)
+
+	if err := formatter.Deliver(context.Background()); err != nil {
+		t.Fatalf("Error delivering: %v", err)
+	}
+	if len(input.LogEvents) != 2 {
+		t.Errorf("Expected 2 log events, got %d", len(input.LogEvents))
+	}
+	if token := aws.ToString(input.SequenceToken); token != "test-token" {
+		t.Errorf("Expected the sequence token to be test-token, got %q", token)
+	}
+	if token := <-formatter.tokens; token != "next-token" {
+		t.Errorf("Expected the next sequence token to be handed back, got %q", token)
+	}
+
+	// Delivery gives up waiting for the token once ctx is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := formatter.Deliver(ctx); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	shuttle "github.com/heroku/log-shuttle"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the format of the YAML file given to -config. Options left
+// out of the file (or set to their zero value) leave the corresponding
+// shuttle.Config option untouched. Boolean options are pointers so that they
+// can be explicitly set to false.
+type fileConfig struct {
+	LogsURL               string        `yaml:"logs_url"`
+	BearerToken           string        `yaml:"bearer_token"`
+	BearerTokenFile       string        `yaml:"bearer_token_file"`
+	CredentialsFile       string        `yaml:"credentials_file"`
+	InputFormat           string        `yaml:"input_format"`
+	Prival                string        `yaml:"prival"`
+	SyslogVersion         string        `yaml:"syslog_version"`
+	Procid                string        `yaml:"procid"`
+	Appname               string        `yaml:"appname"`
+	Hostname              string        `yaml:"hostname"`
+	Msgid                 string        `yaml:"msgid"`
+	StatsSource           string        `yaml:"stats_source"`
+	StatsPrefix           string        `yaml:"stats_prefix"`
+	StatsInterval         time.Duration `yaml:"stats_interval"`
+	Wait                  time.Duration `yaml:"wait"`
+	Timeout               time.Duration `yaml:"timeout"`
+	DrainTimeout          time.Duration `yaml:"drain_timeout"`
+	MaxAttempts           int           `yaml:"max_attempts"`
+	NumOutlets            int           `yaml:"num_outlets"`
+	BatchSize             int           `yaml:"batch_size"`
+	MaxBatchBytes         int           `yaml:"max_batch_bytes"`
+	BackBuff              int           `yaml:"back_buff"`
+	MaxLineLength         int           `yaml:"max_line_length"`
+	KinesisShards         int           `yaml:"kinesis_shards"`
+	KinesisEndpoint       string        `yaml:"kinesis_endpoint"`
+	KinesisPartitioning   string        `yaml:"kinesis_partitioning"`
+	KinesisPartitionField string        `yaml:"kinesis_partition_field"`
+	KinesisPartitionKey   string        `yaml:"kinesis_partition_key"`
+	FirehoseEndpoint      string        `yaml:"firehose_endpoint"`
+	FirehoseFormat        string        `yaml:"firehose_format"`
+	Proxy                 string        `yaml:"proxy"`
+	NoProxy               []string      `yaml:"no_proxy"`
+	Verbose               *bool         `yaml:"verbose"`
+	SkipVerify            *bool         `yaml:"skip_verify"`
+	Gzip                  *bool         `yaml:"gzip"`
+	Drop                  *bool         `yaml:"drop"`
+	LogToSyslog           *bool         `yaml:"log_to_syslog"`
+	LogLevel              string        `yaml:"log_level"`
+	LogFormat             string        `yaml:"log_format"`
+
+	TLS struct {
+		CAFile     string   `yaml:"ca_file"`
+		CertFile   string   `yaml:"cert_file"`
+		KeyFile    string   `yaml:"key_file"`
+		MinVersion string   `yaml:"min_version"`
+		Pins       []string `yaml:"pins"`
+	} `yaml:"tls"`
+
+	OAuth2 *fileOAuth2 `yaml:"oauth2"`
+
+	Compression struct {
+		Algorithm string `yaml:"algorithm"`
+		Level     int    `yaml:"level"`
+		Fallback  *bool  `yaml:"fallback"`
+	} `yaml:"compression"`
+
+	Transport struct {
+		MaxIdleConns        int           `yaml:"max_idle_conns"`
+		MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+		MaxConnsPerHost     int           `yaml:"max_conns_per_host"`
+		IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+		KeepAlive           time.Duration `yaml:"keep_alive"`
+		DNSRefreshInterval  time.Duration `yaml:"dns_refresh_interval"`
+		HTTP2               string        `yaml:"http2"`
+	} `yaml:"transport"`
+
+	Adaptive struct {
+		Enabled      *bool         `yaml:"enabled"`
+		Interval     time.Duration `yaml:"interval"`
+		Latency      time.Duration `yaml:"latency"`
+		MinOutlets   int           `yaml:"min_outlets"`
+		MaxOutlets   int           `yaml:"max_outlets"`
+		MinBatchSize int           `yaml:"min_batch_size"`
+		MaxBatchSize int           `yaml:"max_batch_size"`
+	} `yaml:"adaptive"`
+
+	RateLimit struct {
+		Lines int   `yaml:"lines"`
+		Bytes int   `yaml:"bytes"`
+		Drop  *bool `yaml:"drop"`
+	} `yaml:"rate_limit"`
+
+	Statsd struct {
+		Addr      string   `yaml:"addr"`
+		DogStatsD *bool    `yaml:"dogstatsd"`
+		Tags      []string `yaml:"tags"`
+	} `yaml:"statsd"`
+
+	Graphite struct {
+		Addr string `yaml:"addr"`
+	} `yaml:"graphite"`
+
+	SelfLog struct {
+		Enabled *bool  `yaml:"enabled"`
+		Rate    int    `yaml:"rate"`
+		Appname string `yaml:"appname"`
+		Procid  string `yaml:"procid"`
+	} `yaml:"self_log"`
+
+	// Inputs are paths to read lines from, "-" is stdin. Stdin is read when
+	// no inputs are given.
+	Inputs []string `yaml:"inputs"`
+
+	// Filters are regexps, lines whose message matches any of them are
+	// discarded.
+	Filters []string `yaml:"filters"`
+
+	Destinations []fileDestination `yaml:"destinations"`
+}
+
+// fileDestination is a named destination in the -config file, see
+// shuttle.RouteConfig.
+type fileDestination struct {
+	Name            string      `yaml:"name"`
+	LogsURL         string      `yaml:"logs_url"`
+	BearerToken     string      `yaml:"bearer_token"`
+	BearerTokenFile string      `yaml:"bearer_token_file"`
+	CredentialsFile string      `yaml:"credentials_file"`
+	LogplexToken    string      `yaml:"logplex_token"`
+	OAuth2          *fileOAuth2 `yaml:"oauth2"`
+	Proxy           string      `yaml:"proxy"`
+	NoProxy         []string    `yaml:"no_proxy"`
+	AppNames        []string    `yaml:"app_names"`
+	Patterns        []string    `yaml:"patterns"`
+}
+
+// fileOAuth2 configures OAuth2 client credentials auth, see
+// shuttle.OAuth2Config. The client secret can't be given inline, use
+// client_secret_file or $OAUTH2_CLIENT_SECRET.
+type fileOAuth2 struct {
+	TokenURL         string   `yaml:"token_url"`
+	ClientID         string   `yaml:"client_id"`
+	ClientSecretFile string   `yaml:"client_secret_file"`
+	Scopes           []string `yaml:"scopes"`
+}
+
+// loadConfigFile reads and validates the config file at path.
+func loadConfigFile(path string) (*fileConfig, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigFile(d)
+}
+
+// parseConfigFile decodes and validates the config file data. Unknown options
+// are an error.
+func parseConfigFile(d []byte) (*fileConfig, error) {
+	var fc fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(d))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fc); err != nil {
+		return nil, err
+	}
+	if err := fc.validate(); err != nil {
+		return nil, err
+	}
+	return &fc, nil
+}
+
+// validate the options that can be checked on their own, returning an error
+// naming the offending option.
+func (fc *fileConfig) validate() error {
+	if fc.LogsURL != "" {
+		if _, err := validateURL(fc.LogsURL); err != nil {
+			return fmt.Errorf("logs_url: %s", err)
+		}
+	}
+	if fc.KinesisEndpoint != "" {
+		if _, err := validateURL(fc.KinesisEndpoint); err != nil {
+			return fmt.Errorf("kinesis_endpoint: %s", err)
+		}
+	}
+	if fc.KinesisPartitioning != "" {
+		if _, err := mapKinesisPartitioning(fc.KinesisPartitioning); err != nil {
+			return fmt.Errorf("kinesis_partitioning: %s", err)
+		}
+	}
+	if err := shuttle.ValidateProxy(shuttle.Config{Proxy: fc.Proxy}); err != nil {
+		return fmt.Errorf("proxy: %s", err)
+	}
+
+	if fc.FirehoseEndpoint != "" {
+		if _, err := validateURL(fc.FirehoseEndpoint); err != nil {
+			return fmt.Errorf("firehose_endpoint: %s", err)
+		}
+	}
+	if fc.FirehoseFormat != "" {
+		if _, err := mapFirehoseFormat(fc.FirehoseFormat); err != nil {
+			return fmt.Errorf("firehose_format: %s", err)
+		}
+	}
+	if fc.InputFormat != "" {
+		if _, err := mapInputFormat(fc.InputFormat); err != nil {
+			return fmt.Errorf("input_format: %s", err)
+		}
+	}
+	if fc.LogLevel != "" {
+		if _, err := mapLogLevel(fc.LogLevel); err != nil {
+			return fmt.Errorf("log_level: %s", err)
+		}
+	}
+	if fc.LogFormat != "" {
+		if _, err := mapLogFormat(fc.LogFormat); err != nil {
+			return fmt.Errorf("log_format: %s", err)
+		}
+	}
+	if fc.OAuth2 != nil {
+		if err := fc.OAuth2.validate(); err != nil {
+			return fmt.Errorf("oauth2.%s", err)
+		}
+	}
+
+	if fc.Compression.Algorithm != "" {
+		algorithm, err := mapCompression(fc.Compression.Algorithm)
+		if err != nil {
+			return fmt.Errorf("compression.algorithm: %s", err)
+		}
+		if err := shuttle.ValidateCompression(shuttle.Config{Compression: algorithm, CompressionLevel: fc.Compression.Level}); err != nil {
+			return fmt.Errorf("compression.level: %s", err)
+		}
+	}
+
+	if fc.Transport.HTTP2 != "" {
+		if _, err := mapHTTP2(fc.Transport.HTTP2); err != nil {
+			return fmt.Errorf("transport.http2: %s", err)
+		}
+	}
+
+	if _, err := mapTLSVersion(fc.TLS.MinVersion); err != nil {
+		return fmt.Errorf("tls.min_version: %s", err)
+	}
+	if (fc.TLS.CertFile == "") != (fc.TLS.KeyFile == "") {
+		return fmt.Errorf("tls: cert_file and key_file must be set together")
+	}
+
+	for _, o := range []struct {
+		name string
+		v    int
+	}{
+		{"max_attempts", fc.MaxAttempts},
+		{"num_outlets", fc.NumOutlets},
+		{"batch_size", fc.BatchSize},
+		{"max_batch_bytes", fc.MaxBatchBytes},
+		{"back_buff", fc.BackBuff},
+		{"max_line_length", fc.MaxLineLength},
+		{"kinesis_shards", fc.KinesisShards},
+		{"transport.max_idle_conns", fc.Transport.MaxIdleConns},
+		{"transport.max_idle_conns_per_host", fc.Transport.MaxIdleConnsPerHost},
+		{"transport.max_conns_per_host", fc.Transport.MaxConnsPerHost},
+		{"adaptive.min_outlets", fc.Adaptive.MinOutlets},
+		{"adaptive.max_outlets", fc.Adaptive.MaxOutlets},
+		{"adaptive.min_batch_size", fc.Adaptive.MinBatchSize},
+		{"adaptive.max_batch_size", fc.Adaptive.MaxBatchSize},
+		{"rate_limit.lines", fc.RateLimit.Lines},
+		{"rate_limit.bytes", fc.RateLimit.Bytes},
+		{"self_log.rate", fc.SelfLog.Rate},
+	} {
+		if o.v < 0 {
+			return fmt.Errorf("%s: must be >= 0, got %d", o.name, o.v)
+		}
+	}
+
+	for _, o := range []struct {
+		name string
+		v    time.Duration
+	}{
+		{"stats_interval", fc.StatsInterval},
+		{"wait", fc.Wait},
+		{"timeout", fc.Timeout},
+		{"drain_timeout", fc.DrainTimeout},
+		{"transport.idle_conn_timeout", fc.Transport.IdleConnTimeout},
+		{"transport.dns_refresh_interval", fc.Transport.DNSRefreshInterval},
+		{"adaptive.interval", fc.Adaptive.Interval},
+		{"adaptive.latency", fc.Adaptive.Latency},
+	} {
+		if o.v < 0 {
+			return fmt.Errorf("%s: must be >= 0, got %s", o.name, o.v)
+		}
+	}
+
+	for i, f := range fc.Inputs {
+		if f == "" {
+			return fmt.Errorf("inputs[%d]: must not be empty", i)
+		}
+	}
+
+	for i, f := range fc.Filters {
+		if _, err := regexp.Compile(f); err != nil {
+			return fmt.Errorf("filters[%d]: %s", i, err)
+		}
+	}
+
+	names := make(map[string]bool, len(fc.Destinations))
+	for i, d := range fc.Destinations {
+		if err := d.validate(); err != nil {
+			return fmt.Errorf("destinations[%d]: %s", i, err)
+		}
+		if names[d.Name] {
+			return fmt.Errorf("destinations[%d].name: duplicate name %q", i, d.Name)
+		}
+		names[d.Name] = true
+	}
+
+	return nil
+}
+
+func (d fileDestination) validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("name: must not be empty")
+	}
+	if strings.ContainsAny(d.Name, ". \t") {
+		return fmt.Errorf("name: %q must not contain dots or spaces", d.Name)
+	}
+	if d.LogsURL == "" {
+		return fmt.Errorf("logs_url: must not be empty")
+	}
+	if _, err := validateURL(d.LogsURL); err != nil {
+		return fmt.Errorf("logs_url: %s", err)
+	}
+	if err := shuttle.ValidateProxy(shuttle.Config{Proxy: d.Proxy}); err != nil {
+		return fmt.Errorf("proxy: %s", err)
+	}
+	if len(d.AppNames) == 0 && len(d.Patterns) == 0 {
+		return fmt.Errorf("at least one of app_names or patterns is required")
+	}
+	for i, p := range d.Patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("patterns[%d]: %s", i, err)
+		}
+	}
+	if d.OAuth2 != nil {
+		if d.OAuth2.ClientSecretFile == "" {
+			return fmt.Errorf("oauth2.client_secret_file: must not be empty")
+		}
+		if err := d.OAuth2.validate(); err != nil {
+			return fmt.Errorf("oauth2.%s", err)
+		}
+	}
+	return nil
+}
+
+func (o *fileOAuth2) validate() error {
+	if o.TokenURL == "" {
+		return fmt.Errorf("token_url: must not be empty")
+	}
+	if _, err := validateURL(o.TokenURL); err != nil {
+		return fmt.Errorf("token_url: %s", err)
+	}
+	if o.ClientID == "" {
+		return fmt.Errorf("client_id: must not be empty")
+	}
+	return nil
+}
+
+func (o *fileOAuth2) config() shuttle.OAuth2Config {
+	return shuttle.OAuth2Config{
+		TokenURL:         o.TokenURL,
+		ClientID:         o.ClientID,
+		ClientSecretFile: o.ClientSecretFile,
+		Scopes:           o.Scopes,
+	}
+}
+
+// apply the options set in the file to c. LogsURL isn't applied as it is
+// resolved along with $LOGS_URL, see determineLogsURL. Destinations are
+// applied by applyDestinations once the rest of the config is known.
+func (fc *fileConfig) apply(c *shuttle.Config) {
+	setString := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	setInt := func(dst *int, v int) {
+		if v != 0 {
+			*dst = v
+		}
+	}
+	setDuration := func(dst *time.Duration, v time.Duration) {
+		if v != 0 {
+			*dst = v
+		}
+	}
+	setBool := func(dst *bool, v *bool) {
+		if v != nil {
+			*dst = *v
+		}
+	}
+
+	setString(&c.BearerAuthToken, fc.BearerToken)
+	setString(&c.BearerAuthTokenFile, fc.BearerTokenFile)
+	setString(&c.CredentialsFile, fc.CredentialsFile)
+	setString(&c.Prival, fc.Prival)
+	setString(&c.Version, fc.SyslogVersion)
+	setString(&c.Procid, fc.Procid)
+	setString(&c.Appname, fc.Appname)
+	setString(&c.Hostname, fc.Hostname)
+	setString(&c.Msgid, fc.Msgid)
+	setString(&c.StatsSource, fc.StatsSource)
+	setString(&c.StatsPrefix, fc.StatsPrefix)
+	setString(&c.StatsdAddr, fc.Statsd.Addr)
+	setBool(&c.DogStatsD, fc.Statsd.DogStatsD)
+	if len(fc.Statsd.Tags) > 0 {
+		c.StatsdTags = fc.Statsd.Tags
+	}
+	setString(&c.GraphiteAddr, fc.Graphite.Addr)
+	setString(&c.KinesisEndpoint, fc.KinesisEndpoint)
+	setString(&c.FirehoseEndpoint, fc.FirehoseEndpoint)
+	setString(&c.Proxy, fc.Proxy)
+	if len(fc.NoProxy) > 0 {
+		c.NoProxy = fc.NoProxy
+	}
+	setString(&c.KinesisPartitionField, fc.KinesisPartitionField)
+	setString(&c.KinesisPartitionKey, fc.KinesisPartitionKey)
+	setDuration(&c.StatsInterval, fc.StatsInterval)
+	setDuration(&c.WaitDuration, fc.Wait)
+	setDuration(&c.Timeout, fc.Timeout)
+	setDuration(&c.DrainTimeout, fc.DrainTimeout)
+	setInt(&c.MaxAttempts, fc.MaxAttempts)
+	setInt(&c.NumOutlets, fc.NumOutlets)
+	setInt(&c.BatchSize, fc.BatchSize)
+	setInt(&c.MaxBatchBytes, fc.MaxBatchBytes)
+	setInt(&c.BackBuff, fc.BackBuff)
+	setInt(&c.MaxLineLength, fc.MaxLineLength)
+	setInt(&c.KinesisShards, fc.KinesisShards)
+	setInt(&c.RateLimitLines, fc.RateLimit.Lines)
+	setInt(&c.RateLimitBytes, fc.RateLimit.Bytes)
+	setBool(&c.Verbose, fc.Verbose)
+	setBool(&c.SkipVerify, fc.SkipVerify)
+	setBool(&c.UseGzip, fc.Gzip)
+	setBool(&c.Drop, fc.Drop)
+	setBool(&c.RateLimitDrop, fc.RateLimit.Drop)
+	setBool(&c.SelfLog, fc.SelfLog.Enabled)
+	setInt(&c.SelfLogRate, fc.SelfLog.Rate)
+	setString(&c.SelfLogAppName, fc.SelfLog.Appname)
+	setString(&c.SelfLogProcid, fc.SelfLog.Procid)
+	setInt(&c.MaxIdleConns, fc.Transport.MaxIdleConns)
+	setInt(&c.MaxIdleConnsPerHost, fc.Transport.MaxIdleConnsPerHost)
+	setInt(&c.MaxConnsPerHost, fc.Transport.MaxConnsPerHost)
+	setDuration(&c.IdleConnTimeout, fc.Transport.IdleConnTimeout)
+	setDuration(&c.KeepAlive, fc.Transport.KeepAlive)
+	setDuration(&c.DNSRefreshInterval, fc.Transport.DNSRefreshInterval)
+	if fc.Transport.HTTP2 != "" {
+		c.HTTP2, _ = mapHTTP2(fc.Transport.HTTP2) // already validated
+	}
+	setBool(&c.Adaptive, fc.Adaptive.Enabled)
+	setDuration(&c.AdaptiveInterval, fc.Adaptive.Interval)
+	setDuration(&c.AdaptiveLatency, fc.Adaptive.Latency)
+	setInt(&c.MinOutlets, fc.Adaptive.MinOutlets)
+	setInt(&c.MaxOutlets, fc.Adaptive.MaxOutlets)
+	setInt(&c.MinBatchSize, fc.Adaptive.MinBatchSize)
+	setInt(&c.MaxBatchSize, fc.Adaptive.MaxBatchSize)
+	setBool(&logToSyslog, fc.LogToSyslog)
+	if fc.OAuth2 != nil {
+		oauth2Config = fc.OAuth2.config()
+	}
+	if fc.Compression.Algorithm != "" {
+		c.Compression, _ = mapCompression(fc.Compression.Algorithm) // already validated
+	}
+	setInt(&c.CompressionLevel, fc.Compression.Level)
+	setBool(&c.CompressionFallback, fc.Compression.Fallback)
+	setString(&c.TLSCAFile, fc.TLS.CAFile)
+	setString(&c.TLSCertFile, fc.TLS.CertFile)
+	setString(&c.TLSKeyFile, fc.TLS.KeyFile)
+	if fc.TLS.MinVersion != "" {
+		c.TLSMinVersion, _ = mapTLSVersion(fc.TLS.MinVersion) // already validated
+	}
+	if len(fc.TLS.Pins) > 0 {
+		c.TLSPins = fc.TLS.Pins
+	}
+
+	if fc.KinesisPartitioning != "" {
+		c.KinesisPartitioning, _ = mapKinesisPartitioning(fc.KinesisPartitioning) // already validated
+	}
+	if fc.FirehoseFormat != "" {
+		c.FirehoseFormat, _ = mapFirehoseFormat(fc.FirehoseFormat) // already validated
+	}
+	if fc.InputFormat != "" {
+		c.InputFormat, _ = mapInputFormat(fc.InputFormat) // already validated
+	}
+	if fc.LogLevel != "" {
+		c.LogLevel, _ = mapLogLevel(fc.LogLevel) // already validated
+	}
+	if fc.LogFormat != "" {
+		c.LogFormat, _ = mapLogFormat(fc.LogFormat) // already validated
+	}
+
+	for _, f := range fc.Filters {
+		c.Filters = append(c.Filters, regexp.MustCompile(f)) // already validated
+	}
+}
+
+// applyDestinations adds a route to c for each of the file's destinations. It
+// must be called once c.Transport is set, as OAuth2 tokens are fetched with it.
+func (fc *fileConfig) applyDestinations(c *shuttle.Config) error {
+	for i, d := range fc.Destinations {
+		u, err := validateURL(d.LogsURL)
+		if err != nil {
+			return fmt.Errorf("destinations[%d].logs_url: %s", i, err)
+		}
+		if u.User == nil && d.LogplexToken != "" {
+			u.User = url.UserPassword("token", d.LogplexToken)
+		}
+
+		rc := shuttle.RouteConfig{
+			Name:                d.Name,
+			LogsURL:             u.String(),
+			BearerAuthToken:     d.BearerToken,
+			BearerAuthTokenFile: d.BearerTokenFile,
+			CredentialsFile:     d.CredentialsFile,
+			Proxy:               d.Proxy,
+			NoProxy:             d.NoProxy,
+			AppNames:            d.AppNames,
+		}
+		if d.OAuth2 != nil {
+			rc.Auth = shuttle.NewOAuth2ClientCredentials(d.OAuth2.config(), oauth2Client(*c))
+		}
+		for _, p := range d.Patterns {
+			rc.Patterns = append(rc.Patterns, regexp.MustCompile(p)) // already validated
+		}
+		c.Routes = append(c.Routes, rc)
+	}
+	return nil
+}
+
+// lookupConfigPath returns the value of the -config flag in args, if any. The
+// config file needs to be loaded before the rest of the flags are parsed so
+// that flags take precedence over it.
+func lookupConfigPath(args []string) string {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			return ""
+		}
+		if !strings.HasPrefix(a, "-") {
+			continue // the value of the previous flag
+		}
+		name := strings.TrimLeft(a, "-")
+		switch {
+		case name == "config" && i+1 < len(args):
+			return args[i+1]
+		case strings.HasPrefix(name, "config="):
+			return strings.TrimPrefix(name, "config=")
+		}
+	}
+	return ""
+}
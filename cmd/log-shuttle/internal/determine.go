@@ -2,7 +2,6 @@ package internal
 
 import (
 	"fmt"
-	"log"
 	"net/url"
 	"regexp"
 	"strings"
@@ -16,35 +15,67 @@ var (
 )
 
 const (
-	kinesis = "kinesis"
-	logs    = "logs"
+	kinesis  = "kinesis"
+	firehose = "firehose"
+	logs     = "logs"
 )
 
-func DetermineOutputFormatter(u *url.URL, errLogger *log.Logger) shuttle.NewHTTPFormatterFunc {
+// DetermineOutputFormatter returns the formatter for the destination at u,
+// whose config is that of a route for route destinations. AWS clients use
+// config's Transport, KinesisEndpoint & FirehoseEndpoint, and the outlets pass
+// them the destination's proxy.
+func DetermineOutputFormatter(u *url.URL, config shuttle.Config) (shuttle.NewHTTPFormatterFunc, error) {
 	service, err := DetermineAWSService(u.Host)
 	if err != nil {
-		return shuttle.NewLogplexBatchFormatter
+		return shuttle.NewLogplexBatchFormatter, nil
 	}
 	region, err := DetermineAWSRegion(u.Host)
 	if err != nil {
-		return shuttle.NewLogplexBatchFormatter
+		return shuttle.NewLogplexBatchFormatter, nil
 	}
 
 	switch service {
 	case kinesis:
-		return shuttle.NewKinesisFormatter
+		ff, err := shuttle.NewKinesisFormatterFunc(region, config.KinesisEndpoint, config.Transport)
+		if err != nil {
+			return nil, fmt.Errorf("Error setting up Kinesis: %s", err)
+		}
+		return ff, nil
+	case firehose:
+		ff, err := shuttle.NewFirehoseFormatterFunc(region, config.FirehoseEndpoint, config.Transport)
+		if err != nil {
+			return nil, fmt.Errorf("Error setting up Firehose: %s", err)
+		}
+		return ff, nil
 	case logs:
 		logGroup, logStream, err := DetermineCloudWatchLogsGroupInfo(u.Path)
 		if err != nil {
-			errLogger.Fatalf("Error setting up Cloudwatch: %s", err)
+			return nil, fmt.Errorf("Error setting up Cloudwatch: %s", err)
 		}
-		ff, err := shuttle.NewCloudWatchLogsFormatterFunc(region, u.Host, logGroup, logStream)
+		ff, err := shuttle.NewCloudWatchLogsFormatterFunc(region, u.Host, logGroup, logStream, config.Transport)
 		if err != nil {
-			errLogger.Fatalf("Error setting up Cloudwatch: %s", err)
+			return nil, fmt.Errorf("Error setting up Cloudwatch: %s", err)
 		}
-		return ff
+		return ff, nil
+	}
+	return nil, fmt.Errorf("Detected unsupported AWS Service from URL: %s", u.Host)
+}
+
+// IsAWSDestination returns whether DetermineOutputFormatter delivers to u with
+// an AWS client, which signs requests with the AWS credential chain.
+func IsAWSDestination(u *url.URL) bool {
+	service, err := DetermineAWSService(u.Host)
+	if err != nil {
+		return false
+	}
+	if _, err := DetermineAWSRegion(u.Host); err != nil {
+		return false
+	}
+	switch service {
+	case kinesis, firehose, logs:
+		return true
 	}
-	panic("Detected unsupported AWS Service from URL: " + u.Host)
+	return false
 }
 
 func DetermineAWSRegion(host string) (string, error) {
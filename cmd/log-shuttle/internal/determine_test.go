@@ -1,6 +1,9 @@
 package internal
 
-import "testing"
+import (
+	"net/url"
+	"testing"
+)
 
 func TestDetermineAWSRegion(t *testing.T) {
 	for _, tc := range []struct {
@@ -40,6 +43,7 @@ func TestDetermineAWSService(t *testing.T) {
 		{input: "logs.foo.amazonaws.com", expected: "logs", err: false},
 		{input: "kinesis.us-east-2.amazonaws.com", expected: "kinesis", err: false},
 		{input: "kinesis.us-east-2.amazonaws.com.cn", expected: "kinesis", err: false},
+		{input: "firehose.eu-west-1.amazonaws.com", expected: "firehose", err: false},
 	} {
 		t.Run(tc.input, func(t *testing.T) {
 			out, err := DetermineAWSService(tc.input)
@@ -53,3 +57,26 @@ func TestDetermineAWSService(t *testing.T) {
 		})
 	}
 }
+
+func TestIsAWSDestination(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected bool
+	}{
+		{input: "https://logs.example.com/logs", expected: false},
+		{input: "https://ec2-54-203-136-119.us-west-2.compute.amazonaws.com/", expected: false},
+		{input: "https://kinesis.us-east-2.amazonaws.com/stream", expected: true},
+		{input: "https://firehose.eu-west-1.amazonaws.com/stream", expected: true},
+		{input: "https://logs.us-east-2.amazonaws.com/group/stream", expected: true},
+	} {
+		t.Run(tc.input, func(t *testing.T) {
+			u, err := url.Parse(tc.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out := IsAWSDestination(u); out != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, out)
+			}
+		})
+	}
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	shuttle "github.com/heroku/log-shuttle"
 	"github.com/heroku/log-shuttle/cmd/log-shuttle/internal"
@@ -20,6 +23,13 @@ var (
 	errLogger = log.New(os.Stderr, "log-shuttle: ", log.LstdFlags)
 
 	logToSyslog bool
+	checkConfig bool
+
+	// inputs to read from instead of stdin, see fileConfig.Inputs
+	inputs []string
+
+	// oauth2Config of the default destination, used if it has a TokenURL
+	oauth2Config shuttle.OAuth2Config
 )
 
 var version = "" // log-shuttle version, set with linker
@@ -41,6 +51,207 @@ func mapInputFormat(i string) (int, error) {
 	return 0, fmt.Errorf("Unknown input format: %s", i)
 }
 
+// inputFormatName is the reverse of mapInputFormat
+func inputFormatName(i int) string {
+	switch i {
+	case shuttle.InputFormatRFC5424:
+		return "rfc5424"
+	case shuttle.InputFormatLengthPrefixedRFC5424:
+		return "lprfc5424"
+	}
+	return "raw"
+}
+
+func mapFirehoseFormat(f string) (int, error) {
+	switch f {
+	case "raw":
+		return shuttle.FirehoseFormatRaw, nil
+	case "logplex":
+		return shuttle.FirehoseFormatLogplex, nil
+	}
+	return 0, fmt.Errorf("Unknown firehose format: %s", f)
+}
+
+// firehoseFormatName is the reverse of mapFirehoseFormat
+func firehoseFormatName(f int) string {
+	if f == shuttle.FirehoseFormatLogplex {
+		return "logplex"
+	}
+	return "raw"
+}
+
+// kinesisPartitionings maps the names of Kinesis partitionings to their constants
+var kinesisPartitionings = map[string]int{
+	"round-robin":   shuttle.KinesisPartitionRoundRobin,
+	"random":        shuttle.KinesisPartitionRandom,
+	"explicit-hash": shuttle.KinesisPartitionExplicitHash,
+	"field":         shuttle.KinesisPartitionField,
+	"fixed":         shuttle.KinesisPartitionFixed,
+}
+
+func mapKinesisPartitioning(p string) (int, error) {
+	if kp, ok := kinesisPartitionings[p]; ok {
+		return kp, nil
+	}
+	return 0, fmt.Errorf("Unknown kinesis partitioning: %s", p)
+}
+
+// kinesisPartitioningName is the reverse of mapKinesisPartitioning
+func kinesisPartitioningName(kp int) string {
+	for p, k := range kinesisPartitionings {
+		if k == kp {
+			return p
+		}
+	}
+	return "round-robin"
+}
+
+// http2Modes maps the names of HTTP/2 modes to their constants
+var http2Modes = map[string]int{
+	"auto":  shuttle.HTTP2Auto,
+	"force": shuttle.HTTP2Force,
+	"off":   shuttle.HTTP2Disable,
+}
+
+func mapHTTP2(m string) (int, error) {
+	if h, ok := http2Modes[m]; ok {
+		return h, nil
+	}
+	return 0, fmt.Errorf("Unknown HTTP/2 mode: %s", m)
+}
+
+// http2Name is the reverse of mapHTTP2
+func http2Name(h int) string {
+	for m, v := range http2Modes {
+		if v == h {
+			return m
+		}
+	}
+	return "off"
+}
+
+// logLevels maps the names of log levels to their constants
+var logLevels = map[string]int{
+	"debug": shuttle.LogLevelDebug,
+	"info":  shuttle.LogLevelInfo,
+	"warn":  shuttle.LogLevelWarn,
+	"error": shuttle.LogLevelError,
+}
+
+func mapLogLevel(l string) (int, error) {
+	if v, ok := logLevels[l]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("Unknown log level: %s", l)
+}
+
+// logLevelName is the reverse of mapLogLevel
+func logLevelName(v int) string {
+	for l, lv := range logLevels {
+		if lv == v {
+			return l
+		}
+	}
+	return "info"
+}
+
+// logFormats maps the names of log formats to their constants
+var logFormats = map[string]int{
+	"logfmt": shuttle.LogFormatLogfmt,
+	"json":   shuttle.LogFormatJSON,
+}
+
+func mapLogFormat(f string) (int, error) {
+	if v, ok := logFormats[f]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("Unknown log format: %s", f)
+}
+
+// logFormatName is the reverse of mapLogFormat
+func logFormatName(v int) string {
+	for f, fv := range logFormats {
+		if fv == v {
+			return f
+		}
+	}
+	return "logfmt"
+}
+
+func mapCompression(c string) (int, error) {
+	if c == "none" {
+		return shuttle.CompressionNone, nil
+	}
+	for algorithm, encoding := range shuttle.CompressionEncodings {
+		if encoding == c {
+			return algorithm, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown compression: %s", c)
+}
+
+// compressionName is the reverse of mapCompression
+func compressionName(c int) string {
+	if encoding, ok := shuttle.CompressionEncodings[c]; ok {
+		return encoding
+	}
+	return "none"
+}
+
+func mapTLSVersion(v string) (uint16, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if tv, ok := shuttle.TLSVersions[v]; ok {
+		return tv, nil
+	}
+	return 0, fmt.Errorf("Unknown TLS version: %s", v)
+}
+
+// tlsVersionName is the reverse of mapTLSVersion
+func tlsVersionName(tv uint16) string {
+	for v, t := range shuttle.TLSVersions {
+		if t == tv {
+			return v
+		}
+	}
+	return ""
+}
+
+// applySecretEnv sets the secrets given in the environment, which unlike
+// flags don't show up in ps.
+func applySecretEnv(c *shuttle.Config) {
+	if v := os.Getenv("BEARER_TOKEN"); v != "" {
+		c.BearerAuthToken = v
+	}
+	if v := os.Getenv("LOGPLEX_TOKEN"); v != "" {
+		c.Appname = v
+	}
+	if v := os.Getenv("OAUTH2_CLIENT_SECRET"); v != "" {
+		oauth2Config.ClientSecret = v
+	}
+}
+
+// oauth2Client returns the client OAuth2 tokens are fetched with for c
+func oauth2Client(c shuttle.Config) *http.Client {
+	return &http.Client{Transport: c.Transport, Timeout: c.Timeout}
+}
+
+// validateOAuth2Config validates the OAuth2 options set with flags,
+// environment variables and the config file.
+func validateOAuth2Config(oc shuttle.OAuth2Config) error {
+	if _, err := validateURL(oc.TokenURL); err != nil {
+		return fmt.Errorf("-oauth2-token-url: %s", err)
+	}
+	if oc.ClientID == "" {
+		return fmt.Errorf("-oauth2-client-id is required with -oauth2-token-url")
+	}
+	if oc.ClientSecret == "" && oc.ClientSecretFile == "" {
+		return fmt.Errorf("-oauth2-client-secret-file or $OAUTH2_CLIENT_SECRET is required with -oauth2-token-url")
+	}
+	return nil
+}
+
 // determineLogsURL from the various options favoring each one in turn
 func determineLogsURL(logplexURL, logsURL, cmdLineURL string) string {
 	var envURL string
@@ -68,52 +279,112 @@ func determineLogsURL(logplexURL, logsURL, cmdLineURL string) string {
 
 // parseFlags overrides the properties of the given config using the provided
 // command-line flags.  Any option not overridden by a flag will be untouched.
+// A new FlagSet is used for every call so that the config can be re-parsed on
+// reload.
 func parseFlags(c shuttle.Config) (shuttle.Config, error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
 	var skipHeaders bool
 	var statsAddr string
 	var printVersion bool
-
-	flag.BoolVar(&c.Verbose, "verbose", c.Verbose, "Enable verbose debug info.")
-	flag.BoolVar(&c.SkipVerify, "skip-verify", c.SkipVerify, "Skip the verification of HTTPS server certificate.")
-	flag.BoolVar(&c.UseGzip, "gzip", c.UseGzip, "POST using gzip compression.")
-	flag.BoolVar(&c.Drop, "drop", c.Drop, "Drop (default) logs or backup & block stdin.")
-
-	flag.BoolVar(&skipHeaders, "skip-headers", skipHeaders, "Skip the prepending of rfc5424 headers.")
-	flag.BoolVar(&logToSyslog, "log-to-syslog", logToSyslog, "Log to syslog instead of stderr.")
-	flag.BoolVar(&printVersion, "version", printVersion, "Print log-shuttle version & exit.")
-
-	var inputFormat string
-
-	flag.StringVar(&c.Prival, "prival", c.Prival, "The primary value of the rfc5424 header.")
-	flag.StringVar(&c.Version, "syslog-version", c.Version, "The version of syslog.")
-	flag.StringVar(&c.Procid, "procid", c.Procid, "The procid field for the syslog header.")
-	flag.StringVar(&c.Appname, "appname", c.Appname, "The app-name field for the syslog header.")
-	flag.StringVar(&c.Appname, "logplex-token", c.Appname, "Secret logplex token.")
-	flag.StringVar(&c.Hostname, "hostname", c.Hostname, "The hostname field for the syslog header.")
-	flag.StringVar(&c.Msgid, "msgid", c.Msgid, "The msgid field for the syslog header.")
-	flag.StringVar(&c.LogsURL, "logs-url", c.LogsURL, "The receiver of the log data.")
-	flag.StringVar(&c.StatsSource, "stats-source", c.StatsSource, "When emitting stats, add source=<stats-source> to the stats.")
-	flag.StringVar(&c.BearerAuthToken, "bearer-token", c.BearerAuthToken, "Token for bearer auth, overrides basic auth in logs-url")
-
-	flag.StringVar(&inputFormat, "input-format", "raw", "'raw' (default; newline termined text), 'rfc5424' (newline terminated rfc5424), 'lprfc5424' (length prefixed rfc5424).")
-	flag.StringVar(&statsAddr, "stats-addr", "", "DEPRECATED, WILL BE REMOVED, HAS NO EFFECT.")
-
-	flag.DurationVar(&c.StatsInterval, "stats-interval", c.StatsInterval, "How often to emit/reset stats.")
-	flag.DurationVar(&c.WaitDuration, "wait", c.WaitDuration, "Duration to wait to flush messages to logs-url.")
-	flag.DurationVar(&c.Timeout, "timeout", c.Timeout, "Duration to wait for a response from logs-url.")
-
-	flag.IntVar(&c.MaxAttempts, "max-attempts", c.MaxAttempts, "Max number of retries.")
+	var configPath string
+
+	fs.BoolVar(&c.Verbose, "verbose", c.Verbose, "Enable verbose debug info.")
+	fs.BoolVar(&c.SkipVerify, "skip-verify", c.SkipVerify, "Skip the verification of HTTPS server certificate.")
+	fs.BoolVar(&c.UseGzip, "gzip", c.UseGzip, "POST using gzip compression, the same as -compression gzip.")
+	fs.BoolVar(&c.CompressionFallback, "compression-fallback", c.CompressionFallback, "Retry uncompressed, and stop compressing, when the receiver responds with a 415.")
+	fs.BoolVar(&c.Drop, "drop", c.Drop, "Drop (default) logs or backup & block stdin.")
+	fs.BoolVar(&c.Adaptive, "adaptive", c.Adaptive, "Adjust the active outlets & batch size within -min/-max-outlets & -min/-max-batch-size to the observed latency, errors and backlog.")
+	fs.BoolVar(&c.DogStatsD, "dogstatsd", c.DogStatsD, "Tag the stats pushed to -statsd-addr with -statsd-tags & source:<stats-source>, DogStatsD style.")
+	fs.BoolVar(&c.SelfLog, "self-log", c.SelfLog, "Also send log-shuttle's own warnings & errors to the logs url, as lines of -self-log-appname & -self-log-procid.")
+	fs.BoolVar(&c.RateLimitDrop, "rate-limit-drop", c.RateLimitDrop, "Discard (default) lines over the rate limits or block stdin until they are within the limits.")
+
+	fs.BoolVar(&skipHeaders, "skip-headers", skipHeaders, "Skip the prepending of rfc5424 headers.")
+	fs.BoolVar(&logToSyslog, "log-to-syslog", logToSyslog, "Log to syslog instead of stderr.")
+	fs.BoolVar(&printVersion, "version", printVersion, "Print log-shuttle version & exit.")
+	fs.BoolVar(&checkConfig, "check-config", checkConfig, "Validate the configuration & exit.")
+
+	var inputFormat, compression, firehoseFormat, kinesisPartitioning, tlsMinVersion, tlsPins, oauth2Scopes, http2, noProxy, logLevel, logFormat, statsdTags string
+
+	fs.StringVar(&configPath, "config", configPath, "YAML config file. Flags take precedence over $LOGS_URL, which takes precedence over the file.")
+
+	fs.StringVar(&c.Prival, "prival", c.Prival, "The primary value of the rfc5424 header.")
+	fs.StringVar(&c.Version, "syslog-version", c.Version, "The version of syslog.")
+	fs.StringVar(&c.Procid, "procid", c.Procid, "The procid field for the syslog header.")
+	fs.StringVar(&c.Appname, "appname", c.Appname, "The app-name field for the syslog header.")
+	fs.StringVar(&c.Appname, "logplex-token", c.Appname, "Secret logplex token. Prefer $LOGPLEX_TOKEN.")
+	fs.StringVar(&c.Hostname, "hostname", c.Hostname, "The hostname field for the syslog header.")
+	fs.StringVar(&c.Msgid, "msgid", c.Msgid, "The msgid field for the syslog header.")
+	fs.StringVar(&c.LogsURL, "logs-url", c.LogsURL, "The receiver of the log data.")
+	fs.StringVar(&c.KinesisEndpoint, "kinesis-endpoint", c.KinesisEndpoint, "Endpoint to send Kinesis requests to instead of the region's, e.g. a local stand-in.")
+	fs.StringVar(&kinesisPartitioning, "kinesis-partitioning", kinesisPartitioningName(c.KinesisPartitioning), "How Kinesis records are spread over shards: 'round-robin' (default; app-name plus up to -kinesis-shards integers), 'random', 'explicit-hash' (evenly over the stream's open shards), 'field' (hash of -kinesis-partition-field) or 'fixed' (-kinesis-partition-key, keeps ordering).")
+	fs.StringVar(&c.KinesisPartitionField, "kinesis-partition-field", c.KinesisPartitionField, "RFC5424 header field (hostname, app-name, procid or msgid) or key of a key=value pair hashed by the 'field' Kinesis partitioning.")
+	fs.StringVar(&c.KinesisPartitionKey, "kinesis-partition-key", c.KinesisPartitionKey, "Partition key of the 'fixed' Kinesis partitioning, the app-name if empty.")
+	fs.StringVar(&c.FirehoseEndpoint, "firehose-endpoint", c.FirehoseEndpoint, "Endpoint to send Firehose requests to instead of the region's, e.g. a local stand-in.")
+	fs.StringVar(&firehoseFormat, "firehose-format", firehoseFormatName(c.FirehoseFormat), "Firehose record framing: 'raw' (default; newline terminated lines) or 'logplex' (length prefixed rfc5424).")
+	fs.StringVar(&c.StatsSource, "stats-source", c.StatsSource, "When emitting stats, add source=<stats-source> to the stats.")
+	fs.StringVar(&c.StatsdAddr, "statsd-addr", c.StatsdAddr, "host:port of a statsd server to push stats to over UDP every -stats-interval.")
+	fs.StringVar(&statsdTags, "statsd-tags", strings.Join(c.StatsdTags, ","), "Comma separated 'key:value' tags of the stats pushed with -dogstatsd.")
+	fs.StringVar(&c.GraphiteAddr, "graphite-addr", c.GraphiteAddr, "host:port of a Graphite server to push stats to with the plaintext protocol every -stats-interval.")
+	fs.StringVar(&c.StatsPrefix, "stats-prefix", c.StatsPrefix, "Prefix of the names of the stats pushed to statsd & Graphite, e.g. 'log-shuttle.'.")
+	fs.StringVar(&c.BearerAuthToken, "bearer-token", c.BearerAuthToken, "Token for bearer auth, overrides basic auth in logs-url. Prefer $BEARER_TOKEN or -bearer-token-file.")
+	fs.StringVar(&c.BearerAuthTokenFile, "bearer-token-file", c.BearerAuthTokenFile, "File holding the bearer token, re-read when it changes.")
+	fs.StringVar(&c.CredentialsFile, "credentials-file", c.CredentialsFile, "File holding the 'user:password' (or AWS 'key:secret') of logs-url, re-read when it changes.")
+	fs.StringVar(&oauth2Config.TokenURL, "oauth2-token-url", oauth2Config.TokenURL, "OAuth2 token endpoint to fetch bearer tokens from with the client credentials grant.")
+	fs.StringVar(&oauth2Config.ClientID, "oauth2-client-id", oauth2Config.ClientID, "OAuth2 client id.")
+	fs.StringVar(&oauth2Config.ClientSecretFile, "oauth2-client-secret-file", oauth2Config.ClientSecretFile, "File holding the OAuth2 client secret, re-read when it changes. $OAUTH2_CLIENT_SECRET can be used instead.")
+	fs.StringVar(&oauth2Scopes, "oauth2-scopes", strings.Join(oauth2Config.Scopes, ","), "Comma separated OAuth2 scopes to request.")
+	fs.StringVar(&c.TLSCAFile, "tls-ca-file", c.TLSCAFile, "PEM bundle of CAs to verify HTTPS servers with instead of the system's.")
+	fs.StringVar(&c.TLSCertFile, "tls-cert-file", c.TLSCertFile, "PEM client certificate to present to HTTPS servers.")
+	fs.StringVar(&c.TLSKeyFile, "tls-key-file", c.TLSKeyFile, "PEM key of the client certificate.")
+	fs.StringVar(&tlsMinVersion, "tls-min-version", tlsVersionName(c.TLSMinVersion), "Minimum TLS version: '1.0', '1.1', '1.2' or '1.3'.")
+	fs.StringVar(&tlsPins, "tls-pins", strings.Join(c.TLSPins, ","), "Comma separated 'sha256/<base64>' SPKI pins, one of which the server's certificate chain must match.")
+
+	fs.StringVar(&c.Proxy, "proxy", c.Proxy, "Proxy url, with any user:password, or 'direct'. $HTTPS_PROXY, $HTTP_PROXY & $NO_PROXY are used when empty.")
+	fs.StringVar(&noProxy, "no-proxy", strings.Join(c.NoProxy, ","), "Comma separated hosts, domains, IPs & CIDRs that bypass -proxy.")
+	fs.StringVar(&http2, "http2", http2Name(c.HTTP2), "'off' (default; HTTP/1.1 only), 'auto' (negotiated with https servers) or 'force' (https servers must speak HTTP/2).")
+	fs.StringVar(&compression, "compression", compressionName(c.Compression), "Compress POST bodies with 'gzip', 'deflate', 'snappy' or 'zstd', or 'none' (default).")
+	fs.StringVar(&inputFormat, "input-format", inputFormatName(c.InputFormat), "'raw' (default; newline termined text), 'rfc5424' (newline terminated rfc5424), 'lprfc5424' (length prefixed rfc5424).")
+	fs.StringVar(&logLevel, "log-level", logLevelName(c.LogLevel), "Lowest level of log-shuttle's own diagnostics to log: 'debug', 'info' (default), 'warn' or 'error'.")
+	fs.StringVar(&c.SelfLogAppName, "self-log-appname", c.SelfLogAppName, "The app-name of -self-log lines.")
+	fs.StringVar(&c.SelfLogProcid, "self-log-procid", c.SelfLogProcid, "The procid of -self-log lines.")
+	fs.StringVar(&logFormat, "log-format", logFormatName(c.LogFormat), "Format of log-shuttle's own diagnostics: 'logfmt' (default) or 'json'.")
+	fs.StringVar(&statsAddr, "stats-addr", "", "DEPRECATED, WILL BE REMOVED, HAS NO EFFECT.")
+
+	fs.DurationVar(&c.StatsInterval, "stats-interval", c.StatsInterval, "How often to emit/reset stats.")
+	fs.DurationVar(&c.WaitDuration, "wait", c.WaitDuration, "Duration to wait to flush messages to logs-url.")
+	fs.DurationVar(&c.Timeout, "timeout", c.Timeout, "Duration to wait for a response from logs-url.")
+	fs.DurationVar(&c.DrainTimeout, "drain-timeout", c.DrainTimeout, "Duration to wait for buffered logs to be delivered on shutdown (0 waits forever).")
+	fs.DurationVar(&c.IdleConnTimeout, "idle-conn-timeout", c.IdleConnTimeout, "Duration to keep idle connections open (0 keeps them forever).")
+	fs.DurationVar(&c.KeepAlive, "keep-alive", c.KeepAlive, "TCP keep-alive period (0 is Go's default of 15s, negative disables).")
+	fs.DurationVar(&c.DNSRefreshInterval, "dns-refresh-interval", c.DNSRefreshInterval, "How often to close idle connections so that hosts are re-resolved (0 disables).")
+	fs.DurationVar(&c.AdaptiveInterval, "adaptive-interval", c.AdaptiveInterval, "How often -adaptive adjusts the outlets & batch size.")
+	fs.DurationVar(&c.AdaptiveLatency, "adaptive-latency", c.AdaptiveLatency, "Mean post latency above which -adaptive backs off (0 disables).")
+
+	fs.IntVar(&c.MaxAttempts, "max-attempts", c.MaxAttempts, "Max number of retries.")
 	var b int
-	flag.IntVar(&b, "num-batchers", b, "[NO EFFECT/REMOVED] The number of batchers to run.")
-	flag.IntVar(&c.NumOutlets, "num-outlets", c.NumOutlets, "The number of outlets to run.")
-	flag.IntVar(&c.BatchSize, "batch-size", c.BatchSize, "Number of messages to pack into an application/logplex-1 http request.")
+	fs.IntVar(&b, "num-batchers", b, "[NO EFFECT/REMOVED] The number of batchers to run.")
+	fs.IntVar(&c.NumOutlets, "num-outlets", c.NumOutlets, "The number of outlets to run.")
+	fs.IntVar(&c.BatchSize, "batch-size", c.BatchSize, "Number of messages to pack into an application/logplex-1 http request.")
+	fs.IntVar(&c.MaxIdleConns, "max-idle-conns", c.MaxIdleConns, "Max number of idle connections to keep (0 is unlimited).")
+	fs.IntVar(&c.MaxIdleConnsPerHost, "max-idle-conns-per-host", c.MaxIdleConnsPerHost, "Max number of idle connections to keep per host (0 is one per outlet).")
+	fs.IntVar(&c.MaxConnsPerHost, "max-conns-per-host", c.MaxConnsPerHost, "Max number of connections per host (0 is unlimited).")
+	fs.IntVar(&c.MinOutlets, "min-outlets", c.MinOutlets, "Fewest active outlets with -adaptive (0 is 1).")
+	fs.IntVar(&c.MaxOutlets, "max-outlets", c.MaxOutlets, "Most active outlets with -adaptive (0 is -num-outlets).")
+	fs.IntVar(&c.MinBatchSize, "min-batch-size", c.MinBatchSize, "Smallest batch size with -adaptive (0 is 1).")
+	fs.IntVar(&c.MaxBatchSize, "max-batch-size", c.MaxBatchSize, "Largest batch size with -adaptive (0 is -batch-size).")
+	fs.IntVar(&c.MaxBatchBytes, "max-batch-bytes", c.MaxBatchBytes, "Max number of formatted bytes to pack into a request (0 is unlimited).")
 	var f int
-	flag.IntVar(&f, "front-buff", f, "[NO EFFECT/REMOVED] Number of messages to buffer in log-shuttle's input channel.")
-	flag.IntVar(&c.BackBuff, "back-buff", c.BackBuff, "Number of batches to buffer before dropping.")
-	flag.IntVar(&c.MaxLineLength, "max-line-length", c.MaxLineLength, "Number of bytes that the backend allows per line.")
-	flag.IntVar(&c.KinesisShards, "kinesis-shards", c.KinesisShards, "Number of unique partition keys to use per app.")
+	fs.IntVar(&f, "front-buff", f, "[NO EFFECT/REMOVED] Number of messages to buffer in log-shuttle's input channel.")
+	fs.IntVar(&c.BackBuff, "back-buff", c.BackBuff, "Number of batches to buffer before dropping.")
+	fs.IntVar(&c.MaxLineLength, "max-line-length", c.MaxLineLength, "Number of bytes that the backend allows per line.")
+	fs.IntVar(&c.CompressionLevel, "compression-level", c.CompressionLevel, "Compression level: 1-9 for gzip & deflate, 1-22 for zstd, 0 for the algorithm's default.")
+	fs.IntVar(&c.KinesisShards, "kinesis-shards", c.KinesisShards, "Number of unique partition keys to use per app.")
+	fs.IntVar(&c.RateLimitLines, "rate-limit-lines", c.RateLimitLines, "Max number of lines per second to read from stdin (0 disables).")
+	fs.IntVar(&c.RateLimitBytes, "rate-limit-bytes", c.RateLimitBytes, "Max number of bytes per second to read from stdin (0 disables).")
+	fs.IntVar(&c.SelfLogRate, "self-log-rate", c.SelfLogRate, "Max number of -self-log lines per second, the rest are counted by selflog.suppressed.")
 
-	flag.Parse()
+	fs.Parse(os.Args[1:])
 
 	if printVersion {
 		fmt.Println(version)
@@ -138,6 +409,67 @@ func parseFlags(c shuttle.Config) (shuttle.Config, error) {
 		return c, err
 	}
 
+	c.HTTP2, err = mapHTTP2(http2)
+	if err != nil {
+		return c, err
+	}
+
+	c.LogLevel, err = mapLogLevel(logLevel)
+	if err != nil {
+		return c, err
+	}
+
+	c.LogFormat, err = mapLogFormat(logFormat)
+	if err != nil {
+		return c, err
+	}
+
+	c.Compression, err = mapCompression(compression)
+	if err != nil {
+		return c, err
+	}
+	if err := shuttle.ValidateCompression(c); err != nil {
+		return c, err
+	}
+
+	c.FirehoseFormat, err = mapFirehoseFormat(firehoseFormat)
+	if err != nil {
+		return c, err
+	}
+
+	c.KinesisPartitioning, err = mapKinesisPartitioning(kinesisPartitioning)
+	if err != nil {
+		return c, err
+	}
+	if c.KinesisPartitioning == shuttle.KinesisPartitionField && c.KinesisPartitionField == "" {
+		return c, fmt.Errorf("-kinesis-partition-field is required by the 'field' Kinesis partitioning")
+	}
+
+	c.TLSMinVersion, err = mapTLSVersion(tlsMinVersion)
+	if err != nil {
+		return c, err
+	}
+
+	c.TLSPins = nil
+	if tlsPins != "" {
+		c.TLSPins = strings.Split(tlsPins, ",")
+	}
+
+	c.NoProxy = nil
+	if noProxy != "" {
+		c.NoProxy = strings.Split(noProxy, ",")
+	}
+
+	c.StatsdTags = nil
+	if statsdTags != "" {
+		c.StatsdTags = strings.Split(statsdTags, ",")
+	}
+
+	oauth2Config.Scopes = nil
+	if oauth2Scopes != "" {
+		oauth2Config.Scopes = strings.Split(oauth2Scopes, ",")
+	}
+
 	if skipHeaders {
 		log.Println("Warning: Use of -skip-headers is deprecated, use -input-format=rfc5424 instead")
 		switch c.InputFormat {
@@ -189,7 +521,25 @@ func validateURL(u string) (*url.URL, error) {
 }
 
 func getConfig() (shuttle.Config, error) {
-	c, err := parseFlags(shuttle.NewConfig())
+	c := shuttle.NewConfig()
+	oauth2Config = shuttle.OAuth2Config{}
+
+	// The config file is applied first so that flags take precedence over it
+	var fc *fileConfig
+	if path := lookupConfigPath(os.Args[1:]); path != "" {
+		var err error
+		if fc, err = loadConfigFile(path); err != nil {
+			return c, fmt.Errorf("Invalid config file %s: %s", path, err)
+		}
+		fc.apply(&c)
+		inputs = fc.Inputs
+	}
+
+	// Secrets from the environment take precedence over the file, but not
+	// over flags.
+	applySecretEnv(&c)
+
+	c, err := parseFlags(c)
 	if err != nil {
 		return c, err
 	}
@@ -199,16 +549,103 @@ func getConfig() (shuttle.Config, error) {
 	}
 
 	c.LogsURL = determineLogsURL(os.Getenv("LOGPLEX_URL"), os.Getenv("LOGS_URL"), c.LogsURL)
+	if c.LogsURL == "" && fc != nil {
+		c.LogsURL = fc.LogsURL
+	}
 	oURL, err := validateURL(c.LogsURL)
 	if err != nil {
 		return c, err
 	}
 
-	if oURL.User == nil {
+	// AWS clients would take the logplex token for static AWS keys instead of
+	// using the credential chain.
+	if oURL.User == nil && !internal.IsAWSDestination(oURL) {
 		oURL.User = url.UserPassword("token", c.Appname)
 	}
 
-	c.FormatterFunc = internal.DetermineOutputFormatter(oURL, errLogger)
+	if c.KinesisEndpoint != "" {
+		if _, err := validateURL(c.KinesisEndpoint); err != nil {
+			return c, fmt.Errorf("-kinesis-endpoint: %s", err)
+		}
+	}
+
+	if c.MaxBatchBytes < 0 {
+		return c, fmt.Errorf("-max-batch-bytes: must be >= 0, got %d", c.MaxBatchBytes)
+	}
+
+	for _, o := range []struct {
+		name string
+		v    int
+	}{
+		{"-max-idle-conns", c.MaxIdleConns},
+		{"-max-idle-conns-per-host", c.MaxIdleConnsPerHost},
+		{"-max-conns-per-host", c.MaxConnsPerHost},
+		{"-min-outlets", c.MinOutlets},
+		{"-max-outlets", c.MaxOutlets},
+		{"-min-batch-size", c.MinBatchSize},
+		{"-max-batch-size", c.MaxBatchSize},
+	} {
+		if o.v < 0 {
+			return c, fmt.Errorf("%s: must be >= 0, got %d", o.name, o.v)
+		}
+	}
+	if err := shuttle.ValidateAdaptive(c); err != nil {
+		return c, fmt.Errorf("-adaptive: %s", err)
+	}
+	if err := shuttle.ValidateSelfLog(c); err != nil {
+		return c, fmt.Errorf("-self-log: %s", err)
+	}
+	if err := shuttle.ValidateMetricsBackends(c); err != nil {
+		return c, err
+	}
+
+	if c.FirehoseEndpoint != "" {
+		if _, err := validateURL(c.FirehoseEndpoint); err != nil {
+			return c, fmt.Errorf("-firehose-endpoint: %s", err)
+		}
+	}
+
+	if err := shuttle.ValidateTLSConfig(c); err != nil {
+		return c, err
+	}
+	c.Transport = shuttle.NewHTTPTransport(c)
+
+	if oauth2Config.TokenURL != "" {
+		if err := validateOAuth2Config(oauth2Config); err != nil {
+			return c, err
+		}
+		c.Auth = shuttle.NewOAuth2ClientCredentials(oauth2Config, oauth2Client(c))
+	}
+
+	if fc != nil {
+		if err := fc.applyDestinations(&c); err != nil {
+			return c, err
+		}
+	}
+
+	if err := shuttle.ValidateProxy(c); err != nil {
+		return c, fmt.Errorf("-proxy: %s", err)
+	}
+
+	if err := shuttle.ValidateSecretFiles(c); err != nil {
+		return c, err
+	}
+
+	if checkConfig {
+		// Determining the output formatters may talk to the destinations, so
+		// stop here.
+		return c, nil
+	}
+
+	if c.FormatterFunc, err = internal.DetermineOutputFormatter(oURL, c); err != nil {
+		return c, err
+	}
+	for i, r := range c.Routes {
+		rURL, _ := url.Parse(r.LogsURL) // already validated
+		if c.Routes[i].FormatterFunc, err = internal.DetermineOutputFormatter(rURL, r.DestinationConfig(c)); err != nil {
+			return c, fmt.Errorf("destination %s: %s", r.Name, err)
+		}
+	}
 
 	c.LogsURL = oURL.String()
 
@@ -223,10 +660,15 @@ func main() {
 		errLogger.Fatalf("error=%q\n", err)
 	}
 
+	if checkConfig {
+		fmt.Println("config ok")
+		os.Exit(0)
+	}
+
 	config.ID = version
 
-	if !useStdin() {
-		errLogger.Fatalln(`error="No stdin detected."`)
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
 	}
 
 	s := shuttle.NewShuttle(config)
@@ -235,16 +677,75 @@ func main() {
 		errLogger.Fatal(err)
 	}
 
-	s.LoadReader(os.Stdin)
+	for _, in := range inputs {
+		if in == "-" {
+			if !useStdin() {
+				errLogger.Fatalln(`error="No stdin detected."`)
+			}
+			s.LoadReader(os.Stdin)
+			continue
+		}
+		f, err := os.Open(in)
+		if err != nil {
+			errLogger.Fatalf("error=%q\n", err)
+		}
+		s.LoadReader(f)
+	}
+
+	// cancelled when we're told to shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-shutdownSignals(s)
+		cancel()
+	}()
+
+	// Handled from now on so that SIGHUP doesn't exit, but reloading fails,
+	// keeping the config, until Run launches the shuttle.
+	go reloadOnHUP(s)
+	metricsReporters := []*shuttle.MetricsReporter{shuttle.NewMetricsReporter(s.MetricsRegistry, config.StatsSource, s.Logger)}
+	if config.StatsdAddr != "" {
+		statsd, err := shuttle.NewStatsdReporter(s.MetricsRegistry, config, s.ErrLogger)
+		if err != nil {
+			errLogger.Fatalf("error=%q\n", err)
+		}
+		metricsReporters = append(metricsReporters, statsd)
+	}
+	if config.GraphiteAddr != "" {
+		metricsReporters = append(metricsReporters, shuttle.NewGraphiteReporter(s.MetricsRegistry, config, s.ErrLogger))
+	}
+	for _, mr := range metricsReporters {
+		mr.LogFormat = config.LogFormat
+		mr.Start(config.StatsInterval)
+	}
 
-	s.Launch()
-	metricsReporter := shuttle.NewMetricsReporter(s.MetricsRegistry, config.StatsSource, s.Logger)
-	go metricsReporter.Emit(config.StatsInterval)
+	// blocks until the readers all exit or we're told to shutdown
+	s.Run(ctx)
 
-	// blocks until the readers all exit
-	s.WaitForReadersToFinish()
+	shutdown(s, config.DrainTimeout, errLogger)
+	// Stopping emits the metrics a final time, even without a stats interval
+	for _, mr := range metricsReporters {
+		mr.Stop()
+	}
+}
 
-	// Shutdown the shuttle.
-	s.Land()
-	metricsReporter.Stop()
+// shutdown s, waiting up to drainTimeout (forever if 0) for delivery, and log
+// its summary. The lines still undelivered by then are logged as lost through
+// stderr, even when s logs to syslog.
+func shutdown(s *shuttle.Shuttle, drainTimeout time.Duration, stderr *log.Logger) shuttle.Summary {
+	drain := context.Background()
+	if drainTimeout > 0 {
+		var cancelDrain context.CancelFunc
+		drain, cancelDrain = context.WithTimeout(drain, drainTimeout)
+		defer cancelDrain()
+	}
+	sum, err := s.Shutdown(drain)
+	if err != nil {
+		events := s.Events()
+		events.ErrLogger = stderr
+		events.Error("shutdown", "drain_timeout", drainTimeout, "lost", sum.Undelivered, "error", err)
+	}
+	s.Events().Info("summary", "read", sum.Read, "filtered", sum.Filtered, "rate_limited", sum.RateLimited,
+		"delivered", sum.Delivered, "dropped", sum.Dropped, "lost", sum.Lost)
+	return sum
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	shuttle "github.com/heroku/log-shuttle"
+)
+
+// reloadOnHUP re-reads the configuration every time a SIGHUP is received and
+// swaps the shuttle's outlets to use it. Invalid configurations are logged and
+// the previous configuration is kept.
+func reloadOnHUP(s *shuttle.Shuttle) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		reload(s)
+	}
+}
+
+func reload(s *shuttle.Shuttle) {
+	config, err := getConfig()
+	if err != nil {
+		s.Events().Error("reload", "error", err, "keeping", "previous")
+		return
+	}
+	config.ID = version
+
+	if err := s.Reload(config); err != nil {
+		s.Events().Error("reload", "error", err, "keeping", "previous")
+		return
+	}
+	s.Events().Info("reload", "status", "ok")
+}
+
+// shutdownSignals returns a channel that is closed when the first SIGTERM or
+// SIGINT is received, which is logged through the events of s. Any further
+// signal exits immediately.
+func shutdownSignals(s *shuttle.Shuttle) <-chan struct{} {
+	term := make(chan os.Signal, 2)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	shutdown := make(chan struct{})
+	go func() {
+		sig := <-term
+		s.Events().Warn("shutdown", "signal", sig)
+		close(shutdown)
+		sig = <-term
+		s.Events().Warn("shutdown", "signal", sig, "forced", true)
+		os.Exit(1)
+	}()
+	return shutdown
+}
@@ -0,0 +1,205 @@
+package shuttle
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithm constants, see Config.Compression.
+const (
+	CompressionNone    = iota // default, unless UseGzip is set
+	CompressionGzip           // gzip, levels 1 to 9
+	CompressionDeflate        // zlib wrapped deflate (the "deflate" Content-Encoding), levels 1 to 9
+	CompressionSnappy         // snappy block format, without levels
+	CompressionZstd           // zstd, levels 1 to 22
+)
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// CompressionEncodings are the Content-Encodings of the compression algorithms
+var CompressionEncodings = map[int]string{
+	CompressionGzip:    "gzip",
+	CompressionDeflate: "deflate",
+	CompressionSnappy:  "snappy",
+	CompressionZstd:    "zstd",
+}
+
+// compressionLevels are the [min, max] levels of the compression algorithms
+// that have levels
+var compressionLevels = map[int][2]int{
+	CompressionGzip:    {gzip.BestSpeed, gzip.BestCompression},
+	CompressionDeflate: {zlib.BestSpeed, zlib.BestCompression},
+	CompressionZstd:    {1, 22},
+}
+
+// compression returns the algorithm request bodies are compressed with.
+// UseGzip selects gzip when Compression isn't set.
+func (c *Config) compression() int {
+	if c.Compression == CompressionNone && c.UseGzip {
+		return CompressionGzip
+	}
+	return c.Compression
+}
+
+// ValidateCompression returns an error if config's compression algorithm is
+// unknown or its level is out of the algorithm's range. A level of 0 is the
+// algorithm's default.
+func ValidateCompression(config Config) error {
+	algorithm := config.compression()
+	if algorithm == CompressionNone {
+		return nil
+	}
+	encoding, ok := CompressionEncodings[algorithm]
+	if !ok {
+		return fmt.Errorf("unknown compression algorithm: %d", algorithm)
+	}
+	if config.CompressionLevel == 0 {
+		return nil
+	}
+	levels, ok := compressionLevels[algorithm]
+	if !ok {
+		return fmt.Errorf("%s compression has no levels", encoding)
+	}
+	if config.CompressionLevel < levels[0] || config.CompressionLevel > levels[1] {
+		return fmt.Errorf("%s compression level must be between %d and %d, got %d", encoding, levels[0], levels[1], config.CompressionLevel)
+	}
+	return nil
+}
+
+// CompressFormatter is an HTTPFormatter that is built with a delegate
+// HTTPFormatter but which compresses the request body with one of the
+// Compression algorithms, setting the Content-Encoding accordingly.
+type CompressFormatter struct {
+	delegate  HTTPFormatter
+	algorithm int
+	level     int
+	bytesIn   int64 // accessed atomically
+	bytesOut  int64 // accessed atomically
+	reader    *io.PipeReader
+	writer    *io.PipeWriter
+	once      *sync.Once
+}
+
+// NewCompressFormatter builds a new CompressFormatter compressing the
+// delegate's body with algorithm at level, or the algorithm's default level
+// if level is 0.
+func NewCompressFormatter(delegate HTTPFormatter, algorithm, level int) *CompressFormatter {
+	reader, writer := io.Pipe()
+	return &CompressFormatter{
+		delegate:  delegate,
+		algorithm: algorithm,
+		level:     level,
+		reader:    reader,
+		writer:    writer,
+		once:      new(sync.Once),
+	}
+}
+
+// newCompressWriter returns a writer compressing to w with algorithm at level
+func newCompressWriter(w io.Writer, algorithm, level int) (io.WriteCloser, error) {
+	switch algorithm {
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionDeflate:
+		if level == 0 {
+			level = zlib.DefaultCompression
+		}
+		return zlib.NewWriterLevel(w, level)
+	case CompressionSnappy:
+		return &snappyWriter{w: w}, nil
+	case CompressionZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	}
+	return nil, fmt.Errorf("unknown compression algorithm: %d", algorithm)
+}
+
+// snappyWriter buffers everything written to it and writes it to w as one
+// snappy block on Close, as the snappy Content-Encoding isn't framed.
+type snappyWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (s *snappyWriter) Write(p []byte) (int, error) {
+	return s.buf.Write(p)
+}
+
+func (s *snappyWriter) Close() error {
+	_, err := s.w.Write(s2.EncodeSnappy(nil, s.buf.Bytes()))
+	return err
+}
+
+func (c *CompressFormatter) compress() {
+	cw, err := newCompressWriter(c.writer, c.algorithm, c.level)
+	if err != nil {
+		c.writer.CloseWithError(err)
+		return
+	}
+	n, err := io.Copy(cw, c.delegate)
+	atomic.AddInt64(&c.bytesIn, n)
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+	c.writer.CloseWithError(err) // Same as Close if err is nil
+}
+
+// MsgCount return the number of messages contained in the formatted batch
+func (c *CompressFormatter) MsgCount() int {
+	return c.delegate.MsgCount()
+}
+
+// Request returns a http.Request to be used with a http.Client
+// The request has it's body and headers set as necessary
+func (c *CompressFormatter) Request() (*http.Request, error) {
+	request, err := c.delegate.Request()
+	if err != nil {
+		return request, err
+	}
+
+	request.Body = ioutil.NopCloser(c)
+	request.Header.Add("Content-Encoding", CompressionEncodings[c.algorithm])
+	return request, nil
+}
+
+// Read bytes from the formatter stream
+func (c *CompressFormatter) Read(p []byte) (int, error) {
+	c.once.Do(func() {
+		go c.compress()
+	})
+	n, err := c.reader.Read(p)
+	atomic.AddInt64(&c.bytesOut, int64(n))
+	return n, err
+}
+
+// Close the stream
+func (c *CompressFormatter) Close() error {
+	return c.reader.Close()
+}
+
+// BytesIn returns the number of bytes compressed so far
+func (c *CompressFormatter) BytesIn() int64 {
+	return atomic.LoadInt64(&c.bytesIn)
+}
+
+// BytesOut returns the number of compressed bytes read so far
+func (c *CompressFormatter) BytesOut() int64 {
+	return atomic.LoadInt64(&c.bytesOut)
+}
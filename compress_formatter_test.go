@@ -0,0 +1,164 @@
+package shuttle
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// decompress body, as encoded with encoding
+func decompress(t *testing.T, encoding string, body []byte) string {
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	case "zstd":
+		var d *zstd.Decoder
+		d, err = zstd.NewReader(bytes.NewReader(body))
+		if err == nil {
+			defer d.Close()
+		}
+		r = d
+	case "snappy":
+		var d []byte
+		d, err = s2.Decode(nil, body)
+		r = bytes.NewReader(d)
+	default:
+		r = bytes.NewReader(body)
+	}
+	if err != nil {
+		t.Fatalf("error decompressing %s: %s", encoding, err)
+	}
+	d, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("error decompressing %s: %s", encoding, err)
+	}
+	return string(d)
+}
+
+func TestCompressFormatter(t *testing.T) {
+	testString := strings.Repeat("Hi there! ", 100)
+	for _, tc := range []struct {
+		algorithm, level int
+	}{
+		{CompressionGzip, 0},
+		{CompressionGzip, 9},
+		{CompressionDeflate, 1},
+		{CompressionSnappy, 0},
+		{CompressionZstd, 0},
+		{CompressionZstd, 19},
+	} {
+		encoding := CompressionEncodings[tc.algorithm]
+		cf := NewCompressFormatter(&fakeFormatter{strings.NewReader(testString)}, tc.algorithm, tc.level)
+		req, err := cf.Request()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ce := req.Header.Get("Content-Encoding"); ce != encoding {
+			t.Errorf("expected Content-Encoding %s, got %q", encoding, ce)
+		}
+
+		compressed, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := decompress(t, encoding, compressed); d != testString {
+			t.Errorf("%s level %d: unexpected body %q", encoding, tc.level, d)
+		}
+		if cf.BytesIn() != int64(len(testString)) || cf.BytesOut() != int64(len(compressed)) || cf.BytesOut() >= cf.BytesIn() {
+			t.Errorf("%s level %d: unexpected byte counts, in=%d out=%d", encoding, tc.level, cf.BytesIn(), cf.BytesOut())
+		}
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	for _, tc := range []struct {
+		algorithm, level int
+		gzip             bool
+		err              string
+	}{
+		{CompressionNone, 0, false, ""},
+		{CompressionNone, 10, true, "gzip compression level must be between 1 and 9, got 10"},
+		{CompressionDeflate, 9, false, ""},
+		{CompressionZstd, 22, false, ""},
+		{CompressionZstd, 23, false, "zstd compression level must be between 1 and 22, got 23"},
+		{CompressionSnappy, 1, false, "snappy compression has no levels"},
+		{42, 0, false, "unknown compression algorithm: 42"},
+	} {
+		config := newTestConfig()
+		config.Compression, config.CompressionLevel, config.UseGzip = tc.algorithm, tc.level, tc.gzip
+		err := ValidateCompression(config)
+		if (err == nil) != (tc.err == "") || (err != nil && err.Error() != tc.err) {
+			t.Errorf("%d level %d: expected error %q, got %v", tc.algorithm, tc.level, tc.err, err)
+		}
+	}
+}
+
+func TestOutletCompression(t *testing.T) {
+	var encodings, bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ce := r.Header.Get("Content-Encoding")
+		body, _ := ioutil.ReadAll(r.Body)
+		encodings = append(encodings, ce)
+		bodies = append(bodies, decompress(t, ce, body))
+		if ce == "zstd" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+		}
+	}))
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.Compression = CompressionZstd
+	config.CompressionFallback = true
+
+	s := NewShuttle(config)
+	outlet := NewHTTPOutlet(s)
+	for i := 0; i < 2; i++ {
+		batch := NewBatch(config.BatchSize)
+		batch.Add(LogLine{line: []byte("Hello"), when: time.Now()})
+		outlet.retryPost(batch)
+	}
+
+	if strings.Join(encodings, ",") != "zstd,," {
+		t.Errorf("expected a zstd request, then uncompressed ones, got %q", encodings)
+	}
+	for _, body := range bodies {
+		if !strings.Contains(body, "Hello") {
+			t.Errorf("unexpected body %q", body)
+		}
+	}
+	if lost := s.Lost.Read(); lost != 0 {
+		t.Errorf("expected nothing lost, got %d", lost)
+	}
+	in := s.MetricsRegistry.Get("outlet.compression.in.bytes").(interface{ Count() int64 }).Count()
+	out := s.MetricsRegistry.Get("outlet.compression.out.bytes").(interface{ Count() int64 }).Count()
+	if in != int64(len(bodies[0])) || out == 0 {
+		t.Errorf("expected the compressed request to be counted, in=%d out=%d", in, out)
+	}
+
+	// Without the fallback a 415 isn't special
+	encodings = nil
+	config.CompressionFallback = false
+	config.MaxAttempts = 1
+	outlet = NewHTTPOutlet(NewShuttle(config))
+	batch := NewBatch(config.BatchSize)
+	batch.Add(LogLine{line: []byte("Hello"), when: time.Now()})
+	outlet.retryPost(batch)
+	if strings.Join(encodings, ",") != "zstd" {
+		t.Errorf("expected a single zstd request, got %q", encodings)
+	}
+}
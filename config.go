@@ -3,6 +3,8 @@ package shuttle
 import (
 	"fmt"
 	"log"
+	"net/http"
+	"regexp"
 	"time"
 )
 
@@ -16,34 +18,52 @@ const (
 
 // Default option values
 const (
-	DefaultMaxLineLength = 10000 // Logplex max is 10000 bytes, so default to that
-	DefaultInputFormat   = InputFormatRaw
-	DefaultBackBuff      = 50
-	DefaultTimeout       = 5 * time.Second
-	DefaultWaitDuration  = 250 * time.Millisecond
-	DefaultMaxAttempts   = 3
-	DefaultStatsInterval = 0 * time.Second
-	DefaultStatsSource   = ""
-	DefaultVerbose       = false
-	DefaultSkipVerify    = false
-	DefaultPriVal        = "190"
-	DefaultVersion       = "1"
-	DefaultProcID        = "shuttle"
-	DefaultAppName       = "token"
-	DefaultHostname      = "shuttle"
-	DefaultMsgID         = "- -"
-	DefaultLogsURL       = ""
-	DefaultNumOutlets    = 4
-	DefaultBatchSize     = 500
-	DefaultID            = ""
-	DefaultDrop          = true
-	DefaultUseGzip       = false
-	DefaultKinesisShards = 1
+	DefaultMaxLineLength    = 10000 // Logplex max is 10000 bytes, so default to that
+	DefaultInputFormat      = InputFormatRaw
+	DefaultBackBuff         = 50
+	DefaultTimeout          = 5 * time.Second
+	DefaultWaitDuration     = 250 * time.Millisecond
+	DefaultMaxAttempts      = 3
+	DefaultStatsInterval    = 0 * time.Second
+	DefaultStatsSource      = ""
+	DefaultVerbose          = false
+	DefaultSkipVerify       = false
+	DefaultPriVal           = "190"
+	DefaultVersion          = "1"
+	DefaultProcID           = "shuttle"
+	DefaultAppName          = "token"
+	DefaultHostname         = "shuttle"
+	DefaultMsgID            = "- -"
+	DefaultLogsURL          = ""
+	DefaultNumOutlets       = 4
+	DefaultBatchSize        = 500
+	DefaultID               = ""
+	DefaultDrop             = true
+	DefaultUseGzip          = false
+	DefaultCompression      = CompressionNone
+	DefaultKinesisShards    = 1
+	DefaultFirehoseFormat   = FirehoseFormatRaw
+	DefaultRateLimitLines   = 0
+	DefaultRateLimitBytes   = 0
+	DefaultRateLimitDrop    = true
+	DefaultDrainTimeout     = 0 * time.Second
+	DefaultAdaptive         = false
+	DefaultAdaptiveInterval = 5 * time.Second
+	DefaultAdaptiveLatency  = time.Second
+	DefaultHTTP2            = HTTP2Disable
+	DefaultIdleConnTimeout  = 90 * time.Second
+	DefaultLogLevel         = LogLevelInfo
+	DefaultLogFormat        = LogFormatLogfmt
+	DefaultSelfLog          = false
+	DefaultSelfLogAppName   = "log-shuttle"
+	DefaultSelfLogProcid    = "self"
+	DefaultSelfLogRate      = 10
 )
 
 const (
 	errDrop errType = iota
 	errLost
+	errRateLimited
 )
 
 // Defaults that can't be constants
@@ -64,10 +84,25 @@ type Config struct {
 	MaxLineLength                       int
 	BackBuff                            int
 	BatchSize                           int
+	MaxBatchBytes                       int // Most formatted bytes per batch, 0 is unlimited
 	NumOutlets                          int
+	MinOutlets                          int // Fewest active outlets per destination with Adaptive, 1 when 0
+	MaxOutlets                          int // Most active outlets per destination with Adaptive, NumOutlets when 0
+	MinBatchSize                        int // Smallest batch size with Adaptive, 1 when 0
+	MaxBatchSize                        int // Largest batch size with Adaptive, BatchSize when 0
 	InputFormat                         int
 	MaxAttempts                         int
 	KinesisShards                       int
+	Compression                         int // Algorithm request bodies are compressed with, e.g. CompressionZstd
+	CompressionLevel                    int // Level of the Compression algorithm, 0 is its default
+	KinesisPartitioning                 int // How records are spread over shards, e.g. KinesisPartitionRandom
+	FirehoseFormat                      int // Framing of Firehose records, FirehoseFormatRaw or FirehoseFormatLogplex
+	RateLimitLines                      int // Max lines per second per reader, 0 disables
+	MaxIdleConns                        int // Most idle connections kept by NewHTTPTransport, 0 is unlimited
+	MaxIdleConnsPerHost                 int // Most idle connections kept per host, 0 is one per outlet
+	MaxConnsPerHost                     int // Most connections per host, 0 is unlimited
+	HTTP2                               int // HTTP2Disable, HTTP2Auto or HTTP2Force
+	RateLimitBytes                      int // Max bytes per second per reader, 0 disables
 	LogsURL                             string
 	Prival                              string
 	Version                             string
@@ -76,18 +111,56 @@ type Config struct {
 	Appname                             string
 	Msgid                               string
 	StatsSource                         string
+	KinesisEndpoint                     string   // Endpoint used instead of the region's by NewKinesisFormatterFunc's client
+	KinesisPartitionField               string   // Header field or key=value key hashed by KinesisPartitionField, see KinesisPartitionHeaderFields
+	KinesisPartitionKey                 string   // Key of KinesisPartitionFixed, the app-name if empty
+	FirehoseEndpoint                    string   // Endpoint used instead of the region's by NewFirehoseFormatterFunc's client
+	SelfLogAppName                      string   // The app-name of the lines sent with SelfLog
+	StatsPrefix                         string   // Prepended to the names of metrics pushed to statsd & Graphite
+	StatsdAddr                          string   // host:port metrics are pushed to over UDP, see NewStatsdReporter
+	StatsdTags                          []string // DogStatsD "key:value" tags of the pushed metrics
+	GraphiteAddr                        string   // host:port metrics are pushed to over TCP, see NewGraphiteReporter
+	SelfLogProcid                       string   // The procid of the lines sent with SelfLog
+	Proxy                               string   // Proxy url, with any credentials, or ProxyDirect. $HTTPS_PROXY, $HTTP_PROXY & $NO_PROXY are used when empty
+	NoProxy                             []string // Hosts, domains, IPs & CIDRs that bypass Proxy, like $NO_PROXY
 	BearerAuthToken                     string
+	BearerAuthTokenFile                 string   // File holding BearerAuthToken, re-read when it changes
+	CredentialsFile                     string   // File holding the "user:password" of LogsURL (basic auth or AWS keys), re-read when it changes
+	TLSCAFile                           string   // PEM bundle of CAs to verify servers with instead of the system's
+	TLSCertFile                         string   // PEM client certificate presented to servers, requires TLSKeyFile
+	TLSKeyFile                          string   // PEM key of TLSCertFile
+	TLSPins                             []string // base64 SHA-256 digests of SPKIs, one of which the server's chain must have, see SPKIPin
+	TLSMinVersion                       uint16   // Minimum TLS version, e.g. tls.VersionTLS12, 0 is Go's default
 	SkipVerify                          bool
-	Verbose                             bool
-	UseGzip                             bool
+	Verbose                             bool // Log debug lines too, like LogLevel = LogLevelDebug
+	LogLevel                            int  // The lowest level of log-shuttle's own diagnostics that's logged, see EventLogger
+	LogFormat                           int  // LogFormatLogfmt or LogFormatJSON
+	SelfLog                             bool // Also send the warnings & errors of log-shuttle's diagnostics through the shuttle
+	SelfLogRate                         int  // Most diagnostics sent per second with SelfLog, DefaultSelfLogRate when <= 0
+	DogStatsD                           bool // Push DogStatsD tags to StatsdAddr
+	UseGzip                             bool // Shorthand for Compression = CompressionGzip
+	CompressionFallback                 bool // Retry uncompressed, and stop compressing, when the receiver responds with a 415
 	Drop                                bool
+	RateLimitDrop                       bool // Discard (default) or block lines over the rate limits
+	Adaptive                            bool // Adjust the active outlets & batch size to the observed latency, errors and inbox depth
 	WaitDuration                        time.Duration
 	Timeout                             time.Duration
 	StatsInterval                       time.Duration
+	DrainTimeout                        time.Duration // How long LandWithin waits for delivery, 0 waits forever
+	AdaptiveInterval                    time.Duration // How often Adaptive adjusts the outlets & batch size
+	AdaptiveLatency                     time.Duration // Mean post latency above which Adaptive backs off, 0 disables
+	IdleConnTimeout                     time.Duration // How long idle connections are kept, 0 is forever
+	KeepAlive                           time.Duration // TCP keep-alive period, 0 is Go's default, negative disables
+	DNSRefreshInterval                  time.Duration // How often idle connections are closed so hosts are re-resolved, 0 disables
 	lengthPrefixedSyslogFrameHeaderSize int
 	syslogFrameHeaderFormat             string
 	ID                                  string
 	FormatterFunc                       NewHTTPFormatterFunc
+	Routes                              []RouteConfig
+	Filters                             []*regexp.Regexp // Lines whose message matches any of these are discarded
+	Transport                           *http.Transport  // Shared by all outlets, its settings by AWS clients, NewShuttle uses NewHTTPTransport when nil
+	Auth                                AuthProvider     // Authenticates requests to LogsURL, see Config.AuthProvider
+	Observer                            Observer         // Notified of what happens to batches, nil if nothing is
 
 	// Loggers
 	Logger    *log.Logger
@@ -97,32 +170,49 @@ type Config struct {
 // NewConfig returns a newly created Config, filled in with defaults
 func NewConfig() Config {
 	shuttleConfig := Config{
-		MaxLineLength: DefaultMaxLineLength,
-		Verbose:       DefaultVerbose,
-		SkipVerify:    DefaultSkipVerify,
-		Prival:        DefaultPriVal,
-		Version:       DefaultVersion,
-		Procid:        DefaultProcID,
-		Appname:       DefaultAppName,
-		Hostname:      DefaultHostname,
-		Msgid:         DefaultMsgID,
-		LogsURL:       DefaultLogsURL,
-		StatsSource:   DefaultStatsSource,
-		StatsInterval: time.Duration(DefaultStatsInterval),
-		MaxAttempts:   DefaultMaxAttempts,
-		InputFormat:   DefaultInputFormat,
-		NumOutlets:    DefaultNumOutlets,
-		WaitDuration:  time.Duration(DefaultWaitDuration),
-		BatchSize:     DefaultBatchSize,
-		BackBuff:      DefaultBackBuff,
-		Timeout:       time.Duration(DefaultTimeout),
-		ID:            DefaultID,
-		Logger:        discardLogger,
-		ErrLogger:     discardLogger,
-		FormatterFunc: DefaultFormatterFunc,
-		Drop:          DefaultDrop,
-		UseGzip:       DefaultUseGzip,
-		KinesisShards: DefaultKinesisShards,
+		MaxLineLength:    DefaultMaxLineLength,
+		Verbose:          DefaultVerbose,
+		SkipVerify:       DefaultSkipVerify,
+		Prival:           DefaultPriVal,
+		Version:          DefaultVersion,
+		Procid:           DefaultProcID,
+		Appname:          DefaultAppName,
+		Hostname:         DefaultHostname,
+		Msgid:            DefaultMsgID,
+		LogsURL:          DefaultLogsURL,
+		StatsSource:      DefaultStatsSource,
+		StatsInterval:    time.Duration(DefaultStatsInterval),
+		MaxAttempts:      DefaultMaxAttempts,
+		InputFormat:      DefaultInputFormat,
+		NumOutlets:       DefaultNumOutlets,
+		WaitDuration:     time.Duration(DefaultWaitDuration),
+		BatchSize:        DefaultBatchSize,
+		BackBuff:         DefaultBackBuff,
+		Timeout:          time.Duration(DefaultTimeout),
+		ID:               DefaultID,
+		Logger:           discardLogger,
+		ErrLogger:        discardLogger,
+		FormatterFunc:    DefaultFormatterFunc,
+		Drop:             DefaultDrop,
+		UseGzip:          DefaultUseGzip,
+		Compression:      DefaultCompression,
+		KinesisShards:    DefaultKinesisShards,
+		FirehoseFormat:   DefaultFirehoseFormat,
+		RateLimitLines:   DefaultRateLimitLines,
+		RateLimitBytes:   DefaultRateLimitBytes,
+		RateLimitDrop:    DefaultRateLimitDrop,
+		DrainTimeout:     DefaultDrainTimeout,
+		Adaptive:         DefaultAdaptive,
+		AdaptiveInterval: DefaultAdaptiveInterval,
+		AdaptiveLatency:  DefaultAdaptiveLatency,
+		HTTP2:            DefaultHTTP2,
+		IdleConnTimeout:  DefaultIdleConnTimeout,
+		LogLevel:         DefaultLogLevel,
+		LogFormat:        DefaultLogFormat,
+		SelfLog:          DefaultSelfLog,
+		SelfLogRate:      DefaultSelfLogRate,
+		SelfLogAppName:   DefaultSelfLogAppName,
+		SelfLogProcid:    DefaultSelfLogProcid,
 	}
 
 	shuttleConfig.ComputeHeader()
@@ -0,0 +1,186 @@
+package shuttle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// Levels of log-shuttle's own diagnostics, see Config.LogLevel
+const (
+	LogLevelDebug = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+// Formats of log-shuttle's own diagnostics, see Config.LogFormat
+const (
+	LogFormatLogfmt = iota
+	LogFormatJSON
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// EventLogger writes log-shuttle's diagnostics as leveled, structured lines
+// through the user supplied *log.Loggers: debug & info lines through Logger,
+// warnings & errors through ErrLogger. Lines start with their level and the
+// at key, followed by key value pairs, for example
+//
+//	level=warn at=post request_id="..." msgcount=10 status=503 attempt=1
+//
+// The zero value discards everything.
+type EventLogger struct {
+	Logger, ErrLogger *log.Logger
+	Level             int // The lowest level logged, see LogLevelDebug
+	Format            int // LogFormatLogfmt or LogFormatJSON
+
+	self *selfLogger // also sends warnings & errors, see Config.SelfLog
+}
+
+// NewEventLogger returns an EventLogger writing through logger & errLogger with
+// the LogLevel & LogFormat of config. Config.Verbose logs debug lines too.
+func NewEventLogger(logger, errLogger *log.Logger, config Config) EventLogger {
+	level := config.LogLevel
+	if config.Verbose && level > LogLevelDebug {
+		level = LogLevelDebug
+	}
+	return EventLogger{Logger: logger, ErrLogger: errLogger, Level: level, Format: config.LogFormat}
+}
+
+// Debug logs at with the key value pairs of kvs at the debug level.
+func (l EventLogger) Debug(at string, kvs ...interface{}) {
+	l.log(LogLevelDebug, at, kvs)
+}
+
+// Info logs at with the key value pairs of kvs at the info level.
+func (l EventLogger) Info(at string, kvs ...interface{}) {
+	l.log(LogLevelInfo, at, kvs)
+}
+
+// Warn logs at with the key value pairs of kvs at the warn level.
+func (l EventLogger) Warn(at string, kvs ...interface{}) {
+	l.log(LogLevelWarn, at, kvs)
+}
+
+// Error logs at with the key value pairs of kvs at the error level.
+func (l EventLogger) Error(at string, kvs ...interface{}) {
+	l.log(LogLevelError, at, kvs)
+}
+
+// Enabled reports whether lines of level are logged.
+func (l EventLogger) Enabled(level int) bool {
+	if level < l.Level {
+		return false
+	}
+	if level >= LogLevelWarn {
+		return l.ErrLogger != nil
+	}
+	return l.Logger != nil
+}
+
+func (l EventLogger) log(level int, at string, kvs []interface{}) {
+	local := l.Enabled(level)
+	self := l.self != nil && level >= LogLevelWarn && level >= l.Level
+	if !local && !self {
+		return
+	}
+	line := formatEvent(l.Format, level, at, kvs)
+	if local {
+		out := l.Logger
+		if level >= LogLevelWarn {
+			out = l.ErrLogger
+		}
+		out.Println(line)
+	}
+	if self {
+		l.self.log(level, line)
+	}
+}
+
+// formatEvent formats a line of EventLogger. A trailing key without a value
+// gets an empty one.
+func formatEvent(format, level int, at string, kvs []interface{}) string {
+	var buf bytes.Buffer
+	if format == LogFormatJSON {
+		buf.WriteString(`{"level":`)
+		buf.Write(jsonEventValue(logLevelNames[level]))
+		buf.WriteString(`,"at":`)
+		buf.Write(jsonEventValue(at))
+		for i := 0; i < len(kvs); i += 2 {
+			buf.WriteByte(',')
+			buf.Write(jsonEventValue(fmt.Sprint(kvs[i])))
+			buf.WriteByte(':')
+			buf.Write(jsonEventValue(eventValue(kvs, i+1)))
+		}
+		buf.WriteByte('}')
+		return buf.String()
+	}
+
+	buf.WriteString("level=")
+	buf.WriteString(logLevelNames[level])
+	buf.WriteString(" at=")
+	buf.WriteString(logfmtEventValue(at))
+	for i := 0; i < len(kvs); i += 2 {
+		buf.WriteByte(' ')
+		buf.WriteString(fmt.Sprint(kvs[i]))
+		buf.WriteByte('=')
+		buf.WriteString(logfmtEventValue(eventValue(kvs, i+1)))
+	}
+	return buf.String()
+}
+
+// eventValue returns kvs[i] in a form both encoders handle, "" if it's missing
+func eventValue(kvs []interface{}, i int) interface{} {
+	if i >= len(kvs) {
+		return ""
+	}
+	switch v := kvs[i].(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return kvs[i]
+}
+
+// logfmtEventValue returns v as a logfmt value, quoting strings that are empty
+// or have spaces, quotes, equal signs or non printable characters
+func logfmtEventValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError || !strconv.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+// jsonEventValue returns v as JSON, or as a JSON string if it can't be
+// marshaled
+func jsonEventValue(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return b
+}
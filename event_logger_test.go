@@ -0,0 +1,51 @@
+package shuttle
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestFormatEvent(t *testing.T) {
+	kvs := []interface{}{"request_id", "a b", "msgcount", 10, "took", time.Second, "error", errors.New(`bad "thing"`), "empty", "", "rate", 1.5, "trailing"}
+	for _, tc := range []struct {
+		format   int
+		expected string
+	}{
+		{LogFormatLogfmt, `level=warn at=post request_id="a b" msgcount=10 took=1s error="bad \"thing\"" empty="" rate=1.5 trailing=""`},
+		{LogFormatJSON, `{"level":"warn","at":"post","request_id":"a b","msgcount":10,"took":"1s","error":"bad \"thing\"","empty":"","rate":1.5,"trailing":""}`},
+	} {
+		if got := formatEvent(tc.format, LogLevelWarn, "post", kvs); got != tc.expected {
+			t.Errorf("format %d:\nexpected %s\n     got %s", tc.format, tc.expected, got)
+		}
+	}
+}
+
+func TestEventLoggerLevels(t *testing.T) {
+	var out, errOut bytes.Buffer
+	config := newTestConfig()
+	config.LogLevel = LogLevelInfo
+	l := NewEventLogger(log.New(&out, "", 0), log.New(&errOut, "", 0), config)
+
+	l.Debug("debug")
+	l.Info("info")
+	l.Warn("warn")
+	l.Error("error")
+	if got, expected := out.String(), "level=info at=info\n"; got != expected {
+		t.Errorf("expected %q to be logged, got %q", expected, got)
+	}
+	if got, expected := errOut.String(), "level=warn at=warn\nlevel=error at=error\n"; got != expected {
+		t.Errorf("expected %q to be logged to the error logger, got %q", expected, got)
+	}
+
+	config.Verbose = true
+	if !NewEventLogger(&log.Logger{}, nil, config).Enabled(LogLevelDebug) {
+		t.Error("expected Verbose to enable debug lines")
+	}
+	if NewEventLogger(&log.Logger{}, nil, config).Enabled(LogLevelError) {
+		t.Error("expected lines without a logger to be disabled")
+	}
+	EventLogger{}.Error("discarded") // The zero value doesn't panic
+}
@@ -0,0 +1,295 @@
+package shuttle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// Firehose record framing constants.
+const (
+	FirehoseFormatRaw     = iota // default, newline terminated lines
+	FirehoseFormatLogplex        // length prefixed rfc5424, the same as KinesisRecord
+)
+
+// PutRecordBatch limits, see:
+// https://docs.aws.amazon.com/firehose/latest/APIReference/API_PutRecordBatch.html
+const (
+	FirehoseMaxBatchRecords = 500
+	FirehoseMaxBatchBytes   = 4 * 1024 * 1024
+	FirehoseMaxRecordBytes  = 1000 * 1024
+)
+
+// errFirehoseRecordTooLarge is the error of the lines whose records are over
+// FirehoseMaxRecordBytes, which aren't sent
+var errFirehoseRecordTooLarge = fmt.Errorf("record over %d bytes", FirehoseMaxRecordBytes)
+
+// FirehoseClient defines the interface for Firehose operations we need
+type FirehoseClient interface {
+	PutRecordBatch(ctx context.Context, params *firehose.PutRecordBatchInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error)
+}
+
+// FirehoseFormatter formats batches destined for Kinesis Data Firehose
+// delivery streams, one record per log line. Records are either the raw,
+// newline terminated lines or length prefixed rfc5424 (see config.FirehoseFormat).
+// Batches are delivered with PutRecordBatch, split as needed to stay within
+// its limits, see Deliver.
+type FirehoseFormatter struct {
+	records     [][]byte
+	lines       []int // The index in the batch of each record's line, -1 for error lines
+	tooLarge    []int // The lines with a length prefixed record over FirehoseMaxRecordBytes
+	client      FirehoseClient
+	url         *url.URL
+	streamName  string
+	maxAttempts int
+
+	once   sync.Once // encodes the PutRecordBatch JSON body on the first Read
+	reader io.Reader
+}
+
+// NewFirehoseFormatterFunc returns a NewHTTPFormatterFunc for Firehose
+// delivery streams in region, delivering with a client built once and reused
+// for every batch. The client uses the default AWS credential chain and
+// transport, or the SDK's default transport if nil. If endpoint isn't empty
+// it's used instead of the region's Firehose endpoint.
+func NewFirehoseFormatterFunc(region, endpoint string, transport *http.Transport) (NewHTTPFormatterFunc, error) {
+	cfg, err := loadAWSConfig(region, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	client := firehose.NewFromConfig(cfg, func(o *firehose.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	return func(b Batch, eData []errData, config *Config) HTTPFormatter {
+		return newFirehoseFormatter(b, eData, config, client)
+	}, nil
+}
+
+// newFirehoseFormatter returns a FirehoseFormatter delivering with client to
+// the delivery stream named by the path of config.LogsURL.
+func newFirehoseFormatter(b Batch, eData []errData, config *Config, client FirehoseClient) *FirehoseFormatter {
+	u, err := url.Parse(config.LogsURL)
+	if err != nil {
+		panic(err)
+	}
+
+	ff := &FirehoseFormatter{
+		records:     make([][]byte, 0, b.MsgCount()+len(eData)),
+		lines:       make([]int, 0, b.MsgCount()+len(eData)),
+		client:      client,
+		streamName:  strings.TrimPrefix(u.Path, "/"),
+		maxAttempts: config.MaxAttempts,
+	}
+
+	u.User = nil // Ensure there is no auth info
+	u.Path = ""  // Ensure there is no path
+	ff.url = u
+
+	for _, edata := range eData {
+		llf := NewLogplexErrorFormatter(edata, config)
+		if config.FirehoseFormat == FirehoseFormatRaw {
+			ff.addRaw(llf.line, -1)
+		} else {
+			ff.addLogplex(llf, -1)
+		}
+	}
+
+	for i, l := range b.logLines {
+		switch {
+		case config.FirehoseFormat == FirehoseFormatRaw:
+			ff.addRaw(l.line, i)
+		case config.InputFormat == InputFormatRaw && len(l.line) > config.MaxLineLength:
+			for _, sl := range splitLine(l, config.MaxLineLength).logLines {
+				ff.addLogplex(NewLogplexLineFormatter(sl, config), i)
+			}
+		default:
+			ff.addLogplex(NewLogplexLineFormatter(l, config), i)
+		}
+	}
+
+	return ff
+}
+
+// addRaw adds line, the line'th of the batch, as newline terminated records,
+// splitting it if it's over FirehoseMaxRecordBytes.
+func (ff *FirehoseFormatter) addRaw(line []byte, lineIndex int) {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	for {
+		n := len(line)
+		if n > FirehoseMaxRecordBytes-1 {
+			n = FirehoseMaxRecordBytes - 1
+		}
+		record := make([]byte, n+1)
+		copy(record, line[:n])
+		record[n] = '\n'
+		ff.records = append(ff.records, record)
+		ff.lines = append(ff.lines, lineIndex)
+
+		if line = line[n:]; len(line) == 0 {
+			return
+		}
+	}
+}
+
+// addLogplex adds the length prefixed rfc5424 message of llf, of the
+// lineIndex'th line of the batch, as a record. Messages can't be split, so
+// those over FirehoseMaxRecordBytes are left out and the line counted as
+// failed, see Deliver.
+func (ff *FirehoseFormatter) addLogplex(llf *LogplexLineFormatter, lineIndex int) {
+	data, _ := ioutil.ReadAll(llf) // LogplexLineFormatters don't fail
+	if len(data) > FirehoseMaxRecordBytes {
+		if lineIndex >= 0 {
+			ff.tooLarge = append(ff.tooLarge, lineIndex)
+		}
+		return
+	}
+	ff.records = append(ff.records, data)
+	ff.lines = append(ff.lines, lineIndex)
+}
+
+// Read the PutRecordBatch JSON body of the batch
+func (ff *FirehoseFormatter) Read(p []byte) (int, error) {
+	ff.once.Do(func() {
+		body := struct {
+			DeliveryStreamName string
+			Records            []struct{ Data []byte }
+		}{DeliveryStreamName: ff.streamName}
+		for _, r := range ff.records {
+			body.Records = append(body.Records, struct{ Data []byte }{r})
+		}
+		b, _ := json.Marshal(body)
+		ff.reader = bytes.NewReader(b)
+	})
+	return ff.reader.Read(p)
+}
+
+// Request constructs the PutRecordBatch request for this formatter. Outlets
+// deliver the batch with Deliver instead, as the request isn't signed nor
+// split to PutRecordBatch's limits.
+func (ff *FirehoseFormatter) Request() (*http.Request, error) {
+	req, err := http.NewRequest("POST", ff.url.String(), ff)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Add("X-Amz-Target", "Firehose_20150804.PutRecordBatch")
+	req.Host = ff.url.Host
+
+	return req, nil
+}
+
+// Deliver the records with PutRecordBatch, at most FirehoseMaxBatchRecords
+// records and FirehoseMaxBatchBytes per call. See Deliverer.
+//
+// If no record is delivered the error is returned, so that the outlet retries
+// the batch. Once some are, only the records Firehose rejected are retried, up
+// to config.MaxAttempts times, after which a *PartialDeliveryError is
+// returned for the lines of those still failing, or as soon as ctx is done.
+// Lines too large for a record are failed too.
+func (ff *FirehoseFormatter) Deliver(ctx context.Context) error {
+	pending := make([]int, len(ff.records))
+	for i := range pending {
+		pending[i] = i
+	}
+	pending, err := ff.put(ctx, pending)
+	if err != nil && len(pending) == len(ff.records) {
+		return err
+	}
+
+	for attempts := 1; err != nil && attempts < ff.maxAttempts; attempts++ {
+		if serr := sleepContext(ctx, time.Duration(attempts)*EOFRetrySleep*time.Millisecond); serr != nil {
+			err = serr
+			break
+		}
+		pending, err = ff.put(ctx, pending)
+	}
+	if err == nil {
+		if len(ff.tooLarge) == 0 {
+			return nil
+		}
+		err = errFirehoseRecordTooLarge
+	}
+	return &PartialDeliveryError{Failed: ff.failedLines(pending), Err: err}
+}
+
+// failedLines returns the number of batch lines with a record among pending
+// or too large for one
+func (ff *FirehoseFormatter) failedLines(pending []int) int {
+	failed := make(map[int]bool)
+	for _, r := range pending {
+		if l := ff.lines[r]; l >= 0 {
+			failed[l] = true
+		}
+	}
+	for _, l := range ff.tooLarge {
+		failed[l] = true
+	}
+	return len(failed)
+}
+
+// put the records at the pending indexes in as many PutRecordBatch calls as
+// needed, returning the indexes of the ones that failed and the error of the
+// last failure. Records are at most FirehoseMaxRecordBytes, so each call
+// takes at least one.
+func (ff *FirehoseFormatter) put(ctx context.Context, pending []int) ([]int, error) {
+	var failed []int
+	var lastErr error
+
+	for len(pending) > 0 {
+		var n, size int
+		for n < len(pending) && n < FirehoseMaxBatchRecords && size+len(ff.records[pending[n]]) <= FirehoseMaxBatchBytes {
+			size += len(ff.records[pending[n]])
+			n++
+		}
+		chunk := pending[:n]
+		pending = pending[n:]
+
+		entries := make([]types.Record, 0, len(chunk))
+		for _, r := range chunk {
+			entries = append(entries, types.Record{Data: ff.records[r]})
+		}
+
+		out, err := ff.client.PutRecordBatch(ctx, &firehose.PutRecordBatchInput{
+			DeliveryStreamName: aws.String(ff.streamName),
+			Records:            entries,
+		})
+		if err != nil {
+			failed = append(failed, chunk...)
+			lastErr = err
+			continue
+		}
+		if aws.ToInt32(out.FailedPutCount) == 0 {
+			continue
+		}
+		for i, resp := range out.RequestResponses {
+			if resp.ErrorCode != nil && i < len(chunk) {
+				failed = append(failed, chunk[i])
+				lastErr = fmt.Errorf("%s: %s", aws.ToString(resp.ErrorCode), aws.ToString(resp.ErrorMessage))
+			}
+		}
+	}
+
+	return failed, lastErr
+}
+
+// MsgCount returns the number of records that the formatter is formatting,
+// which may be more than the lines of the batch as long lines are split
+func (ff *FirehoseFormatter) MsgCount() int {
+	return len(ff.records)
+}
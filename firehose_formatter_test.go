@@ -0,0 +1,277 @@
+package shuttle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// mockFirehoseClient records the batches it's called with, failing the
+// records for which fail returns true.
+type mockFirehoseClient struct {
+	calls [][]types.Record
+	fail  func(call int, data []byte) bool
+}
+
+func (m *mockFirehoseClient) PutRecordBatch(ctx context.Context, params *firehose.PutRecordBatchInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error) {
+	m.calls = append(m.calls, params.Records)
+	out := &firehose.PutRecordBatchOutput{FailedPutCount: aws.Int32(0)}
+	for _, r := range params.Records {
+		var resp types.PutRecordBatchResponseEntry
+		if m.fail != nil && m.fail(len(m.calls), r.Data) {
+			resp.ErrorCode = aws.String("ServiceUnavailableException")
+			resp.ErrorMessage = aws.String("Slow down.")
+			*out.FailedPutCount++
+		} else {
+			resp.RecordId = aws.String("1")
+		}
+		out.RequestResponses = append(out.RequestResponses, resp)
+	}
+	return out, nil
+}
+
+func TestFirehoseFormatterFormats(t *testing.T) {
+	config := newTestConfig()
+	config.LogsURL = "https://firehose.us-east-1.amazonaws.com/Stream"
+	b := NewBatch(1)
+	b.Add(LogLineOne)
+	b.Add(LogLine{line: []byte("no newline"), when: time.Now()})
+	eData := []errData{{count: 2, since: time.Now(), eType: errDrop}}
+
+	client := &mockFirehoseClient{}
+	ff := newFirehoseFormatter(b, eData, &config, client)
+	if err := ff.Deliver(context.Background()); err != nil {
+		t.Fatal("Unexpected error calling Deliver: ", err)
+	}
+	records := client.calls[0]
+	if len(records) != 3 || !strings.Contains(string(records[0].Data), "Error L12: 2 messages dropped") {
+		t.Fatalf("Expected the error line and 2 records, got %q", records)
+	}
+	if string(records[1].Data) != "Hello World\n" || string(records[2].Data) != "no newline\n" {
+		t.Errorf("Expected newline terminated raw records, got %q %q", records[1].Data, records[2].Data)
+	}
+
+	config.FirehoseFormat = FirehoseFormatLogplex
+	ff = newFirehoseFormatter(b, nil, &config, client)
+	if err := ff.Deliver(context.Background()); err != nil {
+		t.Fatal("Unexpected error calling Deliver: ", err)
+	}
+	expected, _ := ioutil.ReadAll(NewLogplexLineFormatter(LogLineOne, &config))
+	if r := client.calls[1][0]; string(r.Data) != string(expected) {
+		t.Errorf("Expected a length prefixed rfc5424 record %q, got %q", expected, r.Data)
+	}
+
+	// The body can still be read
+	var body struct {
+		DeliveryStreamName string
+		Records            []struct{ Data []byte }
+	}
+	if err := json.NewDecoder(ff).Decode(&body); err != nil || body.DeliveryStreamName != "Stream" || len(body.Records) != 2 {
+		t.Errorf("Unexpected body %+v, %v", body, err)
+	}
+}
+
+func TestFirehoseFormatterLimits(t *testing.T) {
+	config := newTestConfig()
+	config.LogsURL = "https://firehose.us-east-1.amazonaws.com/Stream"
+
+	b := NewBatch(1200)
+	for i := 0; i < 1200; i++ {
+		b.Add(LogLineOne)
+	}
+	client := &mockFirehoseClient{}
+	if err := newFirehoseFormatter(b, nil, &config, client).Deliver(context.Background()); err != nil {
+		t.Fatal("Unexpected error calling Deliver: ", err)
+	}
+	if len(client.calls) != 3 || len(client.calls[0]) != 500 || len(client.calls[2]) != 200 {
+		t.Errorf("Expected 3 calls of at most %d records, got %d", FirehoseMaxBatchRecords, len(client.calls))
+	}
+
+	// 5 records of 900KiB fit 4 to a call, a 2.5MB line is split in 3 records
+	b = NewBatch(6)
+	for i := 0; i < 5; i++ {
+		b.Add(LogLine{line: bytes.Repeat([]byte("a"), 900*1024), when: time.Now()})
+	}
+	b.Add(LogLine{line: bytes.Repeat([]byte("b"), 2500*1000), when: time.Now()})
+	client = &mockFirehoseClient{}
+	ff := newFirehoseFormatter(b, nil, &config, client)
+	if ff.MsgCount() != 8 {
+		t.Errorf("Expected the long line to be split, got %d records", ff.MsgCount())
+	}
+	if err := ff.Deliver(context.Background()); err != nil {
+		t.Fatal("Unexpected error calling Deliver: ", err)
+	}
+	for i, call := range client.calls {
+		var size int
+		for _, r := range call {
+			if len(r.Data) > FirehoseMaxRecordBytes || r.Data[len(r.Data)-1] != '\n' {
+				t.Errorf("Unexpected record of %d bytes", len(r.Data))
+			}
+			size += len(r.Data)
+		}
+		if size > FirehoseMaxBatchBytes {
+			t.Errorf("Call %d sent %d bytes", i, size)
+		}
+	}
+}
+
+func TestFirehoseFormatterPartialFailure(t *testing.T) {
+	config := newTestConfig()
+	config.LogsURL = "https://firehose.us-east-1.amazonaws.com/Stream"
+	b := NewBatch(2)
+	b.Add(LogLineOne)
+	b.Add(LogLineTwo)
+
+	// The second record fails once, only it is retried
+	client := &mockFirehoseClient{fail: func(call int, data []byte) bool {
+		return call == 1 && string(data) == string(LogLineTwo.line)
+	}}
+	if err := newFirehoseFormatter(b, nil, &config, client).Deliver(context.Background()); err != nil {
+		t.Fatal("Unexpected error calling Deliver: ", err)
+	}
+	if len(client.calls) != 2 || len(client.calls[1]) != 1 || string(client.calls[1][0].Data) != string(LogLineTwo.line) {
+		t.Errorf("Expected only the failed record to be retried, got %q", client.calls)
+	}
+
+	// The second record keeps failing
+	client = &mockFirehoseClient{fail: func(call int, data []byte) bool {
+		return string(data) == string(LogLineTwo.line)
+	}}
+	err := newFirehoseFormatter(b, nil, &config, client).Deliver(context.Background())
+	pe, ok := err.(*PartialDeliveryError)
+	if !ok || pe.Failed != 1 || !strings.Contains(pe.Error(), "ServiceUnavailableException: Slow down.") {
+		t.Fatalf("Expected a PartialDeliveryError for 1 record, got %v", err)
+	}
+	if len(client.calls) != config.MaxAttempts {
+		t.Errorf("Expected %d calls, got %d", config.MaxAttempts, len(client.calls))
+	}
+
+	// Nothing is delivered, the outlet retries the batch
+	client = &mockFirehoseClient{fail: func(int, []byte) bool { return true }}
+	err = newFirehoseFormatter(b, nil, &config, client).Deliver(context.Background())
+	if _, ok := err.(*PartialDeliveryError); ok || err == nil || len(client.calls) != 1 {
+		t.Errorf("Expected the error after 1 call, got %v after %d", err, len(client.calls))
+	}
+}
+
+func TestFirehoseFormatterOversizedRecords(t *testing.T) {
+	config := newTestConfig()
+	config.LogsURL = "https://firehose.us-east-1.amazonaws.com/Stream"
+	config.FirehoseFormat = FirehoseFormatLogplex
+	config.InputFormat = InputFormatRFC5424 // so lines aren't split
+
+	// A record over the batch limit too, which mustn't stall the delivery
+	b := NewBatch(3)
+	b.Add(LogLineOne)
+	b.Add(LogLine{line: bytes.Repeat([]byte("a"), 1100*1024), when: time.Now()})
+	b.Add(LogLine{line: bytes.Repeat([]byte("b"), 5*1024*1024), when: time.Now()})
+	client := &mockFirehoseClient{}
+	err := newFirehoseFormatter(b, nil, &config, client).Deliver(context.Background())
+	pe, ok := err.(*PartialDeliveryError)
+	if !ok || pe.Failed != 2 || pe.Err != errFirehoseRecordTooLarge {
+		t.Fatalf("Expected a PartialDeliveryError for the 2 oversized lines, got %v", err)
+	}
+	if len(client.calls) != 1 || len(client.calls[0]) != 1 {
+		t.Errorf("Expected 1 call with the one record that fits, got %d calls", len(client.calls))
+	}
+}
+
+func TestFirehoseFormatterFailedLines(t *testing.T) {
+	config := newTestConfig()
+	config.LogsURL = "https://firehose.us-east-1.amazonaws.com/Stream"
+
+	// The long line is split in 3 records which all fail, but it's 1 line
+	b := NewBatch(2)
+	b.Add(LogLineOne)
+	b.Add(LogLine{line: bytes.Repeat([]byte("b"), 2500*1000), when: time.Now()})
+	client := &mockFirehoseClient{fail: func(call int, data []byte) bool {
+		return data[0] == 'b'
+	}}
+	err := newFirehoseFormatter(b, nil, &config, client).Deliver(context.Background())
+	if pe, ok := err.(*PartialDeliveryError); !ok || pe.Failed != 1 {
+		t.Fatalf("Expected a PartialDeliveryError for 1 line, got %v", err)
+	}
+}
+
+func TestOutletPartialDelivery(t *testing.T) {
+	config := newTestConfig()
+	config.LogsURL = "https://firehose.us-east-1.amazonaws.com/Stream"
+	client := &mockFirehoseClient{fail: func(call int, data []byte) bool {
+		return string(data) == string(LogLineTwo.line)
+	}}
+	config.FormatterFunc = func(b Batch, eData []errData, config *Config) HTTPFormatter {
+		return newFirehoseFormatter(b, eData, config, client)
+	}
+
+	s := NewShuttle(config)
+	outlet := NewHTTPOutlet(s)
+	batch := NewBatch(2)
+	batch.Add(LogLineOne)
+	batch.Add(LogLineTwo)
+	outlet.retryPost(batch)
+
+	if len(client.calls) != config.MaxAttempts {
+		t.Errorf("Expected the batch not to be retried by the outlet, got %d calls", len(client.calls))
+	}
+	if lost := s.Lost.Read(); lost != 1 {
+		t.Errorf("Expected 1 lost message, got %d", lost)
+	}
+}
+
+// TestFirehoseFormatterFuncEndpoint delivers to a local Firehose stand-in
+func TestFirehoseFormatterFuncEndpoint(t *testing.T) {
+	for k, v := range map[string]string{
+		"AWS_ACCESS_KEY_ID":           "AKIDCHAIN",
+		"AWS_SECRET_ACCESS_KEY":       "chain-secret",
+		"AWS_CONFIG_FILE":             os.DevNull,
+		"AWS_SHARED_CREDENTIALS_FILE": os.DevNull,
+	} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+
+	var auth, target string
+	var input struct {
+		DeliveryStreamName string
+		Records            []struct{ Data []byte }
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		target = r.Header.Get("X-Amz-Target")
+		json.NewDecoder(r.Body).Decode(&input)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"FailedPutCount":0,"Encrypted":false,"RequestResponses":[{"RecordId":"1"}]}`))
+	}))
+	defer ts.Close()
+
+	ff, err := NewFirehoseFormatterFunc("eu-west-1", ts.URL, nil)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+
+	config := newTestConfig()
+	config.LogsURL = "https://firehose.eu-west-1.amazonaws.com/Stream"
+	b := NewBatch(1)
+	b.Add(LogLineOne)
+	if err := ff(b, noErrData, &config).(Deliverer).Deliver(context.Background()); err != nil {
+		t.Fatal("Unexpected error delivering: ", err)
+	}
+
+	if !strings.Contains(auth, "/eu-west-1/firehose/") || target != "Firehose_20150804.PutRecordBatch" {
+		t.Errorf("Unexpected request, Authorization %q, X-Amz-Target %q", auth, target)
+	}
+	if input.DeliveryStreamName != "Stream" || len(input.Records) != 1 || string(input.Records[0].Data) != "Hello World\n" {
+		t.Errorf("Unexpected input %+v", input)
+	}
+}
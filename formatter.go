@@ -1,6 +1,8 @@
 package shuttle
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"net/http"
 )
@@ -30,6 +32,26 @@ type ResponseHandler interface {
 	HandleResponse(*http.Response) error
 }
 
+// Deliverer is implemented by HTTPFormatters that deliver their batch
+// themselves, e.g. with an AWS SDK client that signs its requests. Outlets
+// call Deliver instead of posting the formatter's Request, and don't gzip
+// them. Delivery should give up once ctx is done.
+type Deliverer interface {
+	Deliver(ctx context.Context) error
+}
+
+// PartialDeliveryError is returned by Deliverers that delivered only some of
+// their batch. Outlets count the Failed messages as lost instead of retrying
+// the batch, which would deliver the others twice.
+type PartialDeliveryError struct {
+	Failed int   // The number of lines of the batch that weren't delivered
+	Err    error // The last error delivering them
+}
+
+func (e *PartialDeliveryError) Error() string {
+	return fmt.Sprintf("%d messages not delivered: %s", e.Failed, e.Err)
+}
+
 // NewHTTPFormatterFunc defines the function type for defining creating and
 // returning a new Formatter
 type NewHTTPFormatterFunc func(b Batch, eData []errData, config *Config) HTTPFormatter
@@ -4,11 +4,30 @@ require (
 	github.com/aws/aws-sdk-go-v2 v1.26.1
 	github.com/aws/aws-sdk-go-v2/config v1.27.7
 	github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs v1.35.1
+	github.com/aws/aws-sdk-go-v2/service/firehose v1.28.5
 	github.com/aws/aws-sdk-go-v2/service/kinesis v1.27.1
+	github.com/aws/smithy-go v1.20.2
 	github.com/heroku/slog v0.0.0-20150110001655-7746152d9340
+	github.com/klauspost/compress v1.17.7
 	github.com/pborman/uuid v0.0.0-20150824212802-cccd189d45f7
 	github.com/pebbe/util v0.0.0-20140716220158-e0e04dfe647c
 	github.com/rcrowley/go-metrics v0.0.0-20141108142129-dee209f2455f
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-go 1.13
+require (
+	github.com/aws/aws-sdk-go-v2/aws/protocol/eventstream v1.6.2 // indirect
+	github.com/aws/aws-sdk-go-v2/credentials v1.17.7 // indirect
+	github.com/aws/aws-sdk-go-v2/feature/ec2/imds v1.15.3 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/configsources v1.3.5 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/endpoints/v2 v2.6.5 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/ini v1.8.0 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/accept-encoding v1.11.1 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/presigned-url v1.11.5 // indirect
+	github.com/aws/aws-sdk-go-v2/service/sso v1.20.2 // indirect
+	github.com/aws/aws-sdk-go-v2/service/ssooidc v1.23.2 // indirect
+	github.com/aws/aws-sdk-go-v2/service/sts v1.28.4 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+)
+
+go 1.21
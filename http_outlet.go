@@ -1,7 +1,7 @@
 package shuttle
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"net/url"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
@@ -22,6 +24,8 @@ const (
 	// DepthHighWatermark is the high watermark, beyond which the outlet looses batches instead of retrying.
 	DepthHighWatermark = 0.6
 	// RetryWithTypeFormat if the format string for retries that also have a type
+	//
+	// Deprecated: outlets log retries through an EventLogger.
 	RetryWithTypeFormat = "at=post retry=%t msgcount=%d inbox.length=%d request_id=%q attempts=%d error=%q errtype=\"%T\"\n"
 )
 
@@ -30,64 +34,150 @@ const (
 // and lost counters
 type HTTPOutlet struct {
 	inbox            <-chan Batch
+	stop             <-chan struct{} // closed when the outlet is retired, nil if never
+	ctx              context.Context // done when the shuttle shuts down without waiting for delivery
+	index            int             // The outlet's position among its destination's outlets
+	active           *int32          // The number of active outlets, those whose index is lower, nil if all are
 	drops            *Counter
 	lost             *Counter
-	lostMark         int // If len(inbox) > lostMark during error handling, don't retry
+	rateLimited      *Counter // nil when the outlet doesn't report rate limiting
+	inFlight         *int64   // The shuttle's count of lines not yet delivered
+	lostMark         int      // If len(inbox) > lostMark during error handling, don't retry
+	uncompressed     bool     // Set once the destination rejected compressed bodies, see Config.CompressionFallback
 	client           *http.Client
 	config           Config
+	secrets          *secrets
 	newFormatterFunc NewHTTPFormatterFunc
+	proxy            proxyFunc
 	userAgent        string
+	route            *Route // nil for the shuttle's default destination
+	observer         Observer
+	selfLog          *selfLogger // nil without Config.SelfLog
+	undelivered      *undeliveredBatches
+	registry         metrics.Registry // Where the status & error counters are registered, see countStatus
 
 	// User supplied loggers
 	Logger    *log.Logger
 	errLogger *log.Logger
 
 	// Various stats that we'll collect, see NewHTTPOutlet for names
-	inboxLengthGauge metrics.Gauge   // The number of outstanding batches, updated every time we try a post
-	postSuccessTimer metrics.Timer   // The timing data for successful posts
-	postFailureTimer metrics.Timer   // The timing data for failed posts
-	msgLostCount     metrics.Counter // The count of lost messages
+	inboxLengthGauge  metrics.Gauge   // The number of outstanding batches, updated every time we try a post
+	postSuccessTimer  metrics.Timer   // The timing data for successful posts
+	postFailureTimer  metrics.Timer   // The timing data for failed posts
+	msgLostCount      metrics.Counter // The count of lost messages
+	msgDeliveredCount metrics.Counter // The count of delivered messages
+	compressionIn     metrics.Counter // The bytes before compression
+	compressionOut    metrics.Counter // The bytes after compression
+	connsReused       metrics.Counter // The requests made on a pooled connection
+	connsNew          metrics.Counter // The requests that opened a new connection
+	queueWaitTimer    metrics.Timer   // How long batches waited for an outlet
+	deliveryLatency   metrics.Timer   // How long after they were received lines were delivered
+	postBytesOut      metrics.Counter // The bytes of request bodies posted
+	postBytesIn       metrics.Counter // The bytes of response bodies read
 }
 
 // NewHTTPOutlet returns a properly constructed HTTPOutlet for the given shuttle
 func NewHTTPOutlet(s *Shuttle) *HTTPOutlet {
+	return newHTTPOutlet(s, nil)
+}
+
+// newHTTPOutlet returns a HTTPOutlet delivering the batches of route r, or of
+// the shuttle's default destination when r is nil.
+func newHTTPOutlet(s *Shuttle, r *Route) *HTTPOutlet {
+	inbox, drops, lost, rateLimited := s.Batches, s.Drops, s.Lost, s.RateLimited
+	config, newFormatterFunc := s.config, s.NewFormatterFunc
+	if r != nil {
+		// Lines are rate limited before they are routed, so only the default
+		// destination reports them.
+		inbox, drops, lost, rateLimited = r.Batches, r.Drops, r.Lost, nil
+		config = r.config
+		if r.newFormatterFunc != nil {
+			newFormatterFunc = r.newFormatterFunc
+		}
+	}
+
 	return &HTTPOutlet{
-		drops:            s.Drops,
-		lost:             s.Lost,
-		lostMark:         int(float64(s.config.BackBuff) * DepthHighWatermark),
-		inbox:            s.Batches,
-		config:           s.config,
-		newFormatterFunc: s.NewFormatterFunc,
-		userAgent:        fmt.Sprintf("log-shuttle/%s (%s; %s; %s; %s)", s.config.ID, runtime.Version(), runtime.GOOS, runtime.GOARCH, runtime.Compiler),
+		drops:            drops,
+		lost:             lost,
+		rateLimited:      rateLimited,
+		inFlight:         &s.inFlight,
+		lostMark:         int(float64(config.BackBuff) * DepthHighWatermark),
+		inbox:            inbox,
+		ctx:              s.ctx,
+		config:           config,
+		secrets:          newSecrets(config),
+		newFormatterFunc: newFormatterFunc,
+		proxy:            newProxyFunc(config.Proxy, config.NoProxy),
+		route:            r,
+		observer:         config.observer(),
+		selfLog:          s.selfLog,
+		undelivered:      s.undeliveredFor(r),
+		registry:         s.MetricsRegistry,
+		userAgent:        fmt.Sprintf("log-shuttle/%s (%s; %s; %s; %s)", config.ID, runtime.Version(), runtime.GOOS, runtime.GOARCH, runtime.Compiler),
 		errLogger:        s.ErrLogger,
 		Logger:           s.Logger,
 		client: &http.Client{
-			Timeout: s.config.Timeout,
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: s.config.SkipVerify,
-				},
-			},
+			Timeout:   config.Timeout,
+			Transport: config.Transport,
 		},
-		inboxLengthGauge: metrics.GetOrRegisterGauge("outlet.inbox.length", s.MetricsRegistry),
-		postSuccessTimer: metrics.GetOrRegisterTimer("outlet.post.success", s.MetricsRegistry),
-		postFailureTimer: metrics.GetOrRegisterTimer("outlet.post.failure", s.MetricsRegistry),
-		msgLostCount:     metrics.GetOrRegisterCounter("msg.lost", s.MetricsRegistry),
+		inboxLengthGauge:  metrics.GetOrRegisterGauge(r.metricName("outlet.inbox.length"), s.MetricsRegistry),
+		postSuccessTimer:  metrics.GetOrRegisterTimer(r.metricName("outlet.post.success"), s.MetricsRegistry),
+		postFailureTimer:  metrics.GetOrRegisterTimer(r.metricName("outlet.post.failure"), s.MetricsRegistry),
+		msgLostCount:      metrics.GetOrRegisterCounter(r.metricName("msg.lost"), s.MetricsRegistry),
+		msgDeliveredCount: metrics.GetOrRegisterCounter(r.metricName("msg.delivered"), s.MetricsRegistry),
+		compressionIn:     metrics.GetOrRegisterCounter(r.metricName("outlet.compression.in.bytes"), s.MetricsRegistry),
+		compressionOut:    metrics.GetOrRegisterCounter(r.metricName("outlet.compression.out.bytes"), s.MetricsRegistry),
+		connsReused:       metrics.GetOrRegisterCounter(r.metricName("outlet.conns.reused"), s.MetricsRegistry),
+		connsNew:          metrics.GetOrRegisterCounter(r.metricName("outlet.conns.new"), s.MetricsRegistry),
+		queueWaitTimer:    metrics.GetOrRegisterTimer(r.metricName("batch.queue.wait"), s.MetricsRegistry),
+		deliveryLatency:   metrics.GetOrRegisterTimer(r.metricName("msg.delivery.latency"), s.MetricsRegistry),
+		postBytesOut:      metrics.GetOrRegisterCounter(r.metricName("outlet.post.bytes.out"), s.MetricsRegistry),
+		postBytesIn:       metrics.GetOrRegisterCounter(r.metricName("outlet.post.bytes.in"), s.MetricsRegistry),
 	}
 }
 
 // Outlet receives batches from the inbox and submits them to logplex via HTTP.
+// It returns once the inbox is closed or the outlet is retired. Inactive
+// outlets don't receive batches until they become active.
 func (h *HTTPOutlet) Outlet() {
-	for batch := range h.inbox {
-		h.retryPost(batch)
+	for {
+		if h.active != nil && h.index >= int(atomic.LoadInt32(h.active)) {
+			t := time.NewTimer(adaptiveParkInterval)
+			select {
+			case <-t.C:
+			case <-h.stop:
+				t.Stop()
+				return
+			}
+			continue
+		}
+
+		select {
+		case batch, ok := <-h.inbox:
+			if !ok {
+				return
+			}
+			h.retryPost(batch)
+		case <-h.stop:
+			return
+		}
 	}
 }
 
 // retryPost posts batch and will retry on error up to h.config.MaxAttempts times.
 func (h *HTTPOutlet) retryPost(batch Batch) {
-	var dropData, lostData errData
+	// Once we return the batch has either been delivered or lost
+	defer func() {
+		atomic.AddInt64(h.inFlight, -int64(batch.MsgCount()))
+		h.undelivered.remove(batch)
+	}()
+	if !batch.enqueued.IsZero() {
+		h.queueWaitTimer.UpdateSince(batch.enqueued)
+	}
 
-	edata := make([]errData, 0, 2)
+	var dropData, lostData, limitedData errData
+
+	edata := make([]errData, 0, 3)
 
 	dropData.count, dropData.since = h.drops.ReadAndReset()
 	if dropData.count > 0 {
@@ -101,43 +191,125 @@ func (h *HTTPOutlet) retryPost(batch Batch) {
 		edata = append(edata, lostData)
 	}
 
-	for attempts := 1; attempts <= h.config.MaxAttempts; attempts++ {
-		formatter := h.newFormatterFunc(batch, edata, &h.config)
-		if h.config.UseGzip {
-			formatter = NewGzipFormatter(formatter)
+	if h.rateLimited != nil {
+		limitedData.count, limitedData.since = h.rateLimited.ReadAndReset()
+		if limitedData.count > 0 {
+			limitedData.eType = errRateLimited
+			edata = append(edata, limitedData)
 		}
-		err := h.post(formatter)
-		if err != nil {
-			inboxLength := len(h.inbox)
-			h.inboxLengthGauge.Update(int64(inboxLength))
-			msgCount := batch.MsgCount()
-			if attempts < h.config.MaxAttempts && inboxLength < h.lostMark {
-				h.errLogger.Printf(RetryWithTypeFormat, true, msgCount, inboxLength, batch.UUID, attempts, err, err)
-				var si time.Duration = OtherRetrySleep
-				if isEOF(err) {
-					si = EOFRetrySleep
+	}
+
+	event := newBatchEvent(batch, h.route)
+	for attempts := 1; attempts <= h.config.MaxAttempts; attempts++ {
+		event.Attempt = attempts
+		h.observer.AttemptStarted(event)
+
+		// Secrets are re-applied for every attempt so that rotated ones are
+		// picked up.
+		config := h.config
+		err := h.secrets.apply(&config)
+		redactor := newRedactor(config)
+		var status int
+		if err == nil {
+			formatter := h.newFormatterFunc(batch, edata, &config)
+			if d, ok := formatter.(Deliverer); ok {
+				err = h.deliver(d)
+			} else {
+				if algorithm := config.compression(); algorithm != CompressionNone && !h.uncompressed {
+					cf := NewCompressFormatter(formatter, algorithm, config.CompressionLevel)
+					status, err = h.post(cf, config.AuthProvider(), redactor)
+					cf.Close()
+					h.compressionIn.Inc(cf.BytesIn())
+					h.compressionOut.Inc(cf.BytesOut())
+				} else {
+					status, err = h.post(formatter, config.AuthProvider(), redactor)
 				}
-				time.Sleep(time.Duration(attempts) * si * time.Millisecond)
-				continue
 			}
-			h.errLogger.Printf(RetryWithTypeFormat, false, msgCount, inboxLength, batch.UUID, attempts, err, err)
-			h.lost.Add(msgCount)
-			h.msgLostCount.Inc(int64(msgCount))
 		}
+		event.Status = status
+		if err == nil {
+			h.msgDeliveredCount.Inc(int64(batch.MsgCount()))
+			h.updateDeliveryLatency(batch)
+			h.observer.BatchDelivered(event)
+			return
+		}
+		event.Err = err
+		h.observer.AttemptFailed(event)
+		if _, rejected := err.(*rejectedError); rejected {
+			// Already logged by post, and rejected batches aren't retried
+			h.lost.Add(batch.MsgCount())
+			h.msgLostCount.Inc(int64(batch.MsgCount()))
+			event.MsgCount = batch.MsgCount()
+			h.observer.BatchLost(event)
+			return
+		}
+		if h.ctx.Err() != nil {
+			// The shuttle was shut down without waiting for delivery, which
+			// counts what's undelivered as lost.
+			h.observer.BatchLost(event)
+			return
+		}
+
+		inboxLength := len(h.inbox)
+		h.inboxLengthGauge.Update(int64(inboxLength))
+		msgCount := batch.MsgCount()
+		// Retrying a partially delivered batch would duplicate what was
+		// delivered, so only what wasn't is lost.
+		pe, partial := err.(*PartialDeliveryError)
+		if partial {
+			msgCount = pe.Failed
+			if pe.Failed < batch.MsgCount() {
+				h.msgDeliveredCount.Inc(int64(batch.MsgCount() - pe.Failed))
+				delivered := event
+				delivered.MsgCount, delivered.Err = batch.MsgCount()-pe.Failed, nil
+				h.observer.BatchDelivered(delivered)
+			}
+		}
+		logRetry := func(level int, retry bool) {
+			h.events().log(level, "post", []interface{}{
+				"retry", retry, "msgcount", msgCount, "inbox.length", inboxLength, "request_id", batch.UUID,
+				"attempt", attempts, "error", redactor.Replace(err.Error()), "errtype", fmt.Sprintf("%T", err),
+			})
+		}
+		if !partial && attempts < h.config.MaxAttempts && inboxLength < h.lostMark {
+			logRetry(LogLevelWarn, true)
+			var si time.Duration = OtherRetrySleep
+			if isEOF(err) || err == errUnauthorized || err == errUnsupportedEncoding {
+				si = EOFRetrySleep
+			}
+			if sleepContext(h.ctx, time.Duration(attempts)*si*time.Millisecond) != nil {
+				h.observer.BatchLost(event)
+				return
+			}
+			continue
+		}
+		logRetry(LogLevelError, false)
+		h.lost.Add(msgCount)
+		h.msgLostCount.Inc(int64(msgCount))
+		event.MsgCount = msgCount
+		h.observer.BatchLost(event)
 		return
 	}
 }
 
-func (h *HTTPOutlet) post(formatter HTTPFormatter) error {
+// post the formatter's request, scrubbing what redactor replaces from logged
+// errors & response bodies, and return the response's status. If the request
+// is rejected with a 401 and auth can refresh its credentials errUnauthorized
+// is returned so that it's retried. If a compressed request is rejected with a
+// 415 and CompressionFallback is set, errUnsupportedEncoding is returned and
+// the outlet stops compressing. 429 & 5xx statuses return a *statusError so
+// that they're retried, other 4xx statuses a *rejectedError.
+func (h *HTTPOutlet) post(formatter HTTPFormatter, auth AuthProvider, redactor *strings.Replacer) (int, error) {
 	req, err := formatter.Request()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	cr := &countingReader{
 		reader: req.Body,
 	}
 	req.Body = ioutil.NopCloser(cr)
+	defer func() { h.postBytesOut.Inc(cr.count) }()
 
 	uuid := req.Header.Get("X-Request-Id")
 	req.Header.Add("User-Agent", h.userAgent)
@@ -151,39 +323,137 @@ func (h *HTTPOutlet) post(formatter HTTPFormatter) error {
 		}
 	}()
 	if err != nil {
-		return err
+		h.countError(err)
+		return 0, err
 	}
+	h.countStatus(resp.StatusCode)
+	respCr := &countingReader{reader: resp.Body}
+	resp.Body = respCr
+	defer func() { h.postBytesIn.Inc(respCr.count) }()
 
+	_, compressed := formatter.(*CompressFormatter)
 	switch status := resp.StatusCode; {
+	case status == http.StatusUnauthorized && auth != nil && auth.Refresh():
+		h.events().Warn("post", "request_id", uuid, "content_length", cr.count, "msgcount", formatter.MsgCount(), "status", status, "refreshing_credentials", true)
+		err = errUnauthorized
+
+	case status == http.StatusUnsupportedMediaType && compressed && h.config.CompressionFallback:
+		h.events().Warn("post", "request_id", uuid, "content_length", cr.count, "msgcount", formatter.MsgCount(), "status", status, "compression_fallback", true)
+		h.uncompressed = true
+		err = errUnsupportedEncoding
+
 	case status >= 400:
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			h.errLogger.Printf("at=post request_id=%q content_length=%d msgcount=%d status=%d reading_body=true error=%q\n", uuid, cr.count, formatter.MsgCount(), status, err)
+		level := LogLevelError
+		if retryableStatus(status) {
+			level, err = LogLevelWarn, &statusError{status: status}
+		} else {
+			err = &rejectedError{status: status}
+		}
+		kvs := []interface{}{"request_id", uuid, "content_length", cr.count, "msgcount", formatter.MsgCount(), "status", status}
+		body, rerr := ioutil.ReadAll(resp.Body)
+		if rerr != nil {
+			h.events().log(level, "post", append(kvs, "reading_body", true, "error", redactor.Replace(rerr.Error())))
 		} else {
-			h.errLogger.Printf("at=post request_id=%q content_length=%d msgcount=%d status=%d body=%q\n", uuid, cr.count, formatter.MsgCount(), status, body)
+			h.events().log(level, "post", append(kvs, "body", redactor.Replace(string(body))))
 		}
 
 	default:
-		if h.config.Verbose {
-			h.Logger.Printf("at=post request_id=%q status=%d\n", uuid, status)
-		}
+		h.events().Debug("post", "request_id", uuid, "msgcount", formatter.MsgCount(), "status", status)
 		if rh, ok := formatter.(ResponseHandler); ok { // If the formatter is also a ResponseHandler, then handle the response
 			err = rh.HandleResponse(resp)
 		}
 	}
 
-	return err
+	return resp.StatusCode, err
 }
 
-func (h *HTTPOutlet) timeRequest(req *http.Request) (resp *http.Response, err error) {
+// updateDeliveryLatency times how long after they were received the lines of
+// the delivered batch were delivered. Partially delivered batches aren't
+// timed, as which of their lines were delivered isn't known.
+func (h *HTTPOutlet) updateDeliveryLatency(batch Batch) {
+	now := time.Now()
+	for _, ll := range batch.logLines {
+		h.deliveryLatency.Update(now.Sub(ll.when))
+	}
+}
+
+// events returns the EventLogger of the outlet's loggers
+func (h *HTTPOutlet) events() EventLogger {
+	events := NewEventLogger(h.Logger, h.errLogger, h.config)
+	events.self = h.selfLog
+	return events
+}
+
+// rejectedError is returned by post when a request is rejected with a 4xx
+// status that isn't retried.
+type rejectedError struct {
+	status int
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("rejected with status %d", e.status)
+}
+
+// statusError is returned by post when a request is answered with a status
+// that is retried, see retryableStatus.
+type statusError struct {
+	status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("responded with status %d", e.status)
+}
+
+// retryableStatus returns whether a request answered with status is retried:
+// the destination is rate limiting (429) or failed (5xx).
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// deliver a batch with a Deliverer, timing it like a post. Its requests are
+// made like posts too, see requestContext, and the AWS clients count their
+// body bytes, see countingHTTPClient.
+func (h *HTTPOutlet) deliver(d Deliverer) (err error) {
 	defer func(t time.Time) {
-		if err != nil {
-			h.postFailureTimer.UpdateSince(t)
-		} else {
-			h.postSuccessTimer.UpdateSince(t)
-		}
+		h.timePost(t, err)
+		h.countDelivery(err)
 	}(time.Now())
-	return h.client.Do(req)
+	ctx := context.WithValue(h.requestContext(), bodyCountersKey{}, bodyCounters{out: h.postBytesOut, in: h.postBytesIn})
+	return d.Deliver(ctx)
+}
+
+func (h *HTTPOutlet) timeRequest(req *http.Request) (resp *http.Response, err error) {
+	defer func(t time.Time) { h.timePost(t, err) }(time.Now())
+	return h.client.Do(req.WithContext(h.requestContext()))
+}
+
+// requestContext returns the context of the outlet's requests, which go
+// through its proxy and count whether they reuse a pooled connection.
+func (h *HTTPOutlet) requestContext() context.Context {
+	ctx := context.WithValue(h.ctx, proxyKey{}, h.proxy)
+	return traceConnections(ctx, h.connsReused, h.connsNew)
+}
+
+// timePost updates the post success or failure timer, depending on err, with
+// the time since t
+func (h *HTTPOutlet) timePost(t time.Time, err error) {
+	if err != nil {
+		h.postFailureTimer.UpdateSince(t)
+	} else {
+		h.postSuccessTimer.UpdateSince(t)
+	}
+}
+
+// sleepContext sleeps for d, returning ctx's error if it's done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // isEOF returns whether err is io.EOF or a *url.Error wrapping
@@ -197,7 +467,8 @@ func isEOF(err error) bool {
 	return ok && uerr.Err == io.EOF
 }
 
-// countingReader stores the total bytes read from an underlying reader.
+// countingReader stores the total bytes read from an underlying reader, and
+// closes it if it's an io.Closer.
 type countingReader struct {
 	reader io.Reader
 	count  int64
@@ -209,3 +480,11 @@ func (c *countingReader) Read(p []byte) (int, error) {
 	c.count += int64(n)
 	return n, err
 }
+
+// Close implements the io.Closer interface.
+func (c *countingReader) Close() error {
+	if closer, ok := c.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
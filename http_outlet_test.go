@@ -2,6 +2,7 @@ package shuttle
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -75,7 +76,7 @@ func TestOutletEOFRetry(t *testing.T) {
 
 	batch := NewBatch(config.BatchSize)
 
-	batch.Add(LogLine{[]byte(logLineText), time.Now()})
+	batch.Add(LogLine{line: []byte(logLineText), when: time.Now()})
 
 	outlet.retryPost(batch)
 	if th.called != 2 {
@@ -108,7 +109,7 @@ func TestOutletEOFRetryMax(t *testing.T) {
 
 	batch := NewBatch(config.BatchSize)
 
-	batch.Add(LogLine{[]byte("Hello"), time.Now()})
+	batch.Add(LogLine{line: []byte("Hello"), when: time.Now()})
 
 	outlet.retryPost(batch)
 	if th.called != config.MaxAttempts {
@@ -164,7 +165,7 @@ func TestOutletOtherRetry(t *testing.T) {
 
 	batch := NewBatch(config.BatchSize)
 
-	batch.Add(LogLine{[]byte(logLineText), time.Now()})
+	batch.Add(LogLine{line: []byte(logLineText), when: time.Now()})
 
 	outlet.retryPost(batch)
 
@@ -188,7 +189,7 @@ func TestOutletOtherRetryMax(t *testing.T) {
 
 	batch := NewBatch(config.BatchSize)
 
-	batch.Add(LogLine{[]byte("Hello"), time.Now()})
+	batch.Add(LogLine{line: []byte("Hello"), when: time.Now()})
 
 	outlet.retryPost(batch)
 
@@ -228,7 +229,7 @@ func TestTimeout(t *testing.T) {
 	outlet := NewHTTPOutlet(s)
 
 	batch := NewBatch(config.BatchSize)
-	batch.Add(LogLine{[]byte("Hello"), time.Now()})
+	batch.Add(LogLine{line: []byte("Hello"), when: time.Now()})
 	outlet.retryPost(batch)
 
 	if v := atomic.LoadInt32(&called); v != 2 {
@@ -288,11 +289,12 @@ func TestPostError(t *testing.T) {
 	outlet := NewHTTPOutlet(s)
 
 	batch := NewBatch(config.BatchSize)
-	batch.Add(LogLine{[]byte("Hello"), time.Now()})
+	batch.Add(LogLine{line: []byte("Hello"), when: time.Now()})
 	outlet.retryPost(batch)
 
-	if lost := s.Lost.Read(); lost > 0 {
-		t.Errorf("expected lost of 0, got %d", lost)
+	// Rejected batches aren't retried, but are lost
+	if lost := s.Lost.Read(); lost != 1 {
+		t.Errorf("expected lost of 1, got %d", lost)
 	}
 
 	for _, field := range []string{
@@ -306,3 +308,73 @@ func TestPostError(t *testing.T) {
 	}
 
 }
+
+func TestPostRetriedStatus(t *testing.T) {
+	for _, tc := range []struct {
+		statuses []int
+		lost     int
+	}{
+		{[]int{http.StatusTooManyRequests, http.StatusOK}, 0},
+		{[]int{http.StatusBadGateway, http.StatusServiceUnavailable}, 1},
+		{[]int{http.StatusBadRequest}, 1},
+	} {
+		var called int
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called++
+			w.WriteHeader(tc.statuses[called-1])
+		}))
+
+		config := newTestConfig()
+		config.LogsURL = ts.URL
+		config.MaxAttempts = 2
+		s := NewShuttle(config)
+
+		batch := NewBatch(config.BatchSize)
+		batch.Add(LogLine{line: []byte("Hello"), when: time.Now()})
+		NewHTTPOutlet(s).retryPost(batch)
+		ts.Close()
+
+		if called != len(tc.statuses) {
+			t.Errorf("%v: expected %d attempts, got %d", tc.statuses, len(tc.statuses), called)
+		}
+		if lost := s.Lost.Read(); lost != tc.lost {
+			t.Errorf("%v: expected lost of %d, got %d", tc.statuses, tc.lost, lost)
+		}
+	}
+}
+
+// testDeliverer is a formatter that delivers batches itself
+type testDeliverer struct {
+	HTTPFormatter
+	delivered *int
+}
+
+func (d testDeliverer) Deliver(ctx context.Context) error {
+	*d.delivered++
+	return nil
+}
+
+func TestOutletDeliverer(t *testing.T) {
+	th := new(testHelper)
+	ts := httptest.NewServer(th)
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.UseGzip = true
+
+	var delivered int
+	s := NewShuttle(config)
+	s.NewFormatterFunc = func(b Batch, eData []errData, config *Config) HTTPFormatter {
+		return testDeliverer{NewLogplexBatchFormatter(b, eData, config), &delivered}
+	}
+	outlet := NewHTTPOutlet(s)
+
+	batch := NewBatch(config.BatchSize)
+	batch.Add(LogLine{line: []byte("Hello"), when: time.Now()})
+	outlet.retryPost(batch)
+
+	if delivered != 1 || th.Called != 0 {
+		t.Errorf("expected the batch to be delivered by the formatter only, delivered=%d posted=%d", delivered, th.Called)
+	}
+}
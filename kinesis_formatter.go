@@ -3,17 +3,21 @@ package shuttle
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/rcrowley/go-metrics"
 )
 
 // KinesisClient defines the interface for Kinesis operations we need
@@ -24,68 +28,240 @@ type KinesisClient interface {
 // KinesisFormatter formats batches destined for AWS Kinesis HTTP endpoints
 // Kinesis has a very small payload side, so recommend setting config.BatchSize in the 1-3 range so as to not loose logs because we go over the batch size.
 // Kinesis formats the Data using the LogplexLineFormatter, which is additionally base64 encoded.
+// Batches are delivered with the AWS SDK, see Deliver, so they are signed with
+// SigV4.
 type KinesisFormatter struct {
-	records []KinesisRecord
-	client  KinesisClient
-	url     *url.URL
-	io.Reader
+	records      []KinesisRecord
+	client       KinesisClient
+	clientOpts   []func(*kinesis.Options)
+	url          *url.URL
+	streamName   string
+	partitioning int
+	shardMap     *kinesisShardMap // used by KinesisPartitionExplicitHash
+	errRecords   int              // The leading records of error lines, which aren't batch lines
+	maxAttempts  int              // Attempts at putting records that Kinesis rejects
+
+	once   sync.Once // starts writing the PutRecords JSON body on the first Read
+	reader io.Reader
 }
 
-// NewKinesisFormatter constructs a proper HTTPFormatter for Kinesis http targets
-func NewKinesisFormatter(b Batch, eData []errData, config *Config) HTTPFormatter {
-	u, err := url.Parse(config.LogsURL)
+// NewKinesisFormatterFunc returns a NewHTTPFormatterFunc for Kinesis streams
+// in region, delivering with a client built once and reused for every batch.
+// The client uses the default AWS credential chain (environment, shared
+// config & credentials files, web identity, instance/task roles) and
+// transport, or the SDK's default transport if nil. If endpoint isn't empty
+// it's used instead of the region's Kinesis endpoint, e.g. for a local
+// stand-in.
+func NewKinesisFormatterFunc(region, endpoint string, transport *http.Transport) (NewHTTPFormatterFunc, error) {
+	cfg, err := loadAWSConfig(region, transport)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	awsKey := u.User.Username()
-	awsSecret, _ := u.User.Password()
-	streamName := strings.TrimPrefix(u.Path, "/")
+	client := kinesis.NewFromConfig(cfg, func(o *kinesis.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	shardMap := newKinesisShardMap(client)
+	return func(b Batch, eData []errData, config *Config) HTTPFormatter {
+		return newKinesisFormatter(b, eData, config, client, shardMap)
+	}, nil
+}
 
-	u.User = nil // Ensure there is no auth info
-	u.Path = ""  // Ensure there is no path
+// loadAWSConfig loads the default AWS config for region, with clients using
+// the settings of transport unless it's nil. Their requests count the body
+// bytes of outlets' deliveries, see countingHTTPClient.
+func loadAWSConfig(region string, transport *http.Transport) (aws.Config, error) {
+	opts := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(region)}
+	if transport != nil {
+		opts = append(opts, awsconfig.WithHTTPClient(awsHTTPClient(transport)))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return cfg, err
+	}
+	// Wrapped once loaded, as the CA bundles are only added to a
+	// BuildableClient
+	cfg.HTTPClient = countingHTTPClient{client: cfg.HTTPClient}
+	return cfg, nil
+}
 
-	// Create AWS config with credentials
-	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(),
-		awsconfig.WithRegion("us-east-1"), // Kinesis region
-		awsconfig.WithCredentialsProvider(aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
-			return aws.Credentials{
-				AccessKeyID:     awsKey,
-				SecretAccessKey: awsSecret,
-			}, nil
-		})),
-	)
+// awsHTTPClient returns an AWS HTTP client whose transport has the TLS, proxy,
+// dialing & pooling settings of transport. The SDK only adds the CA bundle of
+// $AWS_CA_BUNDLE or a profile's ca_bundle to the transport of a
+// BuildableClient, so transport can't be used as is. The TLS config is cloned
+// for that reason too. -tls-ca-file takes precedence over those bundles.
+func awsHTTPClient(transport *http.Transport) *awshttp.BuildableClient {
+	return awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.Proxy = transport.Proxy
+		tr.DialContext = transport.DialContext
+		if transport.TLSClientConfig != nil {
+			tr.TLSClientConfig = transport.TLSClientConfig.Clone()
+		}
+		tr.MaxIdleConns = transport.MaxIdleConns
+		tr.MaxIdleConnsPerHost = transport.MaxIdleConnsPerHost
+		tr.MaxConnsPerHost = transport.MaxConnsPerHost
+		tr.IdleConnTimeout = transport.IdleConnTimeout
+		tr.ForceAttemptHTTP2 = transport.ForceAttemptHTTP2
+		tr.TLSNextProto = transport.TLSNextProto
+	})
+}
+
+// bodyCountersKey is the context key of the bodyCounters of an outlet's
+// deliveries, see countingHTTPClient
+type bodyCountersKey struct{}
+
+// bodyCounters count the bytes of request & response bodies
+type bodyCounters struct {
+	out, in metrics.Counter
+}
+
+// countingHTTPClient is the HTTP client of AWS clients. Requests made with a
+// context carrying bodyCounters count their body bytes with them, as
+// countingReaders do for posts.
+type countingHTTPClient struct {
+	client aws.HTTPClient
+}
+
+// Do implements the aws.HTTPClient interface.
+func (c countingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	counters, ok := req.Context().Value(bodyCountersKey{}).(bodyCounters)
+	if !ok {
+		return c.client.Do(req)
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		r := new(http.Request)
+		*r = *req
+		r.Body = &countingBody{ReadCloser: req.Body, counter: counters.out}
+		req = r
+	}
+	resp, err := c.client.Do(req)
+	if resp != nil && resp.Body != nil {
+		resp.Body = &countingBody{ReadCloser: resp.Body, counter: counters.in}
+	}
+	return resp, err
+}
+
+// countingBody counts the bytes read from a body with counter
+type countingBody struct {
+	io.ReadCloser
+	counter metrics.Counter
+}
+
+// Read implements the io.Reader interface.
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.counter.Inc(int64(n))
+	return n, err
+}
+
+// NewKinesisFormatter constructs a proper HTTPFormatter for Kinesis http
+// targets in us-east-1, loading the AWS config for every batch.
+//
+// Deprecated: use NewKinesisFormatterFunc, which takes the region and reuses
+// its client.
+func NewKinesisFormatter(b Batch, eData []errData, config *Config) HTTPFormatter {
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO(), awsconfig.WithRegion("us-east-1"))
 	if err != nil {
 		panic(err)
 	}
-
 	client := kinesis.NewFromConfig(cfg)
+	return newKinesisFormatter(b, eData, config, client, newKinesisShardMap(client))
+}
+
+// newKinesisFormatter returns a KinesisFormatter delivering with client,
+// partitioning records as set by config.KinesisPartitioning. AWS keys embedded
+// in config.LogsURL are still honored, but are deprecated in favour of the
+// credential chain.
+func newKinesisFormatter(b Batch, eData []errData, config *Config, client KinesisClient, shardMap *kinesisShardMap) *KinesisFormatter {
+	u, err := url.Parse(config.LogsURL)
+	if err != nil {
+		panic(err)
+	}
+
 	kf := &KinesisFormatter{
-		records: make([]KinesisRecord, 0, b.MsgCount()+len(eData)),
-		client:  client,
-		url:     u,
+		records:      make([]KinesisRecord, 0, b.MsgCount()+len(eData)),
+		client:       client,
+		streamName:   strings.TrimPrefix(u.Path, "/"),
+		partitioning: config.KinesisPartitioning,
+		shardMap:     shardMap,
+		errRecords:   len(eData),
+		maxAttempts:  config.MaxAttempts,
 	}
 
+	if awsSecret, ok := u.User.Password(); ok {
+		creds := aws.Credentials{AccessKeyID: u.User.Username(), SecretAccessKey: awsSecret}
+		kf.clientOpts = append(kf.clientOpts, func(o *kinesis.Options) {
+			o.Credentials = aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+				return creds, nil
+			})
+		})
+	}
+
+	u.User = nil // Ensure there is no auth info
+	u.Path = ""  // Ensure there is no path
+	kf.url = u
+
 	for _, edata := range eData {
 		kf.records = append(kf.records, KinesisRecord{llf: NewLogplexErrorFormatter(edata, config)})
 	}
 
 	for _, l := range b.logLines {
-		kf.records = append(kf.records, KinesisRecord{llf: NewLogplexLineFormatter(l, config)})
+		record := KinesisRecord{llf: NewLogplexLineFormatter(l, config)}
+		if config.KinesisPartitioning == KinesisPartitionField {
+			record.key = fieldPartitionKey(l, config.KinesisPartitionField, config)
+		}
+		kf.records = append(kf.records, record)
+	}
+
+	// Error records of the field partitioning keep the app-name, explicit
+	// hash keys are assigned on delivery.
+	var cs int
+	for i := range kf.records {
+		switch config.KinesisPartitioning {
+		case KinesisPartitionRoundRobin:
+			cs = determineShard(cs, config.KinesisShards)
+			kf.records[i].shard = cs
+		case KinesisPartitionRandom:
+			kf.records[i].key = randomPartitionKey()
+		case KinesisPartitionFixed:
+			kf.records[i].key = config.KinesisPartitionKey
+		}
+	}
+
+	return kf
+}
+
+// Given a current shard number and the number number of shards return the next shard number
+// In the case of 0 KinesisRecord does not add the shard number to the PartitionKey
+func determineShard(c, max int) int {
+	if max == 1 {
+		return 0
+	}
+	if c == max {
+		c = 0
 	}
+	return c + 1
+}
 
+// Read the PutRecords JSON body of the batch
+func (kf *KinesisFormatter) Read(p []byte) (int, error) {
+	kf.once.Do(kf.startBody)
+	return kf.reader.Read(p)
+}
+
+// startBody writes the records to kf.reader as a PutRecords JSON body
+func (kf *KinesisFormatter) startBody() {
 	recordsReader, recordsWriter := io.Pipe()
-	kf.Reader = io.MultiReader(
-		bytes.NewReader([]byte(`{"StreamName":"`+streamName+`","Records":[`)),
+	kf.reader = io.MultiReader(
+		bytes.NewReader([]byte(`{"StreamName":"`+kf.streamName+`","Records":[`)),
 		recordsReader,
 		bytes.NewReader([]byte("]}")),
 	)
 
 	go func() {
-		var cs int
 		for i, record := range kf.records {
-			cs = determineShard(cs, config.KinesisShards)
-			record.shard = cs
 			if _, err := record.WriteTo(recordsWriter); err != nil {
 				recordsWriter.CloseWithError(err)
 				return
@@ -99,24 +275,11 @@ func NewKinesisFormatter(b Batch, eData []errData, config *Config) HTTPFormatter
 		}
 		recordsWriter.Close()
 	}()
-
-	return kf
-}
-
-// Given a current shard number and the number number of shards return the next shard number
-// In the case of 0 KinesisRecord does not add the shard number to the PartitionKey
-func determineShard(c, max int) int {
-	if max == 1 {
-		return 0
-	}
-	if c == max {
-		c = 0
-	}
-	return c + 1
 }
 
-// Request constructs a request for this formatter
-// See: http://docs.aws.amazon.com/kinesis/latest/APIReference/API_PutRecord.html
+// Request constructs the PutRecords request for this formatter. Outlets
+// deliver the batch with Deliver instead, as the request isn't signed.
+// See: http://docs.aws.amazon.com/kinesis/latest/APIReference/API_PutRecords.html
 func (kf *KinesisFormatter) Request() (*http.Request, error) {
 	req, err := http.NewRequest("POST", kf.url.String(), kf)
 	if err != nil {
@@ -127,48 +290,102 @@ func (kf *KinesisFormatter) Request() (*http.Request, error) {
 	req.Header.Add("X-Amz-Target", "Kinesis_20131202.PutRecords")
 	req.Host = kf.url.Host
 
-	// Use the AWS SDK v2 to put records
-	records := make([]types.PutRecordsRequestEntry, 0, len(kf.records))
-	for _, record := range kf.records {
-		// Create a buffer to hold the record data
-		var buf bytes.Buffer
-		if _, err := record.WriteTo(&buf); err != nil {
-			return nil, err
-		}
+	return req, nil
+}
 
-		// Parse the JSON to get the data and partition key
-		var r struct {
-			Data         string `json:"Data"`
-			PartitionKey string `json:"PartitionKey"`
+// Deliver the records with the AWS SDK's PutRecords. See Deliverer. Records
+// that Kinesis rejects, e.g. when a shard's throughput is exceeded, are
+// retried up to config.MaxAttempts times. If some are still rejected, or the
+// retries fail, a *PartialDeliveryError counting their lines is returned.
+func (kf *KinesisFormatter) Deliver(ctx context.Context) error {
+	if kf.partitioning == KinesisPartitionExplicitHash {
+		hashKeys, err := kf.shardMap.hashKeys(ctx, kf.streamName, len(kf.records), kf.clientOpts...)
+		if err != nil {
+			return err
 		}
-		if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
-			return nil, err
+		for i := range kf.records {
+			kf.records[i].hashKey = hashKeys[i]
 		}
+	}
 
-		// Decode the base64 data
-		data, err := base64.StdEncoding.DecodeString(r.Data)
+	entries := make([]types.PutRecordsRequestEntry, 0, len(kf.records))
+	for _, record := range kf.records {
+		data, err := ioutil.ReadAll(record.llf)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		record.llf.Reset()
 
 		entry := types.PutRecordsRequestEntry{
 			Data:         data,
-			PartitionKey: aws.String(r.PartitionKey),
+			PartitionKey: aws.String(record.partitionKey()),
+		}
+		if record.hashKey != "" {
+			entry.ExplicitHashKey = aws.String(record.hashKey)
 		}
-		records = append(records, entry)
+		entries = append(entries, entry)
 	}
 
-	input := &kinesis.PutRecordsInput{
-		Records:    records,
-		StreamName: aws.String(strings.TrimPrefix(kf.url.Path, "/")),
+	pending := make([]int, len(entries))
+	for i := range pending {
+		pending[i] = i
+	}
+	pending, err := kf.put(ctx, entries, pending)
+	if err != nil && len(pending) == len(entries) {
+		return err
 	}
 
-	_, err = kf.client.PutRecords(context.TODO(), input)
+	for attempts := 1; err != nil && attempts < kf.maxAttempts; attempts++ {
+		if serr := sleepContext(ctx, time.Duration(attempts)*EOFRetrySleep*time.Millisecond); serr != nil {
+			err = serr
+			break
+		}
+		pending, err = kf.put(ctx, entries, pending)
+	}
+	if err == nil {
+		return nil
+	}
+	var failed int
+	for _, r := range pending {
+		if r >= kf.errRecords {
+			failed++
+		}
+	}
+	return &PartialDeliveryError{Failed: failed, Err: err}
+}
+
+// put the entries at the pending indexes with PutRecords, returning the
+// indexes of the ones that failed and the error of the last failure.
+func (kf *KinesisFormatter) put(ctx context.Context, entries []types.PutRecordsRequestEntry, pending []int) ([]int, error) {
+	records := make([]types.PutRecordsRequestEntry, 0, len(pending))
+	for _, r := range pending {
+		records = append(records, entries[r])
+	}
+
+	out, err := kf.client.PutRecords(ctx, &kinesis.PutRecordsInput{
+		Records:    records,
+		StreamName: aws.String(kf.streamName),
+	}, kf.clientOpts...)
 	if err != nil {
-		return nil, err
+		return pending, err
+	}
+	if aws.ToInt32(out.FailedRecordCount) == 0 {
+		return nil, nil
 	}
 
-	return req, nil
+	var failed []int
+	var lastErr error
+	for i, result := range out.Records {
+		if result.ErrorCode != nil && i < len(pending) {
+			failed = append(failed, pending[i])
+			lastErr = fmt.Errorf("%s: %s", aws.ToString(result.ErrorCode), aws.ToString(result.ErrorMessage))
+		}
+	}
+	if lastErr == nil {
+		// Which records failed isn't known, so all of them did
+		return pending, fmt.Errorf("%d records failed", aws.ToInt32(out.FailedRecordCount))
+	}
+	return failed, lastErr
 }
 
 // MsgCount returns the number of records that the formatter is formatting
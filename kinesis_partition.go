@@ -0,0 +1,195 @@
+package shuttle
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/pborman/uuid"
+)
+
+// Kinesis partitioning constants, see Config.KinesisPartitioning.
+const (
+	KinesisPartitionRoundRobin   = iota // default, the app-name plus a round-robin integer up to KinesisShards
+	KinesisPartitionRandom              // a random partition key per record
+	KinesisPartitionExplicitHash        // explicit hash keys spreading the records evenly over the stream's open shards
+	KinesisPartitionField               // a hash of KinesisPartitionField
+	KinesisPartitionFixed               // KinesisPartitionKey (the app-name if empty) for every record, keeping their order
+)
+
+// KinesisShardMapTTL is how long the shard map of a stream is used before it's
+// listed again, so that resharding is picked up.
+const KinesisShardMapTTL = time.Minute
+
+// KinesisPartitionHeaderFields are the RFC5424 header fields that
+// KinesisPartitionField can name, with their position in the header. Any other
+// field is looked up as a key=value pair in the message.
+var KinesisPartitionHeaderFields = map[string]int{
+	"hostname": 2,
+	"app-name": 3,
+	"procid":   4,
+	"msgid":    5,
+}
+
+// KinesisShardLister lists the shards of a stream, it's implemented by
+// *kinesis.Client
+type KinesisShardLister interface {
+	ListShards(ctx context.Context, params *kinesis.ListShardsInput, optFns ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error)
+}
+
+// kinesisShardMap caches the hash keys of the open shards of streams, handing
+// them out in turn.
+type kinesisShardMap struct {
+	client KinesisShardLister
+	now    func() time.Time
+
+	mu      sync.Mutex // protects streams
+	streams map[string]*kinesisStreamShards
+}
+
+type kinesisStreamShards struct {
+	hashKeys []string // The starting hash key of each open shard
+	listed   time.Time
+	next     int
+}
+
+func newKinesisShardMap(client KinesisClient) *kinesisShardMap {
+	sl, _ := client.(KinesisShardLister)
+	return &kinesisShardMap{
+		client:  sl,
+		now:     time.Now,
+		streams: make(map[string]*kinesisStreamShards),
+	}
+}
+
+// hashKeys returns n explicit hash keys for records of stream, continuing
+// the round over its shards where the previous call left off.
+func (m *kinesisShardMap) hashKeys(ctx context.Context, stream string, n int, optFns ...func(*kinesis.Options)) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.streams[stream]
+	if s == nil || m.now().Sub(s.listed) >= KinesisShardMapTTL {
+		hashKeys, err := m.list(ctx, stream, optFns...)
+		if err != nil {
+			return nil, err
+		}
+		if s == nil {
+			s = &kinesisStreamShards{}
+			m.streams[stream] = s
+		}
+		s.hashKeys, s.listed = hashKeys, m.now()
+	}
+
+	keys := make([]string, n)
+	for i := range keys {
+		s.next %= len(s.hashKeys)
+		keys[i] = s.hashKeys[s.next]
+		s.next++
+	}
+	return keys, nil
+}
+
+// list the starting hash keys of the open shards of stream
+func (m *kinesisShardMap) list(ctx context.Context, stream string, optFns ...func(*kinesis.Options)) ([]string, error) {
+	if m.client == nil {
+		return nil, fmt.Errorf("kinesis: the client can't list shards")
+	}
+
+	var hashKeys []string
+	input := &kinesis.ListShardsInput{StreamName: aws.String(stream)}
+	for {
+		out, err := m.client.ListShards(ctx, input, optFns...)
+		if err != nil {
+			return nil, err
+		}
+		for _, shard := range out.Shards {
+			// Closed shards have an ending sequence number
+			if shard.HashKeyRange == nil || (shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil) {
+				continue
+			}
+			hashKeys = append(hashKeys, aws.ToString(shard.HashKeyRange.StartingHashKey))
+		}
+		if out.NextToken == nil {
+			break
+		}
+		input = &kinesis.ListShardsInput{NextToken: out.NextToken}
+	}
+
+	if len(hashKeys) == 0 {
+		return nil, fmt.Errorf("kinesis: stream %q has no open shards", stream)
+	}
+	return hashKeys, nil
+}
+
+// randomPartitionKey returns a new random partition key
+func randomPartitionKey() string {
+	return uuid.New()
+}
+
+// fieldPartitionKey returns the hex MD5 digest of the named field of ll, or of
+// an empty string if ll doesn't have it.
+func fieldPartitionKey(ll LogLine, field string, config *Config) string {
+	sum := md5.Sum([]byte(lineField(ll, field, config)))
+	return hex.EncodeToString(sum[:])
+}
+
+// lineField returns the value of the named RFC5424 header field (see
+// KinesisPartitionHeaderFields) or key=value pair of ll. The header fields of
+// raw lines are those of config, or the line's app-name & procid.
+func lineField(ll LogLine, field string, config *Config) string {
+	line := ll.line
+	if config.InputFormat == InputFormatLengthPrefixedRFC5424 {
+		if i := bytes.IndexByte(line, ' '); i >= 0 {
+			line = line[i+1:]
+		}
+	}
+
+	if pos, ok := KinesisPartitionHeaderFields[field]; ok {
+		if config.InputFormat == InputFormatRaw {
+			switch field {
+			case "hostname":
+				return config.Hostname
+			case "app-name":
+				return ll.appNameOr(config.Appname)
+			case "procid":
+				return ll.procidOr(config.Procid)
+			}
+			return config.Msgid
+		}
+		fields := bytes.SplitN(line, []byte(" "), pos+2)
+		if len(fields) <= pos {
+			return ""
+		}
+		return string(fields[pos])
+	}
+
+	key := []byte(field + "=")
+	for start := 0; start < len(line); {
+		i := bytes.Index(line[start:], key)
+		if i < 0 {
+			break
+		}
+		i += start
+		if i == 0 || line[i-1] == ' ' {
+			value := line[i+len(key):]
+			if len(value) > 0 && value[0] == '"' {
+				value = value[1:]
+				if end := bytes.IndexByte(value, '"'); end >= 0 {
+					value = value[:end]
+				}
+			} else if end := bytes.IndexAny(value, " \n"); end >= 0 {
+				value = value[:end]
+			}
+			return string(value)
+		}
+		start = i + len(key)
+	}
+	return ""
+}
@@ -0,0 +1,202 @@
+package shuttle
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// mockKinesisShardClient is a mockKinesisClient listing shards, in pages of
+// one shard.
+type mockKinesisShardClient struct {
+	mockKinesisClient
+	shards []types.Shard
+	lists  int
+}
+
+func (m *mockKinesisShardClient) ListShards(ctx context.Context, params *kinesis.ListShardsInput, optFns ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error) {
+	var i int
+	if params.NextToken != nil {
+		if params.StreamName != nil {
+			panic("StreamName and NextToken can't both be set")
+		}
+		i = len(aws.ToString(params.NextToken))
+	} else {
+		m.lists++
+	}
+	out := &kinesis.ListShardsOutput{Shards: m.shards[i : i+1]}
+	if i+1 < len(m.shards) {
+		out.NextToken = aws.String(strings.Repeat("n", i+1))
+	}
+	return out, nil
+}
+
+func testShard(startingHashKey string, closed bool) types.Shard {
+	s := types.Shard{
+		HashKeyRange:        &types.HashKeyRange{StartingHashKey: aws.String(startingHashKey)},
+		SequenceNumberRange: &types.SequenceNumberRange{StartingSequenceNumber: aws.String("1")},
+	}
+	if closed {
+		s.SequenceNumberRange.EndingSequenceNumber = aws.String("2")
+	}
+	return s
+}
+
+func TestKinesisPartitioning(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config func(*Config)
+		check  func(t *testing.T, entries []types.PutRecordsRequestEntry)
+	}{
+		{"round robin", func(c *Config) { c.KinesisShards = 2 }, func(t *testing.T, entries []types.PutRecordsRequestEntry) {
+			if k := aws.ToString(entries[0].PartitionKey); k != "shuttle1" {
+				t.Errorf("expected shuttle1, got %q", k)
+			}
+			if k := aws.ToString(entries[1].PartitionKey); k != "shuttle2" {
+				t.Errorf("expected shuttle2, got %q", k)
+			}
+		}},
+		{"random", func(c *Config) { c.KinesisPartitioning = KinesisPartitionRandom }, func(t *testing.T, entries []types.PutRecordsRequestEntry) {
+			if k0, k1 := aws.ToString(entries[0].PartitionKey), aws.ToString(entries[1].PartitionKey); k0 == k1 || len(k0) == 0 {
+				t.Errorf("expected different random keys, got %q %q", k0, k1)
+			}
+		}},
+		{"field", func(c *Config) {
+			c.KinesisPartitioning = KinesisPartitionField
+			c.KinesisPartitionField = "user"
+		}, func(t *testing.T, entries []types.PutRecordsRequestEntry) {
+			k0, k1, k2 := aws.ToString(entries[0].PartitionKey), aws.ToString(entries[1].PartitionKey), aws.ToString(entries[2].PartitionKey)
+			if k0 != k2 || k0 == k1 || len(k0) != 32 {
+				t.Errorf("expected the keys of the same field value to match, got %q %q %q", k0, k1, k2)
+			}
+		}},
+		{"fixed", func(c *Config) {
+			c.KinesisPartitioning = KinesisPartitionFixed
+			c.KinesisShards = 2
+		}, func(t *testing.T, entries []types.PutRecordsRequestEntry) {
+			for _, e := range entries {
+				if k := aws.ToString(e.PartitionKey); k != "shuttle" {
+					t.Errorf("expected the app-name, got %q", k)
+				}
+			}
+		}},
+		{"fixed key", func(c *Config) {
+			c.KinesisPartitioning = KinesisPartitionFixed
+			c.KinesisPartitionKey = "ordered"
+		}, func(t *testing.T, entries []types.PutRecordsRequestEntry) {
+			for _, e := range entries {
+				if k := aws.ToString(e.PartitionKey); k != "ordered" {
+					t.Errorf("expected the fixed key, got %q", k)
+				}
+			}
+		}},
+		{"explicit hash", func(c *Config) { c.KinesisPartitioning = KinesisPartitionExplicitHash }, func(t *testing.T, entries []types.PutRecordsRequestEntry) {
+			var hashKeys []string
+			for _, e := range entries {
+				hashKeys = append(hashKeys, aws.ToString(e.ExplicitHashKey))
+			}
+			if strings.Join(hashKeys, ",") != "0,200,0" {
+				t.Errorf("expected the open shards' hash keys in turn, got %q", hashKeys)
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := newTestConfig()
+			config.LogsURL = "https://kinesis.us-east-1.amazonaws.com/Stream"
+			tc.config(&config)
+
+			b := NewBatch(3)
+			b.Add(LogLine{line: []byte("user=alice login\n"), when: time.Now()})
+			b.Add(LogLine{line: []byte("user=bob login\n"), when: time.Now()})
+			b.Add(LogLine{line: []byte("logout user=alice\n"), when: time.Now()})
+
+			var entries []types.PutRecordsRequestEntry
+			client := &mockKinesisShardClient{
+				mockKinesisClient: mockKinesisClient{
+					putRecordsFunc: func(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error) {
+						entries = params.Records
+						return &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int32(0)}, nil
+					},
+				},
+				shards: []types.Shard{testShard("0", false), testShard("100", true), testShard("200", false)},
+			}
+			kf := newKinesisFormatter(b, noErrData, &config, client, newKinesisShardMap(client))
+			if err := kf.Deliver(context.Background()); err != nil {
+				t.Fatal("unexpected error: ", err)
+			}
+			if len(entries) != 3 {
+				t.Fatalf("expected 3 entries, got %d", len(entries))
+			}
+			tc.check(t, entries)
+		})
+	}
+}
+
+func TestKinesisShardMap(t *testing.T) {
+	client := &mockKinesisShardClient{shards: []types.Shard{testShard("0", false), testShard("100", false)}}
+	m := newKinesisShardMap(client)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	keys, err := m.hashKeys(context.Background(), "Stream", 3)
+	if err != nil || strings.Join(keys, ",") != "0,100,0" {
+		t.Fatalf("unexpected keys %q, %v", keys, err)
+	}
+	keys, _ = m.hashKeys(context.Background(), "Stream", 1)
+	if keys[0] != "100" || client.lists != 1 {
+		t.Errorf("expected the next shard from the cached map, got %q after %d lists", keys, client.lists)
+	}
+
+	// After a reshard the map is listed again once it's stale
+	client.shards = []types.Shard{testShard("0", true), testShard("100", true), testShard("50", false)}
+	now = now.Add(KinesisShardMapTTL)
+	keys, _ = m.hashKeys(context.Background(), "Stream", 2)
+	if strings.Join(keys, ",") != "50,50" || client.lists != 2 {
+		t.Errorf("expected the new shard, got %q after %d lists", keys, client.lists)
+	}
+
+	client.shards = []types.Shard{testShard("0", true)}
+	if _, err := m.hashKeys(context.Background(), "Other", 1); err == nil || !strings.Contains(err.Error(), "no open shards") {
+		t.Errorf("expected an error for a stream without open shards, got %v", err)
+	}
+
+	if _, err := newKinesisShardMap(mockKinesisClient{}).hashKeys(context.Background(), "Stream", 1); err == nil {
+		t.Error("expected an error for a client that can't list shards")
+	}
+}
+
+func TestLineField(t *testing.T) {
+	rfc5424 := newTestConfig()
+	rfc5424.InputFormat = InputFormatRFC5424
+	lprfc5424 := newTestConfig()
+	lprfc5424.InputFormat = InputFormatLengthPrefixedRFC5424
+	raw := newTestConfig()
+
+	line := "<190>1 2024-01-02T03:04:05Z host app web.1 - - at=info user=\"alice smith\" path=/\n"
+	for _, tc := range []struct {
+		line     string
+		field    string
+		config   *Config
+		expected string
+	}{
+		{line, "hostname", &rfc5424, "host"},
+		{line, "app-name", &rfc5424, "app"},
+		{line, "procid", &rfc5424, "web.1"},
+		{"78 " + line, "procid", &lprfc5424, "web.1"},
+		{line, "user", &rfc5424, "alice smith"},
+		{line, "path", &rfc5424, "/"},
+		{line, "at", &rfc5424, "info"},
+		{line, "missing", &rfc5424, ""},
+		{"superuser=bob user=alice\n", "user", &raw, "alice"},
+		{"user=alice\n", "app-name", &raw, raw.Appname},
+	} {
+		if v := lineField(LogLine{line: []byte(tc.line)}, tc.field, tc.config); v != tc.expected {
+			t.Errorf("expected %s of %q to be %q, got %q", tc.field, tc.line, tc.expected, v)
+		}
+	}
+}
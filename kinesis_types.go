@@ -9,13 +9,17 @@ import (
 const (
 	partitionKeyHeader = `{"PartitionKey":"`
 	partitionKeyFooter = `","Data":"`
+
+	explicitHashKeyHeader = `","ExplicitHashKey":"`
 )
 
 // KinesisRecord is used to marshal LoglexLineFormatters to Kinesis Records for
 // the PutRecords API Call
 type KinesisRecord struct {
-	llf   *LogplexLineFormatter
-	shard int
+	llf     *LogplexLineFormatter
+	shard   int
+	key     string // The partition key, overrides the app-name & shard if set
+	hashKey string // The explicit hash key, if any
 }
 
 // WriteTo writes the LogplexLineFormatter to the provided writer
@@ -23,7 +27,11 @@ type KinesisRecord struct {
 func (r KinesisRecord) WriteTo(w io.Writer) (int64, error) {
 	// Add an integer in the PartitionKey to enable distribution
 	// over multiple shards in the Kinesis stream.
-	b := partitionKeyHeader + r.partitionKey() + partitionKeyFooter
+	b := partitionKeyHeader + r.partitionKey()
+	if r.hashKey != "" {
+		b += explicitHashKeyHeader + r.hashKey
+	}
+	b += partitionKeyFooter
 	t, err := w.Write([]byte(b))
 	if err != nil {
 		return int64(t), err
@@ -51,9 +59,13 @@ func encodedLen(n int64) int64 {
 	return (n + 2) / 3 * 4
 }
 
-// There is no guarantee that this partitionKey will hash to a different shard.
-// Consider this a simplistic form of "sharding" for now.
+// partitionKey is the record's key if set, otherwise the app-name plus its
+// shard. There is no guarantee that such a partitionKey will hash to a
+// different shard, see KinesisPartitionExplicitHash for an even spread.
 func (r KinesisRecord) partitionKey() string {
+	if r.key != "" {
+		return r.key
+	}
 	if r.shard == 0 {
 		return r.llf.AppName()
 	}
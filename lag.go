@@ -0,0 +1,71 @@
+package shuttle
+
+import (
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// undeliveredBatches tracks when the oldest line of each batch handed to a
+// destination's outlets was received, until the batch is delivered, lost or
+// dropped. It's the destination's msg.undelivered.oldest.seconds gauge.
+type undeliveredBatches struct {
+	mu     sync.Mutex
+	oldest map[string]time.Time // by Batch.UUID
+	now    func() time.Time
+}
+
+func newUndeliveredBatches() *undeliveredBatches {
+	return &undeliveredBatches{oldest: make(map[string]time.Time), now: time.Now}
+}
+
+// add b as undelivered
+func (u *undeliveredBatches) add(b Batch) {
+	if when := b.oldest(); !when.IsZero() {
+		u.mu.Lock()
+		u.oldest[b.UUID] = when
+		u.mu.Unlock()
+	}
+}
+
+// remove b once it's delivered, lost or dropped
+func (u *undeliveredBatches) remove(b Batch) {
+	u.mu.Lock()
+	delete(u.oldest, b.UUID)
+	u.mu.Unlock()
+}
+
+// Value returns the age in seconds of the oldest undelivered line, 0 if all
+// were delivered.
+func (u *undeliveredBatches) Value() float64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var oldest time.Time
+	for _, when := range u.oldest {
+		if oldest.IsZero() || when.Before(oldest) {
+			oldest = when
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return u.now().Sub(oldest).Seconds()
+}
+
+// Snapshot returns the current Value.
+func (u *undeliveredBatches) Snapshot() metrics.GaugeFloat64 {
+	return metrics.GaugeFloat64Snapshot(u.Value())
+}
+
+// Update does nothing, the value is computed.
+func (u *undeliveredBatches) Update(float64) {}
+
+// undeliveredFor returns the undelivered batches of route r, or of the default
+// destination if r is nil
+func (s *Shuttle) undeliveredFor(r *Route) *undeliveredBatches {
+	if r == nil {
+		return s.undelivered
+	}
+	return r.undelivered
+}
@@ -0,0 +1,121 @@
+package shuttle
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestUndeliveredBatches(t *testing.T) {
+	now := time.Unix(100, 0)
+	u := newUndeliveredBatches()
+	u.now = func() time.Time { return now }
+
+	b1, b2 := NewBatch(2), NewBatch(1)
+	b1.Add(LogLine{line: []byte("a\n"), when: now.Add(-2 * time.Second)})
+	b1.Add(LogLine{line: []byte("b\n"), when: now.Add(-5 * time.Second)})
+	b2.Add(LogLine{line: []byte("c\n"), when: now.Add(-time.Second)})
+	u.add(b1)
+	u.add(b2)
+	u.add(NewBatch(1)) // empty batches aren't tracked
+
+	if v := u.Snapshot().Value(); v != 5 {
+		t.Errorf("expected the oldest line to be 5s old, got %f", v)
+	}
+	u.remove(b1)
+	if v := u.Value(); v != 1 {
+		t.Errorf("expected the oldest line to be 1s old once b1 is delivered, got %f", v)
+	}
+	u.remove(b2)
+	if v := u.Value(); v != 0 {
+		t.Errorf("expected 0 once everything is delivered, got %f", v)
+	}
+}
+
+func TestDeliveryMetrics(t *testing.T) {
+	th := new(testHelper)
+	ts := httptest.NewServer(th)
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+
+	s := NewShuttle(config)
+	s.Launch()
+	received := time.Now().Add(-time.Second)
+	for _, l := range []string{"one", "two"} {
+		s.Send(context.Background(), NewLogLineWithMetadata([]byte(l), LineMetadata{Time: received}))
+	}
+	s.Land()
+
+	latency := s.MetricsRegistry.Get("msg.delivery.latency").(metrics.Timer)
+	if latency.Count() != 2 || latency.Min() < int64(time.Second) {
+		t.Errorf("expected 2 delivery latencies of at least 1s, got %d with a min of %s", latency.Count(), time.Duration(latency.Min()))
+	}
+	if n := s.MetricsRegistry.Get("batch.queue.wait").(metrics.Timer).Count(); n != 1 {
+		t.Errorf("expected the queue wait of 1 batch, got %d", n)
+	}
+	th.Lock()
+	defer th.Unlock()
+	if n := s.MetricsRegistry.Get("outlet.post.bytes.out").(metrics.Counter).Count(); n != int64(len(th.Actual)) {
+		t.Errorf("expected %d bytes to be posted, got %d", len(th.Actual), n)
+	}
+	if v := s.MetricsRegistry.Get("msg.undelivered.oldest.seconds").(metrics.GaugeFloat64).Value(); v != 0 {
+		t.Errorf("expected nothing to be undelivered, got %f", v)
+	}
+}
+
+// TestDelivererMetrics checks that AWS deliveries are timed and their bytes
+// counted like posts.
+func TestDelivererMetrics(t *testing.T) {
+	for k, v := range map[string]string{
+		"AWS_ACCESS_KEY_ID":           "AKIDCHAIN",
+		"AWS_SECRET_ACCESS_KEY":       "chain-secret",
+		"AWS_CONFIG_FILE":             os.DevNull,
+		"AWS_SHARED_CREDENTIALS_FILE": os.DevNull,
+	} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+	var received int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received += int64(len(b))
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"FailedRecordCount":0,"Records":[{"SequenceNumber":"1","ShardId":"shardId-000000000000"}]}`))
+	}))
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = "https://kinesis.eu-west-1.amazonaws.com/Stream"
+	config.Transport = NewHTTPTransport(config)
+	ff, err := NewKinesisFormatterFunc("eu-west-1", ts.URL, config.Transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.FormatterFunc = ff
+	s := NewShuttle(config)
+	outlet := NewHTTPOutlet(s)
+	for i := 0; i < 2; i++ {
+		batch := NewBatch(1)
+		batch.Add(NewLogLine([]byte("hello")))
+		outlet.retryPost(batch)
+	}
+
+	count := func(name string) int64 { return s.MetricsRegistry.Get(name).(metrics.Counter).Count() }
+	if n := count("outlet.post.bytes.out"); received == 0 || n != received {
+		t.Errorf("expected the %d bytes received to be counted, got %d", received, n)
+	}
+	if n := count("outlet.post.bytes.in"); n == 0 {
+		t.Error("expected the response bytes to be counted")
+	}
+	if n := s.MetricsRegistry.Get("outlet.post.success").(metrics.Timer).Count(); n != 2 {
+		t.Errorf("expected 2 timed deliveries, got %d", n)
+	}
+}
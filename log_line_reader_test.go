@@ -1,9 +1,15 @@
 package shuttle
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"regexp"
 	"sync"
 	"testing"
+
+	metrics "github.com/rcrowley/go-metrics"
 )
 
 const (
@@ -94,3 +100,78 @@ func BenchmarkLogLineReaderWithBackBuffEqual10000(b *testing.B) {
 func BenchmarkLogLineReaderWithDefaultBackBuff(b *testing.B) {
 	doBasicLogLineReaderBenchmark(b, DefaultBackBuff)
 }
+
+func TestFilteredReader(t *testing.T) {
+	config := newTestConfig()
+	config.Filters = []*regexp.Regexp{regexp.MustCompile(`^Test`)}
+	s := NewShuttle(config)
+	rdr := NewLogLineReader(NewTestInput(), s)
+	rdr.ReadLines()
+	close(s.Batches)
+
+	var lines int
+	for b := range s.Batches {
+		lines += b.MsgCount()
+	}
+	if lines != 1 {
+		t.Errorf("expected 1 line to be batched, got %d", lines)
+	}
+	if filtered := metrics.GetOrRegisterCounter("lines.filtered", s.MetricsRegistry).Count(); filtered != 1 {
+		t.Errorf("expected 1 line to be filtered, got %d", filtered)
+	}
+}
+
+func TestReaderMaxBatchBytes(t *testing.T) {
+	config := newTestConfig()
+	config.BackBuff = 10
+	line := bytes.Repeat([]byte("a"), 999)
+	line = append(line, '\n')
+	size := config.formattedLength(LogLine{line: line})
+	config.MaxBatchBytes = 3*size + size/2 // room for 3 lines and a half
+	s := NewShuttle(config)
+
+	rdr := NewLogLineReader(ioutil.NopCloser(bytes.NewReader(bytes.Repeat(line, 7))), s)
+	rdr.ReadLines()
+	close(s.Batches)
+
+	var counts []int
+	for b := range s.Batches {
+		counts = append(counts, b.MsgCount())
+		if b.Bytes() > config.MaxBatchBytes {
+			t.Errorf("batch of %d bytes is over the max of %d", b.Bytes(), config.MaxBatchBytes)
+		}
+		f := NewLogplexBatchFormatter(b, nil, &config)
+		if body, _ := ioutil.ReadAll(f); len(body) != b.Bytes() {
+			t.Errorf("expected the formatted batch to be %d bytes, got %d", b.Bytes(), len(body))
+		}
+	}
+	if fmt.Sprint(counts) != "[3 3 1]" {
+		t.Errorf("expected batches to be flushed before overflowing, got %v", counts)
+	}
+
+	h := metrics.GetOrRegisterHistogram("batch.bytes", s.MetricsRegistry, nil)
+	if h.Count() != 3 || h.Max() != int64(3*size) || h.Min() != int64(size) {
+		t.Errorf("unexpected batch.bytes histogram, count=%d min=%d max=%d", h.Count(), h.Min(), h.Max())
+	}
+}
+
+func TestBatchMaxBytes(t *testing.T) {
+	b := NewBatchWithMaxBytes(10, 10)
+	if !b.fits(100) {
+		t.Error("expected a long line to fit an empty batch")
+	}
+	if full := b.add(LogLine{line: []byte("a")}, 6); full {
+		t.Error("unexpected full batch")
+	}
+	if b.fits(5) || !b.fits(4) {
+		t.Error("expected lines to fit up to the max bytes")
+	}
+	if full := b.add(LogLine{line: []byte("b")}, 4); !full || b.Bytes() != 10 {
+		t.Errorf("expected a full batch of 10 bytes, got %d", b.Bytes())
+	}
+
+	b = NewBatch(10)
+	if !b.fits(1 << 30) {
+		t.Error("expected batches without max bytes to fit anything")
+	}
+}
@@ -1,14 +1,125 @@
 package shuttle
 
-import "time"
+import (
+	"strconv"
+	"time"
+)
+
+// Severity of a LogLine, as in RFC5424 but offset by one so that the zero
+// value, SeverityDefault, keeps the severity of Config.Prival.
+type Severity int
+
+// Severities of log lines, see LineMetadata.
+const (
+	SeverityDefault Severity = iota
+	SeverityEmergency
+	SeverityAlert
+	SeverityCritical
+	SeverityError
+	SeverityWarning
+	SeverityNotice
+	SeverityInfo
+	SeverityDebug
+)
+
+// LineMetadata is optional information about a LogLine. The zero value of each
+// field keeps the shuttle's default. AppName, Procid & Severity are used when
+// raw lines are framed as RFC5424 (Config.Appname, Config.Procid &
+// Config.Prival), lines read in an RFC5424 input format carry their own.
+type LineMetadata struct {
+	Time     time.Time // When the line was logged, instead of when it was received
+	AppName  string
+	Procid   string
+	Severity Severity
+}
 
 // LogLine holds the new line terminated log messages and when shuttle received them.
 type LogLine struct {
-	line []byte
-	when time.Time
+	line     []byte
+	when     time.Time
+	appName  string   // overrides Config.Appname when set
+	procid   string   // overrides Config.Procid when set
+	severity Severity // overrides the severity of Config.Prival when set
+}
+
+// NewLogLine returns a LogLine of a copy of line, received now. A new line is
+// appended to the copy if line doesn't end with one.
+func NewLogLine(line []byte) LogLine {
+	return NewLogLineWithMetadata(line, LineMetadata{})
+}
+
+// NewLogLineWithMetadata is like NewLogLine, with the metadata of md.
+func NewLogLineWithMetadata(line []byte, md LineMetadata) LogLine {
+	l := make([]byte, len(line), len(line)+1)
+	copy(l, line)
+	if len(l) == 0 || l[len(l)-1] != '\n' {
+		l = append(l, '\n')
+	}
+
+	when := md.Time
+	if when.IsZero() {
+		when = time.Now()
+	}
+	return LogLine{line: l, when: when, appName: md.AppName, procid: md.Procid, severity: md.Severity}
 }
 
 // Length returns the length of the raw byte of the LogLine
 func (ll LogLine) Length() int {
 	return len(ll.line)
 }
+
+// Bytes returns the raw bytes of the LogLine, including the new line. They
+// must not be modified.
+func (ll LogLine) Bytes() []byte {
+	return ll.line
+}
+
+// Time returns when the line was received, or logged if that was given.
+func (ll LogLine) Time() time.Time {
+	return ll.when
+}
+
+// Metadata of the LogLine.
+func (ll LogLine) Metadata() LineMetadata {
+	return LineMetadata{Time: ll.when, AppName: ll.appName, Procid: ll.procid, Severity: ll.severity}
+}
+
+// appNameOr returns the line's app-name, or def if it has none
+func (ll LogLine) appNameOr(def string) string {
+	if ll.appName != "" {
+		return ll.appName
+	}
+	return def
+}
+
+// procidOr returns the line's procid, or def if it has none
+func (ll LogLine) procidOr(def string) string {
+	if ll.procid != "" {
+		return ll.procid
+	}
+	return def
+}
+
+// privalOr returns the line's PRI, combining its severity with the facility of
+// def. def is returned when the line has no severity or def isn't a number.
+func (ll LogLine) privalOr(def string) string {
+	if ll.severity == SeverityDefault {
+		return def
+	}
+	pri, err := strconv.Atoi(def)
+	if err != nil {
+		return def
+	}
+	return strconv.Itoa(pri&^7 | int(ll.severity-1))
+}
+
+// headerSizeDelta returns how much longer the line's RFC5424 frame header is
+// than config's, because of its metadata
+func (ll LogLine) headerSizeDelta(config *Config) int {
+	if ll.appName == "" && ll.procid == "" && ll.severity == SeverityDefault {
+		return 0
+	}
+	return len(ll.appNameOr(config.Appname)) - len(config.Appname) +
+		len(ll.procidOr(config.Procid)) - len(config.Procid) +
+		len(ll.privalOr(config.Prival)) - len(config.Prival)
+}
@@ -21,6 +21,7 @@ const (
 type LogplexBatchFormatter struct {
 	headers   http.Header
 	stringURL string
+	auth      AuthProvider
 	msgCount  int
 	io.Reader
 }
@@ -30,15 +31,12 @@ func NewLogplexBatchFormatter(b Batch, eData []errData, config *Config) HTTPForm
 	bf := &LogplexBatchFormatter{
 		headers:   make(http.Header),
 		stringURL: config.LogsURL,
+		auth:      config.AuthProvider(),
 	}
 
 	bf.headers.Add("Content-Type", LogplexContentType)
 	bf.headers.Add("X-Request-Id", b.UUID)
 
-	if config.BearerAuthToken != "" {
-		bf.headers.Add("Authorization", fmt.Sprintf("Bearer %s", config.BearerAuthToken))
-	}
-
 	var r SubFormatter
 	readers := make([]io.Reader, 0, b.MsgCount()+len(eData))
 
@@ -77,26 +75,24 @@ func NewLogplexBatchFormatter(b Batch, eData []errData, config *Config) HTTPForm
 }
 
 // Request returns a properly constructed *http.Request, complete with headers
-// and ContentLength set.
+// and ContentLength set, authenticated by the config's AuthProvider.
 func (bf *LogplexBatchFormatter) Request() (*http.Request, error) {
-	u, user, pass, err := extractCredentials(bf.stringURL)
+	u, _, _, err := extractCredentials(bf.stringURL)
 	if err != nil {
 		return nil, err
 	}
 
-	authHeadersPresent := bf.headers.Get("Authorization") != ""
-
 	req, err := http.NewRequest("POST", u.String(), bf)
 	if err != nil {
 		return nil, err
 	}
 
-	// Assign headers before we potentially BasicAuth
+	// Assign headers before we authenticate
 	req.Header = bf.headers
 
-	if !authHeadersPresent {
-		if user != "" || pass != "" {
-			req.SetBasicAuth(user, pass)
+	if bf.auth != nil {
+		if err := bf.auth.Authenticate(req); err != nil {
+			return nil, err
 		}
 	}
 
@@ -108,6 +104,31 @@ func (bf *LogplexBatchFormatter) MsgCount() int {
 	return bf.msgCount
 }
 
+// formattedLength returns the length of ll once formatted by
+// LogplexLineFormatters, split to MaxLineLength if it's raw.
+func (c *Config) formattedLength(ll LogLine) int {
+	line := ll.line
+	switch c.InputFormat {
+	case InputFormatRaw:
+		var n int
+		for l := len(line); l > 0 || n == 0; l -= c.MaxLineLength {
+			p := l
+			if c.MaxLineLength > 0 && p > c.MaxLineLength {
+				p = c.MaxLineLength
+			}
+			p += c.lengthPrefixedSyslogFrameHeaderSize + ll.headerSizeDelta(c)
+			n += len(strconv.Itoa(p)) + 1 + p
+			if c.MaxLineLength <= 0 {
+				break
+			}
+		}
+		return n
+	case InputFormatRFC5424:
+		return len(strconv.Itoa(len(line))) + 1 + len(line)
+	}
+	return len(line)
+}
+
 // Splits the line into a batch of loglines of max(mll) lengths
 func splitLine(ll LogLine, mll int) Batch {
 	l := ll.Length()
@@ -117,7 +138,9 @@ func splitLine(ll LogLine, mll int) Batch {
 		if t > l {
 			t = l
 		}
-		batch.Add(LogLine{line: ll.line[i:t], when: ll.when})
+		sl := ll // keeping the metadata
+		sl.line = ll.line[i:t]
+		batch.Add(sl)
 	}
 	return batch
 }
@@ -137,12 +160,12 @@ func NewLogplexLineFormatter(ll LogLine, config *Config) *LogplexLineFormatter {
 	switch config.InputFormat {
 	case InputFormatRaw:
 		//fmt.Sprintf induces an extra allocation
-		header = strconv.Itoa(len(ll.line)+config.lengthPrefixedSyslogFrameHeaderSize) + " " +
-			"<" + config.Prival + ">" + config.Version + " " +
+		header = strconv.Itoa(len(ll.line)+config.lengthPrefixedSyslogFrameHeaderSize+ll.headerSizeDelta(config)) + " " +
+			"<" + ll.privalOr(config.Prival) + ">" + config.Version + " " +
 			ll.when.UTC().Format(LogplexBatchTimeFormat) + " " +
 			config.Hostname + " " +
-			config.Appname + " " +
-			config.Procid + " " +
+			ll.appNameOr(config.Appname) + " " +
+			ll.procidOr(config.Procid) + " " +
 			config.Msgid + " "
 	case InputFormatLengthPrefixedRFC5424:
 		//NOOP, the message should already be in the right format. *\o/*
@@ -231,6 +254,9 @@ func NewLogplexErrorFormatter(err errData, config *Config) *LogplexLineFormatter
 	case errLost:
 		what = "lost"
 		code = "L13"
+	case errRateLimited:
+		what = "rate limited"
+		code = "L16"
 	}
 
 	msg := fmt.Sprintf("<172>%s %s heroku %s log-shuttle %s Error %s: %d messages %s since %s\n",
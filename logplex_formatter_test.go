@@ -244,3 +244,28 @@ func BenchmarkLogplexBatchFormatter_WithHeaders(b *testing.B) {
 		}
 	}
 }
+
+func TestConfigFormattedLength(t *testing.T) {
+	for _, tc := range []struct {
+		inputFormat   int
+		maxLineLength int
+		line          string
+	}{
+		{InputFormatRaw, 10000, "Hello World\n"},
+		{InputFormatRaw, 10000, ""},
+		{InputFormatRaw, 5, "Hello World\n"},
+		{InputFormatRaw, 6, "Hello World\n"},
+		{InputFormatRFC5424, 10000, "<13>1 2013-09-25T01:16:49.371356+00:00 host token web.1 - - message 1\n"},
+		{InputFormatLengthPrefixedRFC5424, 10000, "9 <13>1 - -"},
+	} {
+		config := newTestConfig()
+		config.InputFormat = tc.inputFormat
+		config.MaxLineLength = tc.maxLineLength
+		b := NewBatch(1)
+		b.Add(LogLine{line: []byte(tc.line), when: time.Now()})
+		body, _ := ioutil.ReadAll(NewLogplexBatchFormatter(b, nil, &config))
+		if n := config.formattedLength(LogLine{line: []byte(tc.line)}); n != len(body) {
+			t.Errorf("%d %q: expected %d bytes, got %d", tc.inputFormat, tc.line, len(body), n)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package shuttle
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heroku/slog"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	// StatsdMaxPacketSize is the most bytes of metrics sent per UDP packet,
+	// so they aren't fragmented on common networks.
+	StatsdMaxPacketSize = 1432
+	// GraphiteTimeout bounds connecting & writing to Graphite.
+	GraphiteTimeout = 5 * time.Second
+)
+
+// NewStatsdReporter returns a MetricsReporter pushing the metrics of r to the
+// statsd server at config.StatsdAddr over UDP instead of logging them. Counts
+// are sent as counters of their change since the last emission, everything
+// else as gauges, timers in seconds. With config.DogStatsD the metrics are
+// tagged with config.StatsdTags and source:<config.StatsSource>. Failed sends
+// are logged to l.
+func NewStatsdReporter(r metrics.Registry, config Config, l *log.Logger) (*MetricsReporter, error) {
+	conn, err := net.Dial("udp", config.StatsdAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags string
+	if config.DogStatsD {
+		t := append([]string(nil), config.StatsdTags...)
+		if config.StatsSource != "" {
+			t = append(t, "source:"+config.StatsSource)
+		}
+		if len(t) > 0 {
+			tags = "|#" + strings.Join(t, ",")
+		}
+	}
+
+	e := NewMetricsReporter(r, config.StatsSource, l)
+	e.write = func(ctx slog.Context) {
+		var packet bytes.Buffer
+		send := func() {
+			if packet.Len() == 0 {
+				return
+			}
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				e.events().Warn("statsd", "addr", config.StatsdAddr, "error", err)
+			}
+			packet.Reset()
+		}
+		for _, m := range pushedMetrics(ctx) {
+			typ := "|g"
+			if m.count {
+				typ = "|c"
+			}
+			line := config.StatsPrefix + m.name + ":" + m.value + typ + tags
+			if !m.count && strings.HasPrefix(m.value, "-") {
+				// statsd takes signed gauges as changes, so zero them first
+				line = config.StatsPrefix + m.name + ":0|g" + tags + "\n" + line
+			}
+			if packet.Len() > 0 && packet.Len()+1+len(line) > StatsdMaxPacketSize {
+				send()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+		send()
+	}
+	return e, nil
+}
+
+// NewGraphiteReporter returns a MetricsReporter pushing the metrics of r to
+// the Graphite server at config.GraphiteAddr with the plaintext protocol over
+// TCP instead of logging them, one connection per emission. Counts are sent
+// as their change since the last emission, timers in seconds. Metrics are
+// tagged with source=<config.StatsSource> when it's set. Failed pushes are
+// logged to l.
+func NewGraphiteReporter(r metrics.Registry, config Config, l *log.Logger) *MetricsReporter {
+	var tags string
+	if config.StatsSource != "" {
+		tags = ";source=" + graphiteTagValue(config.StatsSource)
+	}
+
+	e := NewMetricsReporter(r, config.StatsSource, l)
+	e.write = func(ctx slog.Context) {
+		now := " " + strconv.FormatInt(time.Now().Unix(), 10) + "\n"
+		var body bytes.Buffer
+		for _, m := range pushedMetrics(ctx) {
+			body.WriteString(config.StatsPrefix + m.name + tags + " " + m.value + now)
+		}
+		if body.Len() == 0 {
+			return
+		}
+		if err := pushGraphite(config.GraphiteAddr, body.Bytes()); err != nil {
+			e.events().Warn("graphite", "addr", config.GraphiteAddr, "error", err)
+		}
+	}
+	return e
+}
+
+func pushGraphite(addr string, body []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, GraphiteTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(GraphiteTimeout))
+	_, err = conn.Write(body)
+	return err
+}
+
+// ValidateMetricsBackends returns an error if config's statsd or Graphite
+// address isn't a host:port, or either is set without a StatsInterval.
+func ValidateMetricsBackends(config Config) error {
+	for _, b := range []struct {
+		name, addr string
+	}{
+		{"statsd", config.StatsdAddr},
+		{"graphite", config.GraphiteAddr},
+	} {
+		if b.addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(b.addr); err != nil {
+			return fmt.Errorf("%s address: %s", b.name, err)
+		}
+		if config.StatsInterval <= 0 {
+			return fmt.Errorf("%s needs a stats interval", b.name)
+		}
+	}
+	return nil
+}
+
+// events returns the EventLogger of the reporter's logger
+func (e *MetricsReporter) events() EventLogger {
+	return EventLogger{Logger: e.logger, ErrLogger: e.logger, Format: e.LogFormat}
+}
+
+// pushedMetric is a value of an emission as sent by the push backends
+type pushedMetric struct {
+	name, value string
+	count       bool // Whether value is a countDelta
+}
+
+// pushedMetrics returns the numeric values of ctx sorted by name, with names
+// made safe for statsd & Graphite. Health check errors & non finite floats
+// aren't numbers they take and are left out.
+func pushedMetrics(ctx slog.Context) []pushedMetric {
+	ms := make([]pushedMetric, 0, len(ctx))
+	for name, v := range ctx {
+		m := pushedMetric{name: metricPathName(name)}
+		switch v := v.(type) {
+		case countDelta:
+			m.value, m.count = strconv.FormatInt(int64(v), 10), true
+		case int64:
+			m.value = strconv.FormatInt(v, 10)
+		case float64:
+			m.value = formatPushedFloat(v)
+		case seconds:
+			m.value = formatPushedFloat(float64(v) / float64(time.Second))
+		case perSecond:
+			m.value = formatPushedFloat(float64(v))
+		}
+		if m.value == "" {
+			continue
+		}
+		ms = append(ms, m)
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].name < ms[j].name })
+	return ms
+}
+
+// formatPushedFloat returns f as a decimal, or "" if it isn't finite
+func formatPushedFloat(f float64) string {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return ""
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// metricPathName replaces the characters of name that statsd & Graphite
+// treat specially, like those of route names, with underscores
+func metricPathName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// graphiteTagValue replaces the characters Graphite doesn't allow in tag
+// values with underscores
+func graphiteTagValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ';' || r == '~' || r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, v)
+}
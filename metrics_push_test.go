@@ -0,0 +1,160 @@
+package shuttle
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func testRegistry() metrics.Registry {
+	r := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("route.a b.msg.delivered", r).Inc(3)
+	metrics.GetOrRegisterGauge("outlet.inbox.length", r).Update(-2)
+	metrics.GetOrRegisterTimer("outlet.post.success", r).Update(time.Millisecond)
+	return r
+}
+
+func TestMetricsReporterLogging(t *testing.T) {
+	var out bytes.Buffer
+	e := NewMetricsReporter(testRegistry(), "src", log.New(&out, "", 0))
+	e.emit()
+	for _, expected := range []string{"log_shuttle_stats_source=src", "route.a b.msg.delivered.count=3", "outlet.post.success.max=0.001000", "outlet.post.success.rate.mean="} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q to be logged, got %q", expected, out.String())
+		}
+	}
+
+	out.Reset()
+	e.LogFormat = LogFormatJSON
+	e.emit()
+	if expected := `"route.a b.msg.delivered.count":0`; !strings.Contains(out.String(), expected) {
+		t.Errorf("expected %q to be logged, got %q", expected, out.String())
+	}
+}
+
+func TestMetricsReporterStopBeforeStart(t *testing.T) {
+	var out bytes.Buffer
+	e := NewMetricsReporter(testRegistry(), "src", log.New(&out, "", 0))
+	// Stopping at once must still wait for the final emission
+	e.Start(time.Hour)
+	e.Stop()
+	if expected := "route.a b.msg.delivered.count=3"; !strings.Contains(out.String(), expected) {
+		t.Errorf("expected the final emission to contain %q, got %q", expected, out.String())
+	}
+}
+
+func TestMetricsReporterStartWithoutInterval(t *testing.T) {
+	var out bytes.Buffer
+	e := NewMetricsReporter(testRegistry(), "src", log.New(&out, "", 0))
+	e.Start(0)
+	time.Sleep(10 * time.Millisecond)
+	if out.Len() != 0 {
+		t.Errorf("expected nothing to be emitted before stopping, got %q", out.String())
+	}
+	e.Stop()
+	if expected := "route.a b.msg.delivered.count=3"; !strings.Contains(out.String(), expected) {
+		t.Errorf("expected a final emission containing %q, got %q", expected, out.String())
+	}
+}
+
+func TestStatsdReporter(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	config := newTestConfig()
+	config.StatsdAddr = pc.LocalAddr().String()
+	config.StatsSource = "src"
+	config.StatsPrefix = "shuttle."
+	config.DogStatsD = true
+	config.StatsdTags = []string{"env:test"}
+	e, err := NewStatsdReporter(testRegistry(), config, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := func() string {
+		buf := make([]byte, StatsdMaxPacketSize)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	e.emit()
+	packet := read()
+	for _, expected := range []string{
+		"shuttle.route.a_b.msg.delivered.count:3|c|#env:test,source:src",
+		"shuttle.outlet.inbox.length:0|g|#env:test,source:src\nshuttle.outlet.inbox.length:-2|g|#env:test,source:src\n",
+		"shuttle.outlet.post.success.max:0.001|g|#env:test,source:src\n",
+	} {
+		if !strings.Contains(packet, expected) {
+			t.Errorf("expected the packet to contain %q, got %q", expected, packet)
+		}
+	}
+
+	e.emit()
+	if packet := read(); !strings.Contains(packet, "shuttle.route.a_b.msg.delivered.count:0|c|") {
+		t.Errorf("expected the count to be sent as a delta, got %q", packet)
+	}
+}
+
+func TestGraphiteReporter(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	bodies := make(chan string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		b, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		bodies <- string(b)
+	}()
+
+	config := newTestConfig()
+	config.GraphiteAddr = l.Addr().String()
+	config.StatsSource = "my src"
+	NewGraphiteReporter(testRegistry(), config, log.New(ioutil.Discard, "", 0)).emit()
+
+	body := <-bodies
+	for _, expected := range []string{
+		"route.a_b.msg.delivered.count;source=my_src 3 ",
+		"outlet.inbox.length;source=my_src -2 ",
+		"outlet.post.success.p99;source=my_src 0.001 ",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected the body to contain %q, got %q", expected, body)
+		}
+	}
+}
+
+func TestValidateMetricsBackends(t *testing.T) {
+	config := newTestConfig()
+	config.StatsdAddr = "localhost:8125"
+	if err := ValidateMetricsBackends(config); err == nil {
+		t.Error("expected an error without a stats interval")
+	}
+	config.StatsInterval = time.Second
+	if err := ValidateMetricsBackends(config); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	config.GraphiteAddr = "localhost"
+	if err := ValidateMetricsBackends(config); err == nil {
+		t.Error("expected an error for an address without a port")
+	}
+}
@@ -1,9 +1,11 @@
 package shuttle
 
 import (
+	"encoding/json"
 	"fmt"
-	"time"
 	"log"
+	"sync/atomic"
+	"time"
 
 	"github.com/heroku/slog"
 	metrics "github.com/rcrowley/go-metrics"
@@ -21,31 +23,64 @@ func sec(t float64) string {
 	return fmt.Sprintf("%.6f", t/1000000000)
 }
 
+// The values of an emission that need telling apart by the push backends.
+// They're logged like the plain values they used to be.
+type (
+	countDelta int64   // The change of a count since the last emission
+	seconds    float64 // A time in ns, logged in seconds, see sec
+	perSecond  float64 // A rate, logged with 3 decimals
+)
+
+func (s seconds) String() string {
+	return sec(float64(s))
+}
+
+func (s seconds) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (r perSecond) String() string {
+	return fmt.Sprintf("%.3f", float64(r))
+}
+
+func (r perSecond) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
 // MetricsReporter handles reporting of metrics to a specified source at a given duration
 type MetricsReporter struct {
-	registry metrics.Registry
-	source   string
-	logger   *log.Logger
+	registry   metrics.Registry
+	source     string
+	logger     *log.Logger
 	lastCounts map[string]int64
-	doneCh chan struct{}
+	doneCh     chan struct{}
+	stoppedCh  chan struct{}          // closed when Emit returns
+	running    int32                  // set by Start & when Emit is emitting, accessed atomically
+	write      func(ctx slog.Context) // outputs an emission, see NewStatsdReporter & NewGraphiteReporter
+
+	// LogFormat of the emitted lines, LogFormatLogfmt or LogFormatJSON. Set
+	// it before calling Emit.
+	LogFormat int
 }
 
 // NewMetricsReporter returns a properly constructed MetricsReporter
 func NewMetricsReporter(r metrics.Registry, source string, l *log.Logger) *MetricsReporter {
-	return &MetricsReporter{registry: r, source: source, logger: l, lastCounts: make(map[string]int64), doneCh: make(chan struct{})}
+	e := &MetricsReporter{registry: r, source: source, logger: l, lastCounts: make(map[string]int64), doneCh: make(chan struct{}), stoppedCh: make(chan struct{})}
+	e.write = e.log
+	return e
 }
 
-func (e MetricsReporter) countDifference(ctx slog.Context, name string, c int64) {
+func (e *MetricsReporter) countDifference(ctx slog.Context, name string, c int64) {
 	name = name + ".count"
 	lc := e.lastCounts[name]
-	ctx[name] = c - lc
+	ctx[name] = countDelta(c - lc)
 	e.lastCounts[name] = c
 }
 
 // Emit emits log-shuttle metrics in logfmt compatible formats every d
 // duration using the MetricsReporter logger. source is added to the line as
-// log_shuttle_stats_source if not empty. It waits for a stop signal
-// and will stop emitting metrics when received. Example output:
+// log_shuttle_stats_source if not empty. It waits for a stop signal and
+// will emit metrics a final time and stop emitting when received. Example output:
 // space=<space-id> instance=<instance-id> runc-shuttle2019/06/10 12:48:25 batch.fill.count=0
 // batch.fill.max=0.000000 batch.fill.mean=0.000000 batch.fill.min=0.000000
 // batch.fill.p75=0.000000 batch.fill.p95=0.000000 batch.fill.p99=0.000000 batch.fill.rate.15min=0.000
@@ -60,34 +95,63 @@ func (e MetricsReporter) countDifference(ctx slog.Context, name string, c int64)
 // outlet.post.success.p75=0.000000 outlet.post.success.p95=0.000000 outlet.post.success.p99=0.000000
 // outlet.post.success.rate.15min=0.000 outlet.post.success.rate.1min=0.000 outlet.post.success.rate.5min=0.000
 // outlet.post.success.rate.mean=0.000 outlet.post.success.stddev=0.000000
-func (e MetricsReporter) Emit(d time.Duration) {
+func (e *MetricsReporter) Emit(d time.Duration) {
 	if d == 0 {
+		close(e.stoppedCh)
 		return
 	}
+	atomic.StoreInt32(&e.running, 1)
 	ticker := time.NewTicker(d)
 	defer ticker.Stop()
+	e.emitUntilStopped(ticker.C)
+}
+
+// Start runs Emit(d) in a goroutine. Unlike with `go e.Emit(d)`, a Stop
+// made before the goroutine is scheduled still waits for the final emission,
+// and a d of 0 still emits once when stopped.
+func (e *MetricsReporter) Start(d time.Duration) {
+	atomic.StoreInt32(&e.running, 1)
+	if d == 0 {
+		go e.emitUntilStopped(nil) // A nil channel never ticks
+		return
+	}
+	go e.Emit(d)
+}
 
+// emitUntilStopped emits on every tick, and a final time once stopped
+func (e *MetricsReporter) emitUntilStopped(tick <-chan time.Time) {
+	defer close(e.stoppedCh)
 	for {
 		select {
-			case <- ticker.C:
-				e.emit()
-			case <- e.doneCh:
-				e.logger.Printf("log_shuttle_stats_source=%s at=Emit msg=closed", e.source)
-				return
+		case <-tick:
+			e.emit()
+		case <-e.doneCh:
+			// Emit what happened since the last tick, so nothing is missed on shutdown
+			e.emit()
+			EventLogger{Logger: e.logger, Format: e.LogFormat}.Info("Emit", "log_shuttle_stats_source", e.source, "msg", "closed")
+			return
 		}
 	}
 }
 
-// Stop stops a MetricsEmitter from emitting log to its logger
-func (e MetricsReporter) Stop() {
+// Stop stops a MetricsEmitter from emitting log to its logger. If Emit is
+// emitting, or the reporter was started with Start, Stop waits for its final
+// emission.
+func (e *MetricsReporter) Stop() {
 	close(e.doneCh)
+	if atomic.LoadInt32(&e.running) == 1 {
+		<-e.stoppedCh
+	}
+}
+
+func (e *MetricsReporter) emit() {
+	e.write(e.snapshot())
 }
 
-func (e MetricsReporter) emit() {
+// snapshot returns the values of the registry's metrics, and the change of
+// its counts since the last snapshot
+func (e *MetricsReporter) snapshot() slog.Context {
 	ctx := slog.Context{}
-	if e.source != "" {
-		ctx["log_shuttle_stats_source"] = e.source
-	}
 	e.registry.Each(func(name string, i interface{}) {
 		switch metric := i.(type) {
 		case metrics.Counter:
@@ -121,18 +185,38 @@ func (e MetricsReporter) emit() {
 			s := metric.Snapshot()
 			ps := s.Percentiles(percentiles)
 			e.countDifference(ctx, name, s.Count())
-			ctx[name+".min"] = sec(float64(s.Min()))
-			ctx[name+".max"] = sec(float64(s.Max()))
-			ctx[name+".mean"] = sec(s.Mean())
-			ctx[name+".stddev"] = sec(s.StdDev())
+			ctx[name+".min"] = seconds(s.Min())
+			ctx[name+".max"] = seconds(s.Max())
+			ctx[name+".mean"] = seconds(s.Mean())
+			ctx[name+".stddev"] = seconds(s.StdDev())
 			for i, pn := range percentileNames {
-				ctx[name+"."+pn] = sec(ps[i])
+				ctx[name+"."+pn] = seconds(ps[i])
 			}
-			ctx[name+".rate.1min"] = fmt.Sprintf("%.3f", s.Rate1())
-			ctx[name+".rate.5min"] = fmt.Sprintf("%.3f", s.Rate5())
-			ctx[name+".rate.15min"] = fmt.Sprintf("%.3f", s.Rate15())
-			ctx[name+".rate.mean"] = fmt.Sprintf("%.3f", s.RateMean())
+			ctx[name+".rate.1min"] = perSecond(s.Rate1())
+			ctx[name+".rate.5min"] = perSecond(s.Rate5())
+			ctx[name+".rate.15min"] = perSecond(s.Rate15())
+			ctx[name+".rate.mean"] = perSecond(s.RateMean())
 		}
 	})
+	return ctx
+}
+
+// log ctx as a line of LogFormat, with the source
+func (e *MetricsReporter) log(ctx slog.Context) {
+	if e.source != "" {
+		ctx["log_shuttle_stats_source"] = e.source
+	}
+	if e.LogFormat == LogFormatJSON {
+		for name, v := range ctx {
+			if err, ok := v.(error); ok {
+				ctx[name] = err.Error()
+			}
+		}
+		// Sorts the keys like slog.Context, non finite floats fall back to logfmt
+		if b, err := json.Marshal(ctx); err == nil {
+			e.logger.Println(string(b))
+			return
+		}
+	}
 	e.logger.Println(ctx)
 }
@@ -0,0 +1,79 @@
+package shuttle
+
+// Observer is notified of what happens to batches, see Config.Observer. The
+// callbacks are made from the shuttle's readers and outlets, concurrently, so
+// they must be safe for concurrent use and return quickly. An outlet may start
+// attempting to deliver a batch before BatchEnqueued returns. Embed
+// NopObserver to only implement some of them.
+type Observer interface {
+	// BatchEnqueued is called when a batch is handed to its outlets.
+	BatchEnqueued(BatchEvent)
+	// BatchDropped is called when a batch is dropped because its outlets
+	// fell behind, see Config.Drop.
+	BatchDropped(BatchEvent)
+	// AttemptStarted is called before every attempt to deliver a batch.
+	AttemptStarted(BatchEvent)
+	// AttemptFailed is called when an attempt fails, with its error and the
+	// response's status if there was one. The batch is retried or lost next.
+	AttemptFailed(BatchEvent)
+	// BatchDelivered is called once a batch is delivered. For partially
+	// delivered batches, MsgCount is the number of delivered messages.
+	BatchDelivered(BatchEvent)
+	// BatchLost is called when a batch isn't retried any more, with the error
+	// of its last attempt. For partially delivered batches, MsgCount is the
+	// number of lost messages. It's also called for batches rejected by their
+	// destination with a 4xx or 5xx status, which aren't retried, and for the
+	// batch an outlet gives up on when Shutdown stops waiting. Batches still
+	// queued then get no callback.
+	BatchLost(BatchEvent)
+}
+
+// BatchEvent describes a batch for an Observer.
+type BatchEvent struct {
+	UUID        string // Batch.UUID, also the X-Request-Id of posts
+	Destination string // The name of the batch's route, "" for Config.LogsURL
+	MsgCount    int    // The number of log lines in the batch
+	Bytes       int    // The formatted length of the batch's lines, see Batch.Bytes
+	Attempt     int    // The delivery attempt, starting at 1, 0 before the first
+	Status      int    // The HTTP status of the attempt's response, 0 if there wasn't one
+	Err         error  // Why the attempt failed or the batch was lost
+}
+
+// NopObserver implements Observer with callbacks that do nothing.
+type NopObserver struct{}
+
+// BatchEnqueued does nothing.
+func (NopObserver) BatchEnqueued(BatchEvent) {}
+
+// BatchDropped does nothing.
+func (NopObserver) BatchDropped(BatchEvent) {}
+
+// AttemptStarted does nothing.
+func (NopObserver) AttemptStarted(BatchEvent) {}
+
+// AttemptFailed does nothing.
+func (NopObserver) AttemptFailed(BatchEvent) {}
+
+// BatchDelivered does nothing.
+func (NopObserver) BatchDelivered(BatchEvent) {}
+
+// BatchLost does nothing.
+func (NopObserver) BatchLost(BatchEvent) {}
+
+// observer returns c.Observer, or a NopObserver if it's nil.
+func (c *Config) observer() Observer {
+	if c.Observer == nil {
+		return NopObserver{}
+	}
+	return c.Observer
+}
+
+// newBatchEvent returns the BatchEvent of b, delivered via route r, or the
+// default destination if r is nil
+func newBatchEvent(b Batch, r *Route) BatchEvent {
+	e := BatchEvent{UUID: b.UUID, MsgCount: b.MsgCount(), Bytes: b.Bytes()}
+	if r != nil {
+		e.Destination = r.Name
+	}
+	return e
+}
@@ -0,0 +1,172 @@
+package shuttle
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testObserver records the callbacks it gets, by name
+type testObserver struct {
+	sync.Mutex
+	events []string
+	last   map[string]BatchEvent
+}
+
+func (o *testObserver) record(name string, e BatchEvent) {
+	o.Lock()
+	defer o.Unlock()
+	if o.last == nil {
+		o.last = make(map[string]BatchEvent)
+	}
+	o.events = append(o.events, name)
+	o.last[name] = e
+}
+
+func (o *testObserver) BatchEnqueued(e BatchEvent)  { o.record("enqueued", e) }
+func (o *testObserver) BatchDropped(e BatchEvent)   { o.record("dropped", e) }
+func (o *testObserver) AttemptStarted(e BatchEvent) { o.record("started", e) }
+func (o *testObserver) AttemptFailed(e BatchEvent)  { o.record("failed", e) }
+func (o *testObserver) BatchDelivered(e BatchEvent) { o.record("delivered", e) }
+func (o *testObserver) BatchLost(e BatchEvent)      { o.record("lost", e) }
+
+func (o *testObserver) expect(t *testing.T, events ...string) {
+	t.Helper()
+	o.Lock()
+	defer o.Unlock()
+	if len(o.events) != len(events) {
+		t.Fatalf("expected events %v, got %v", events, o.events)
+	}
+	for i := range events {
+		if o.events[i] != events[i] {
+			t.Fatalf("expected events %v, got %v", events, o.events)
+		}
+	}
+}
+
+func TestObserverDelivered(t *testing.T) {
+	th := new(testHelper)
+	ts := httptest.NewServer(th)
+	defer ts.Close()
+
+	o := new(testObserver)
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.Routes = []RouteConfig{{Name: "web", LogsURL: ts.URL, AppNames: []string{"web"}}}
+	config.Observer = o
+	config.BatchSize = 2
+
+	// The full batch is enqueued before the outlets start, so that the events
+	// are in order
+	s := NewShuttle(config)
+	s.Send(context.Background(), NewLogLineWithMetadata([]byte("hello"), LineMetadata{AppName: "web"}))
+	s.Send(context.Background(), NewLogLineWithMetadata([]byte("world"), LineMetadata{AppName: "web"}))
+	s.Launch()
+	s.Land()
+
+	o.expect(t, "enqueued", "started", "delivered")
+	e := o.last["delivered"]
+	if e.UUID == "" || e.UUID != o.last["enqueued"].UUID || e.UUID != th.Headers.Get("X-Request-Id") {
+		t.Errorf("expected the events to have the batch's UUID, got %q", e.UUID)
+	}
+	if e.Destination != "web" || e.MsgCount != 2 || e.Bytes == 0 || e.Attempt != 1 || e.Status != http.StatusOK || e.Err != nil {
+		t.Errorf("unexpected delivered event %+v", e)
+	}
+}
+
+func TestObserverRejected(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	o := new(testObserver)
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.Observer = o
+
+	s := NewShuttle(config)
+	batch := NewBatch(1)
+	batch.Add(NewLogLine([]byte("hello")))
+	NewHTTPOutlet(s).retryPost(batch)
+
+	o.expect(t, "started", "failed", "lost")
+	if e := o.last["lost"]; e.Status != http.StatusBadRequest || e.Err == nil || e.Destination != "" || e.MsgCount != 1 {
+		t.Errorf("unexpected lost event %+v", e)
+	}
+	if sum := s.Summary(); sum.Delivered != 0 || sum.Lost != 1 {
+		t.Errorf("expected the line to be counted as lost, got %+v", sum)
+	}
+}
+
+func TestRejectedBatchReportedLost(t *testing.T) {
+	th := new(rejectFirstHelper)
+	ts := httptest.NewServer(th)
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+
+	outlet := NewHTTPOutlet(NewShuttle(config))
+	for _, l := range []string{"rejected", "delivered"} {
+		batch := NewBatch(1)
+		batch.Add(NewLogLine([]byte(l)))
+		outlet.retryPost(batch)
+	}
+
+	th.Lock()
+	defer th.Unlock()
+	if !strings.Contains(th.bodies, "Error L13: 1 messages lost") {
+		t.Errorf("expected the next batch to report the rejected line as lost, got %q", th.bodies)
+	}
+}
+
+// partialDeliverer delivers all but one message of its batch
+type partialDeliverer struct {
+	HTTPFormatter
+}
+
+func (d partialDeliverer) Deliver(ctx context.Context) error {
+	return &PartialDeliveryError{Failed: 1, Err: errors.New("throttled")}
+}
+
+func TestObserverPartial(t *testing.T) {
+	o := new(testObserver)
+	config := newTestConfig()
+	config.Observer = o
+
+	s := NewShuttle(config)
+	s.NewFormatterFunc = func(b Batch, eData []errData, config *Config) HTTPFormatter {
+		return partialDeliverer{NewLogplexBatchFormatter(b, eData, config)}
+	}
+	batch := NewBatch(3)
+	batch.Add(NewLogLine([]byte("a")))
+	batch.Add(NewLogLine([]byte("b")))
+	batch.Add(NewLogLine([]byte("c")))
+	NewHTTPOutlet(s).retryPost(batch)
+
+	o.expect(t, "started", "failed", "delivered", "lost")
+	if d, l := o.last["delivered"].MsgCount, o.last["lost"].MsgCount; d != 2 || l != 1 {
+		t.Errorf("expected 2 messages delivered & 1 lost, got %d & %d", d, l)
+	}
+}
+
+func TestObserverDropped(t *testing.T) {
+	o := new(testObserver)
+	config := newTestConfig()
+	config.BatchSize = 1
+	config.BackBuff = 0
+	config.Observer = o
+
+	s := NewShuttle(config)
+	s.TrySend(NewLogLine([]byte("hello")))
+
+	o.expect(t, "dropped")
+	if e := o.last["dropped"]; e.MsgCount != 1 || e.Bytes == 0 {
+		t.Errorf("unexpected dropped event %+v", e)
+	}
+}
@@ -0,0 +1,94 @@
+package shuttle
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// The classes of transport errors counted as outlet.post.error.<class>
+const (
+	errorClassTimeout  = "timeout"
+	errorClassEOF      = "eof"
+	errorClassRefused  = "refused"
+	errorClassTLS      = "tls"
+	errorClassCanceled = "canceled"
+	errorClassOther    = "other"
+)
+
+// countStatus counts a response's status as both outlet.post.status.<N>xx and
+// outlet.post.status.<code>
+func (h *HTTPOutlet) countStatus(status int) {
+	class := strconv.Itoa(status/100) + "xx"
+	metrics.GetOrRegisterCounter(h.route.metricName("outlet.post.status."+class), h.registry).Inc(1)
+	metrics.GetOrRegisterCounter(h.route.metricName("outlet.post.status."+strconv.Itoa(status)), h.registry).Inc(1)
+}
+
+// countError counts a request that failed without a response as
+// outlet.post.error.<class>, see errorClass
+func (h *HTTPOutlet) countError(err error) {
+	metrics.GetOrRegisterCounter(h.route.metricName("outlet.post.error."+errorClass(err)), h.registry).Inc(1)
+}
+
+// countDelivery counts the outcome of a Deliverer like that of a post: by the
+// HTTP status of its response, taken from AWS response errors, or by the class
+// of its transport error. Deliveries that succeeded, even partially, were
+// answered with a 200.
+func (h *HTTPOutlet) countDelivery(err error) {
+	var re interface{ HTTPStatusCode() int }
+	var pe *PartialDeliveryError
+	switch {
+	case err == nil, errors.As(err, &pe):
+		h.countStatus(http.StatusOK)
+	case errors.As(err, &re) && re.HTTPStatusCode() > 0:
+		h.countStatus(re.HTTPStatusCode())
+	default:
+		h.countError(err)
+	}
+}
+
+// errorClass returns the class of a transport error: timeout, eof, refused,
+// tls, canceled (the shuttle shut down) or other.
+func errorClass(err error) string {
+	var ne net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return errorClassTimeout
+	case errors.Is(err, context.Canceled):
+		return errorClassCanceled
+	case isEOF(err), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return errorClassEOF
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errorClassRefused
+	case isTLSError(err):
+		return errorClassTLS
+	}
+	return errorClassOther
+}
+
+// isTLSError returns whether err is a certificate verification, pinning or
+// TLS protocol error.
+func isTLSError(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		recordHeader     tls.RecordHeaderError
+	)
+	if errors.Is(err, errNoPinMatch) || errors.As(err, &unknownAuthority) || errors.As(err, &hostname) ||
+		errors.As(err, &invalid) || errors.As(err, &recordHeader) {
+		return true
+	}
+	// Alerts & handshake failures aren't exported types, but are all
+	// prefixed by the tls package.
+	return strings.Contains(err.Error(), "tls: ")
+}
@@ -0,0 +1,162 @@
+package shuttle
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorClass(t *testing.T) {
+	wrap := func(err error) error { return &url.Error{Op: "Post", URL: "https://example.com", Err: err} }
+	for _, tc := range []struct {
+		err      error
+		expected string
+	}{
+		{wrap(timeoutError{}), errorClassTimeout},
+		{wrap(context.DeadlineExceeded), errorClassTimeout},
+		{wrap(context.Canceled), errorClassCanceled},
+		{wrap(io.EOF), errorClassEOF},
+		{wrap(io.ErrUnexpectedEOF), errorClassEOF},
+		{wrap(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), errorClassRefused},
+		{wrap(x509.UnknownAuthorityError{}), errorClassTLS},
+		{wrap(errNoPinMatch), errorClassTLS},
+		{wrap(errors.New("remote error: tls: handshake failure")), errorClassTLS},
+		{wrap(errors.New("no such host")), errorClassOther},
+	} {
+		if c := errorClass(tc.err); c != tc.expected {
+			t.Errorf("expected %q to be classed %q, got %q", tc.err, tc.expected, c)
+		}
+	}
+}
+
+func TestStatusCounters(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	}))
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.NumOutlets = 1
+
+	s := NewShuttle(config)
+	s.Launch()
+	s.TrySend(NewLogLine([]byte("too large")))
+	s.Land()
+
+	for _, name := range []string{"outlet.post.status.4xx", "outlet.post.status.413"} {
+		c, ok := s.MetricsRegistry.Get(name).(metrics.Counter)
+		if !ok || c.Count() != 1 {
+			t.Errorf("expected %s to count the rejected post", name)
+		}
+	}
+}
+
+func TestErrorCounters(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close() // Nothing listens, so connections are refused
+
+	config := newTestConfig()
+	config.LogsURL = "http://" + addr
+	config.NumOutlets = 1
+	config.MaxAttempts = 1
+
+	s := NewShuttle(config)
+	s.Launch()
+	s.TrySend(NewLogLine([]byte("refused")))
+	s.Land()
+
+	if c, ok := s.MetricsRegistry.Get("outlet.post.error.refused").(metrics.Counter); !ok || c.Count() != 1 {
+		t.Error("expected outlet.post.error.refused to count the failed post")
+	}
+	if s.MetricsRegistry.Get("outlet.post.status.2xx") != nil {
+		t.Error("expected no status to be counted without a response")
+	}
+}
+
+// errDeliverer is a formatter whose deliveries fail with err
+type errDeliverer struct {
+	HTTPFormatter
+	err error
+}
+
+func (d errDeliverer) Deliver(ctx context.Context) error {
+	return d.err
+}
+
+func TestDelivererCounters(t *testing.T) {
+	for k, v := range map[string]string{
+		"AWS_ACCESS_KEY_ID":           "AKIDCHAIN",
+		"AWS_SECRET_ACCESS_KEY":       "chain-secret",
+		"AWS_CONFIG_FILE":             os.DevNull,
+		"AWS_SHARED_CREDENTIALS_FILE": os.DevNull,
+	} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"Stream Stream not found"}`))
+	}))
+	defer ts.Close()
+	kinesisFormatter, err := NewKinesisFormatterFunc("eu-west-1", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := &smithy.OperationError{ServiceID: "Kinesis", OperationName: "PutRecords", Err: &url.Error{
+		Op: "Post", URL: "https://kinesis.eu-west-1.amazonaws.com", Err: &net.OpError{
+			Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED),
+		},
+	}}
+
+	for _, tc := range []struct {
+		formatterFunc NewHTTPFormatterFunc
+		expected      []string
+	}{
+		{kinesisFormatter, []string{"outlet.post.status.4xx", "outlet.post.status.400"}},
+		{func(b Batch, eData []errData, config *Config) HTTPFormatter {
+			return errDeliverer{NewLogplexBatchFormatter(b, eData, config), refused}
+		}, []string{"outlet.post.error.refused"}},
+	} {
+		config := newTestConfig()
+		config.LogsURL = "https://kinesis.eu-west-1.amazonaws.com/Stream"
+		config.MaxAttempts = 1
+		config.FormatterFunc = tc.formatterFunc
+
+		s := NewShuttle(config)
+		batch := NewBatch(1)
+		batch.Add(NewLogLine([]byte("hello")))
+		NewHTTPOutlet(s).retryPost(batch)
+
+		for _, name := range tc.expected {
+			if c, ok := s.MetricsRegistry.Get(name).(metrics.Counter); !ok || c.Count() != 1 {
+				t.Errorf("expected %s to count the failed delivery", name)
+			}
+		}
+		if s.MetricsRegistry.Get("outlet.post.status.2xx") != nil {
+			t.Error("expected no successful delivery to be counted")
+		}
+	}
+}
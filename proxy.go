@@ -0,0 +1,182 @@
+package shuttle
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxyDirect as Config.Proxy connects directly, ignoring the proxy
+// environment variables.
+const ProxyDirect = "direct"
+
+// proxySchemes are the schemes supported for proxy urls
+var proxySchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"socks5": true,
+}
+
+// proxyKey is the context key of the proxy function chosen for a request by
+// its outlet
+type proxyKey struct{}
+
+// proxyFunc is the signature of http.Transport.Proxy
+type proxyFunc func(*http.Request) (*url.URL, error)
+
+// newProxyFunc returns the function choosing the proxy of requests for the
+// proxy & noProxy settings of a destination, see Config.Proxy. Invalid
+// settings connect directly, see ValidateProxy.
+func newProxyFunc(proxy string, noProxy []string) proxyFunc {
+	switch proxy {
+	case "":
+		return http.ProxyFromEnvironment
+	case ProxyDirect:
+		return func(*http.Request) (*url.URL, error) { return nil, nil }
+	}
+
+	u, err := parseProxy(proxy)
+	if err != nil {
+		return func(*http.Request) (*url.URL, error) { return nil, nil }
+	}
+	bypass := newNoProxy(noProxy)
+	return func(req *http.Request) (*url.URL, error) {
+		if bypass.match(req.URL) {
+			return nil, nil
+		}
+		return u, nil
+	}
+}
+
+// transportProxy is the http.Transport.Proxy of NewHTTPTransport. Requests
+// made by outlets use the proxy of their destination, others, like those of
+// AWS clients, the proxy of config.
+func transportProxy(config Config) proxyFunc {
+	fallback := newProxyFunc(config.Proxy, config.NoProxy)
+	return func(req *http.Request) (*url.URL, error) {
+		if f, ok := req.Context().Value(proxyKey{}).(proxyFunc); ok {
+			return f(req)
+		}
+		return fallback(req)
+	}
+}
+
+func parseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if !proxySchemes[u.Scheme] || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %q: must be an http, https or socks5 url with a host", redactProxy(u))
+	}
+	return u, nil
+}
+
+// redactProxy returns u without its password, for error messages
+func redactProxy(u *url.URL) string {
+	if _, ok := u.User.Password(); ok {
+		r := *u
+		r.User = url.UserPassword(u.User.Username(), "xxxxx")
+		return r.String()
+	}
+	return u.String()
+}
+
+// ValidateProxy returns an error if the proxy of config or of any of its
+// routes isn't a valid proxy url or ProxyDirect.
+func ValidateProxy(config Config) error {
+	if err := validateProxy(config.Proxy); err != nil {
+		return err
+	}
+	for _, rc := range config.Routes {
+		if err := validateProxy(rc.Proxy); err != nil {
+			return fmt.Errorf("route %s: %s", rc.Name, err)
+		}
+	}
+	return nil
+}
+
+func validateProxy(proxy string) error {
+	if proxy == "" || proxy == ProxyDirect {
+		return nil
+	}
+	_, err := parseProxy(proxy)
+	return err
+}
+
+// noProxy matches the hosts that bypass an explicit proxy. Entries are, like
+// in $NO_PROXY, "*" for every host, IP addresses, CIDR ranges or domain
+// names, optionally followed by a port. A domain matches its subdomains too,
+// unless it starts with a dot, in which case only its subdomains match.
+type noProxy struct {
+	all     bool
+	entries []noProxyEntry
+}
+
+type noProxyEntry struct {
+	network *net.IPNet // nil unless the entry is a CIDR range or IP address
+	domain  string
+	self    bool   // whether the domain itself matches, and not only its subdomains
+	port    string // "" matches any port
+}
+
+func newNoProxy(hosts []string) noProxy {
+	var np noProxy
+	for _, h := range hosts {
+		h = strings.ToLower(strings.TrimSpace(h))
+		switch {
+		case h == "":
+			continue
+		case h == "*":
+			np.all = true
+			continue
+		}
+
+		if _, network, err := net.ParseCIDR(h); err == nil {
+			np.entries = append(np.entries, noProxyEntry{network: network})
+			continue
+		}
+
+		var e noProxyEntry
+		if host, port, err := net.SplitHostPort(h); err == nil {
+			h, e.port = host, port
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			e.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else {
+			// "*.example.com" is the same as ".example.com"
+			e.domain = strings.TrimPrefix(strings.TrimPrefix(h, "*"), ".")
+			e.self = !strings.HasPrefix(h, ".") && !strings.HasPrefix(h, "*.")
+		}
+		np.entries = append(np.entries, e)
+	}
+	return np
+}
+
+// match reports whether the host of u bypasses the proxy
+func (np noProxy) match(u *url.URL) bool {
+	if np.all {
+		return true
+	}
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	ip := net.ParseIP(host)
+	for _, e := range np.entries {
+		if e.port != "" && e.port != port {
+			continue
+		}
+		if e.network != nil {
+			if ip != nil && e.network.Contains(ip) {
+				return true
+			}
+		} else if (e.self && host == e.domain) || strings.HasSuffix(host, "."+e.domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package shuttle
+
+import "time"
+
+// tokenBucket is a simple token bucket that refills at rate tokens per second
+// and holds at most burst tokens. tokenBuckets are not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64 // tokens added per second
+	burst  float64 // maximum number of tokens the bucket can hold
+	tokens float64 // tokens currently available, negative when in debt
+	last   time.Time
+	now    func() time.Time
+}
+
+// newTokenBucket returns a full tokenBucket that refills at rate tokens per
+// second, with a burst of one second worth of tokens. A nil *tokenBucket is
+// returned when rate <= 0, which disables limiting.
+func newTokenBucket(rate int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// refill the bucket based on the time elapsed since the last refill
+func (tb *tokenBucket) refill() {
+	now := tb.now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// cost caps n to the burst size so that requests larger than the bucket can
+// ever hold can still be satisfied.
+func (tb *tokenBucket) cost(n int) float64 {
+	c := float64(n)
+	if c > tb.burst {
+		return tb.burst
+	}
+	return c
+}
+
+// available reports whether n tokens are currently available
+func (tb *tokenBucket) available(n int) bool {
+	if tb == nil {
+		return true
+	}
+	tb.refill()
+	return tb.tokens >= tb.cost(n)
+}
+
+// take n tokens from the bucket and return how long the caller needs to wait
+// for the bucket to be out of debt.
+func (tb *tokenBucket) take(n int) time.Duration {
+	if tb == nil {
+		return 0
+	}
+	tb.refill()
+	tb.tokens -= tb.cost(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// rateLimiter limits the lines and bytes per second of a single stream
+type rateLimiter struct {
+	lines, bytes *tokenBucket
+}
+
+// newRateLimiter returns a rateLimiter for the provided config, or nil if no
+// limits are configured.
+func newRateLimiter(config Config) *rateLimiter {
+	if config.RateLimitLines <= 0 && config.RateLimitBytes <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		lines: newTokenBucket(config.RateLimitLines),
+		bytes: newTokenBucket(config.RateLimitBytes),
+	}
+}
+
+// allow reports whether a line of length n is within the limits, taking the
+// tokens for it if it is.
+func (rl *rateLimiter) allow(n int) bool {
+	if rl == nil {
+		return true
+	}
+	if !rl.lines.available(1) || !rl.bytes.available(n) {
+		return false
+	}
+	rl.lines.take(1)
+	rl.bytes.take(n)
+	return true
+}
+
+// wait takes the tokens for a line of length n and returns how long the
+// caller should wait before handling the line.
+func (rl *rateLimiter) wait(n int) time.Duration {
+	if rl == nil {
+		return 0
+	}
+	lw := rl.lines.take(1)
+	if bw := rl.bytes.take(n); bw > lw {
+		return bw
+	}
+	return lw
+}
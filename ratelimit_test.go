@@ -0,0 +1,114 @@
+package shuttle
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestTokenBucket(rate int, now *time.Time) *tokenBucket {
+	tb := newTokenBucket(rate)
+	tb.last = *now
+	tb.now = func() time.Time { return *now }
+	return tb
+}
+
+func TestTokenBucketDisabled(t *testing.T) {
+	tb := newTokenBucket(0)
+	if tb != nil {
+		t.Fatalf("expected a nil token bucket, got %+v", tb)
+	}
+	if !tb.available(100) {
+		t.Error("expected a nil token bucket to always be available")
+	}
+	if d := tb.take(100); d != 0 {
+		t.Errorf("expected a nil token bucket to never wait, got %s", d)
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	now := time.Now()
+	tb := newTestTokenBucket(10, &now)
+
+	for i := 0; i < 10; i++ {
+		if !tb.available(1) {
+			t.Fatalf("expected token %d to be available", i)
+		}
+		tb.take(1)
+	}
+	if tb.available(1) {
+		t.Fatal("expected bucket to be empty")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if !tb.available(5) {
+		t.Error("expected 5 tokens to be available after 500ms")
+	}
+	if tb.available(6) {
+		t.Error("expected only 5 tokens to be available after 500ms")
+	}
+
+	now = now.Add(time.Hour)
+	tb.take(10)
+	if tb.available(1) {
+		t.Error("expected bucket not to refill beyond its burst")
+	}
+}
+
+func TestTokenBucketTakeWait(t *testing.T) {
+	now := time.Now()
+	tb := newTestTokenBucket(10, &now)
+
+	if d := tb.take(10); d != 0 {
+		t.Fatalf("expected no wait when tokens are available, got %s", d)
+	}
+	if d := tb.take(5); d != 500*time.Millisecond {
+		t.Errorf("expected a 500ms wait, got %s", d)
+	}
+	// Requests larger than the burst are capped to the burst
+	now = now.Add(1500 * time.Millisecond)
+	if d := tb.take(1000); d != 0 {
+		t.Errorf("expected no wait for an oversized request with a full bucket, got %s", d)
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Now()
+	rl := &rateLimiter{
+		lines: newTestTokenBucket(2, &now),
+		bytes: newTestTokenBucket(100, &now),
+	}
+
+	if !rl.allow(60) {
+		t.Fatal("expected first line to be allowed")
+	}
+	if rl.allow(60) {
+		t.Fatal("expected second line to exceed the byte limit")
+	}
+	// The rejected line must not have consumed a line token
+	if !rl.allow(40) {
+		t.Fatal("expected third line to be allowed")
+	}
+	if rl.allow(0) {
+		t.Fatal("expected fourth line to exceed the line limit")
+	}
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	config := newTestConfig()
+	config.RateLimitLines = 1
+	s := NewShuttle(config)
+	rdr := NewLogLineReader(NewTestInput(), s)
+	rdr.ReadLines()
+	close(s.Batches)
+
+	var lines int
+	for b := range s.Batches {
+		lines += b.MsgCount()
+	}
+	if lines != 1 {
+		t.Errorf("expected 1 line to be batched, got %d", lines)
+	}
+	if limited := s.RateLimited.Read(); limited != 1 {
+		t.Errorf("expected 1 line to be rate limited, got %d", limited)
+	}
+}
@@ -2,32 +2,62 @@ package shuttle
 
 import (
 	"bufio"
+	"context"
 	"io"
+	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
 )
 
+// lane holds the batch being filled for one destination of a LogLineReader
+type lane struct {
+	route   *Route       // nil for the shuttle's default destination
+	out     chan<- Batch // Where to send batches
+	drops   *Counter
+	targets *adaptiveTargets // The size of new batches
+	b       Batch
+
+	undelivered *undeliveredBatches // The destination's batches handed to its outlets
+
+	linesBatchedCount metrics.Counter
+	linesDroppedCount metrics.Counter
+	batchBytes        metrics.Histogram
+}
+
 // LogLineReader performs the reading of lines from an io.ReadCloser, encapsulating
 // lines into a LogLine and emitting them on outbox
 type LogLineReader struct {
-	input     io.ReadCloser // The input to read from
-	out       chan<- Batch  // Where to send batches
-	close     chan struct{}
-	batchSize int           // size of new batches
-	timeOut   time.Duration // batch timeout
-	timer     *time.Timer   // timer to actually enforce timeout
-	drops     *Counter
-	drop      bool // Should we drop or block
-
-	linesRead         metrics.Counter
-	linesBatchedCount metrics.Counter
-	linesDroppedCount metrics.Counter
-	batchFillTime     metrics.Timer
+	input    io.ReadCloser // The input to read from
+	close    chan struct{}
+	maxBytes int             // max formatted bytes of new batches
+	config   Config          // to compute the formatted length of lines
+	timeOut  time.Duration   // batch timeout
+	timer    *time.Timer     // timer to actually enforce timeout
+	drop     bool            // Should we drop or block
+	inFlight *int64          // The shuttle's count of lines not yet delivered
+	ctx      context.Context // done when the shuttle shuts down without waiting for delivery
+	observer Observer
+
+	inputFormat int
+	filters     []*regexp.Regexp
 
-	mu sync.Mutex // protects access to below
-	b  Batch
+	limiter       *rateLimiter // nil when no rate limits are configured
+	rateLimited   *Counter
+	rateLimitDrop bool // Should we discard or block lines over the rate limits
+
+	linesRead          metrics.Counter
+	linesFilteredCount metrics.Counter
+	linesLimitedCount  metrics.Counter
+	batchFillTime      metrics.Timer
+
+	mu         sync.Mutex // protects access to below
+	lanes      []*lane    // The default destination's lane first, then one per route
+	pending    int        // The number of lines batched across all lanes
+	batchStart time.Time  // When the first pending line was batched
+	finished   bool       // Whether the reader delivered its last batches
 }
 
 // NewLogLineReader constructs a new reader with it's own Outbox.
@@ -36,21 +66,35 @@ func NewLogLineReader(input io.ReadCloser, s *Shuttle) *LogLineReader {
 	t.Stop() // we only need a timer running when we actually have log lines in the batch
 
 	ll := LogLineReader{
-		input:     input,
-		out:       s.Batches,
-		close:     make(chan struct{}),
-		batchSize: s.config.BatchSize,
-		timeOut:   s.config.WaitDuration,
-		timer:     t,
-		drops:     s.Drops,
-		drop:      s.config.Drop,
+		input:    input,
+		close:    make(chan struct{}),
+		maxBytes: s.config.MaxBatchBytes,
+		config:   s.config,
+		timeOut:  s.config.WaitDuration,
+		timer:    t,
+		drop:     s.config.Drop,
+		inFlight: &s.inFlight,
+		ctx:      s.ctx,
+		observer: s.config.observer(),
+
+		inputFormat: s.config.InputFormat,
+		filters:     s.config.Filters,
 
-		linesRead:         metrics.GetOrRegisterCounter("lines.read", s.MetricsRegistry),
-		linesBatchedCount: metrics.GetOrRegisterCounter("lines.batched", s.MetricsRegistry),
-		linesDroppedCount: metrics.GetOrRegisterCounter("lines.dropped", s.MetricsRegistry),
-		batchFillTime:     metrics.GetOrRegisterTimer("batch.fill", s.MetricsRegistry),
+		limiter:       newRateLimiter(s.config),
+		rateLimited:   s.RateLimited,
+		rateLimitDrop: s.config.RateLimitDrop,
 
-		b: NewBatch(s.config.BatchSize),
+		linesRead:          metrics.GetOrRegisterCounter("lines.read", s.MetricsRegistry),
+		linesFilteredCount: metrics.GetOrRegisterCounter("lines.filtered", s.MetricsRegistry),
+		linesLimitedCount:  metrics.GetOrRegisterCounter("lines.ratelimited", s.MetricsRegistry),
+		batchFillTime:      metrics.GetOrRegisterTimer("batch.fill", s.MetricsRegistry),
+
+		lanes: make([]*lane, 0, len(s.Routes)+1),
+	}
+
+	ll.lanes = append(ll.lanes, ll.newLane(nil, s.Batches, s.Drops, s.targets, s.undelivered, s.MetricsRegistry))
+	for _, r := range s.Routes {
+		ll.lanes = append(ll.lanes, ll.newLane(r, r.Batches, r.Drops, r.targets, r.undelivered, s.MetricsRegistry))
 	}
 
 	go ll.expireBatches()
@@ -58,6 +102,31 @@ func NewLogLineReader(input io.ReadCloser, s *Shuttle) *LogLineReader {
 	return &ll
 }
 
+func (rdr *LogLineReader) newLane(r *Route, out chan<- Batch, drops *Counter, targets *adaptiveTargets, undelivered *undeliveredBatches, mr metrics.Registry) *lane {
+	return &lane{
+		route:             r,
+		out:               out,
+		drops:             drops,
+		targets:           targets,
+		undelivered:       undelivered,
+		b:                 NewBatchWithMaxBytes(targets.getBatchSize(), rdr.maxBytes),
+		linesBatchedCount: metrics.GetOrRegisterCounter(r.metricName("lines.batched"), mr),
+		linesDroppedCount: metrics.GetOrRegisterCounter(r.metricName("lines.dropped"), mr),
+		batchBytes:        metrics.GetOrRegisterHistogram(r.metricName("batch.bytes"), mr, metrics.NewExpDecaySample(1028, 0.015)),
+	}
+}
+
+// laneFor returns the lane of the first route matching ll, or the default
+// destination's lane if none match.
+func (rdr *LogLineReader) laneFor(ll LogLine) *lane {
+	for _, l := range rdr.lanes[1:] {
+		if l.route.match(ll.line, ll.appNameOr(l.route.appName)) {
+			return l
+		}
+	}
+	return rdr.lanes[0]
+}
+
 func (rdr *LogLineReader) expireBatches() {
 	for {
 		select {
@@ -66,70 +135,230 @@ func (rdr *LogLineReader) expireBatches() {
 
 		case <-rdr.timer.C:
 			rdr.mu.Lock()
-			rdr.deliverOrDropCurrent(rdr.timeOut)
+			rdr.deliverOrDropAll(rdr.timeOut, rdr.drop, rdr.ctx.Done())
 			rdr.mu.Unlock()
 		}
 	}
 }
 
-//Close the reader for input
+// Close the reader for input
 func (rdr *LogLineReader) Close() error {
 	return rdr.input.Close()
 }
 
 // ReadLines from the input created for. Return any errors
-// blocks until the underlying reader is closed
+// blocks until the underlying reader is closed, or the shuttle is shut down
+// without waiting for delivery.
 func (rdr *LogLineReader) ReadLines() error {
 	rdrIo := bufio.NewReader(rdr.input)
-	now := time.Now()
 
 	for {
 		line, err := rdrIo.ReadBytes('\n')
+		if err == nil {
+			err = rdr.ctx.Err()
+		}
 
 		if len(line) > 0 {
-			currentLogTime := time.Now()
 			rdr.linesRead.Inc(1)
-			rdr.mu.Lock()
-			if full := rdr.b.Add(LogLine{line, currentLogTime}); full {
-				rdr.deliverOrDropCurrent(time.Since(now))
-			}
-			if rdr.b.MsgCount() == 1 { // First line so restart the timer
-				now = time.Now()
-				rdr.timer.Reset(rdr.timeOut)
+			if !rdr.filtered(line) && rdr.withinRateLimit(rdr.ctx, len(line)) {
+				ll := LogLine{line: line, when: time.Now()}
+				rdr.mu.Lock()
+				rdr.batch(ll, rdr.drop, rdr.ctx.Done())
+				rdr.mu.Unlock()
 			}
-			rdr.mu.Unlock()
 		}
 
 		if err != nil {
-			rdr.mu.Lock()
-			rdr.deliverOrDropCurrent(time.Since(now))
-			rdr.mu.Unlock()
-			close(rdr.close)
+			rdr.finish()
 			return err
 		}
 	}
 }
 
+// send batches ll, like a line read from the input. Full batch queues drop the
+// batch when drop is set, otherwise blocking on them gives up when ctx is done,
+// dropping the batch and returning ctx's error. ErrLanded is returned once
+// the reader is finished.
+func (rdr *LogLineReader) send(ctx context.Context, ll LogLine, drop bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rdr.mu.Lock()
+	finished := rdr.finished
+	rdr.mu.Unlock()
+	if finished {
+		return ErrLanded
+	}
+	if ll.when.IsZero() {
+		ll.when = time.Now()
+	}
+
+	rdr.linesRead.Inc(1)
+	if rdr.filtered(ll.line) || !rdr.withinRateLimit(ctx, len(ll.line)) {
+		return nil
+	}
+
+	rdr.mu.Lock()
+	defer rdr.mu.Unlock()
+	if rdr.finished {
+		return ErrLanded
+	}
+	rdr.batch(ll, drop, ctx.Done())
+	return ctx.Err()
+}
+
+// inject batches ll without filtering, rate limiting or counting it as read,
+// dropping batches instead of blocking on their queues. false is returned
+// once the reader is finished.
+func (rdr *LogLineReader) inject(ll LogLine) bool {
+	rdr.mu.Lock()
+	defer rdr.mu.Unlock()
+	if rdr.finished {
+		return false
+	}
+	rdr.batch(ll, true, nil)
+	return true
+}
+
+// batch adds ll to the batch of its lane, delivering that first if ll would
+// overflow it and after if it's full. See deliverOrDrop for drop & cancel.
 // Should only be called when rdr.mu is held
-func (rdr *LogLineReader) deliverOrDropCurrent(d time.Duration) {
+func (rdr *LogLineReader) batch(ll LogLine, drop bool, cancel <-chan struct{}) {
+	n := rdr.config.formattedLength(ll)
+	l := rdr.laneFor(ll)
+	// Flush the batch first if the line would overflow it
+	if !l.b.fits(n) {
+		rdr.deliverOrDrop(l, time.Since(rdr.batchStart), drop, cancel)
+		if rdr.pending == 0 {
+			rdr.timer.Stop()
+		}
+	}
+	// Only the first pending line restarts the timer, lines of other lanes
+	// still waiting keep their deadline
+	if rdr.pending == 0 {
+		rdr.batchStart = time.Now()
+		rdr.timer.Reset(rdr.timeOut)
+	}
+	rdr.pending++
+	atomic.AddInt64(rdr.inFlight, 1)
+	if full := l.b.add(ll, n); full {
+		rdr.deliverOrDrop(l, time.Since(rdr.batchStart), drop, cancel)
+		if rdr.pending == 0 {
+			rdr.timer.Stop()
+		}
+	}
+}
+
+// finish delivers the batches of every lane and stops expiring batches. Lines
+// sent afterwards are refused.
+func (rdr *LogLineReader) finish() {
+	rdr.mu.Lock()
+	rdr.deliverOrDropAll(time.Since(rdr.batchStart), rdr.drop, rdr.ctx.Done())
+	rdr.finished = true
+	rdr.mu.Unlock()
+	close(rdr.close)
+}
+
+// filtered reports whether line's message matches any of the reader's
+// filters, counting it if so.
+func (rdr *LogLineReader) filtered(line []byte) bool {
+	if len(rdr.filters) == 0 {
+		return false
+	}
+	msg := lineMessage(line, rdr.inputFormat)
+	for _, f := range rdr.filters {
+		if f.Match(msg) {
+			rdr.linesFilteredCount.Inc(1)
+			return true
+		}
+	}
+	return false
+}
+
+// withinRateLimit applies the reader's rate limits to a line of length n.
+// When discarding, lines over the limits are counted as rate limited and false
+// is returned. When blocking, it sleeps until the line is within the limits or
+// ctx is done. Must not be called when rdr.mu is held.
+func (rdr *LogLineReader) withinRateLimit(ctx context.Context, n int) bool {
+	if rdr.limiter == nil {
+		return true
+	}
+
+	if rdr.rateLimitDrop {
+		if rdr.limiter.allow(n) {
+			return true
+		}
+		rdr.linesLimitedCount.Inc(1)
+		rdr.rateLimited.Add(1)
+		return false
+	}
+
+	if d := rdr.limiter.wait(n); d > 0 {
+		sleepContext(ctx, d)
+	}
+	return true
+}
+
+// deliverOrDropAll delivers the batches of every lane. Should only be called
+// when rdr.mu is held
+func (rdr *LogLineReader) deliverOrDropAll(d time.Duration, drop bool, cancel <-chan struct{}) {
 	rdr.timer.Stop()
+	for _, l := range rdr.lanes {
+		rdr.deliverOrDrop(l, d, drop, cancel)
+	}
+}
+
+// deliverOrDrop hands the lane's batch to its outlets, or drops it if they
+// are behind and drop is set. Otherwise it blocks, and closing cancel drops
+// the batch instead. Should only be called when rdr.mu is held
+func (rdr *LogLineReader) deliverOrDrop(l *lane, d time.Duration, drop bool, cancel <-chan struct{}) {
 	// There is the possibility of a new batch being expired while this is happening.
 	// so guard against queueing up an empty batch
-	if c := rdr.b.MsgCount(); c > 0 {
-		if rdr.drop {
+	if c := l.b.MsgCount(); c > 0 {
+		l.b.enqueued = time.Now()
+		l.undelivered.add(l.b)
+		if drop {
 			select {
-			case rdr.out <- rdr.b:
-				rdr.linesBatchedCount.Inc(int64(c))
+			case l.out <- l.b:
+				rdr.enqueued(l)
 			default:
-				rdr.linesDroppedCount.Inc(int64(c))
-				rdr.drops.Add(c)
+				rdr.dropped(l)
 			}
 		} else {
-			rdr.out <- rdr.b
-			rdr.linesBatchedCount.Inc(int64(c))
+			select {
+			case l.out <- l.b:
+				rdr.enqueued(l)
+			case <-rdr.ctx.Done():
+				// Abandoned, Shutdown counts undelivered lines as lost
+				l.undelivered.remove(l.b)
+			case <-cancel:
+				if rdr.ctx.Err() != nil {
+					l.undelivered.remove(l.b)
+					break // Abandoned, as above
+				}
+				rdr.dropped(l)
+			}
 		}
 
+		rdr.pending -= c
 		rdr.batchFillTime.Update(d)
-		rdr.b = NewBatch(rdr.batchSize)
+		l.batchBytes.Update(int64(l.b.Bytes()))
+		l.b = NewBatchWithMaxBytes(l.targets.getBatchSize(), rdr.maxBytes)
 	}
 }
+
+// enqueued counts the lane's batch as handed to its outlets
+func (rdr *LogLineReader) enqueued(l *lane) {
+	l.linesBatchedCount.Inc(int64(l.b.MsgCount()))
+	rdr.observer.BatchEnqueued(newBatchEvent(l.b, l.route))
+}
+
+// dropped counts the lane's batch as dropped
+func (rdr *LogLineReader) dropped(l *lane) {
+	c := l.b.MsgCount()
+	l.linesDroppedCount.Inc(int64(c))
+	l.drops.Add(c)
+	atomic.AddInt64(rdr.inFlight, -int64(c))
+	l.undelivered.remove(l.b)
+	rdr.observer.BatchDropped(newBatchEvent(l.b, l.route))
+}
@@ -0,0 +1,185 @@
+package shuttle
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// RouteConfig describes a named destination and the rules used to pick the
+// lines that are delivered to it instead of Config.LogsURL. A line matches
+// when its RFC5424 app-name is one of AppNames or its message matches any of
+// Patterns.
+type RouteConfig struct {
+	Name                string
+	LogsURL             string
+	BearerAuthToken     string
+	BearerAuthTokenFile string
+	CredentialsFile     string
+	Auth                AuthProvider // The route's BearerAuthToken or LogsURL credentials are used when nil
+	Proxy               string       // Overrides Config.Proxy & NoProxy when set
+	NoProxy             []string
+	FormatterFunc       NewHTTPFormatterFunc // Shuttle.NewFormatterFunc is used when nil
+	AppNames            []string
+	Patterns            []*regexp.Regexp
+}
+
+// Route delivers the lines matching its rules to its own destination, with
+// its own batches, outlets and counters.
+type Route struct {
+	Name             string
+	Batches          chan Batch
+	Drops, Lost      *Counter
+	config           Config // protected by the Shuttle's configMu
+	newFormatterFunc NewHTTPFormatterFunc
+	inputFormat      int
+	appName          string // The app-name of raw lines
+	appNames         map[string]struct{}
+	patterns         []*regexp.Regexp
+	targets          *adaptiveTargets
+	undelivered      *undeliveredBatches
+}
+
+// DestinationConfig returns config with the route's LogsURL, bearer token,
+// credentials file, Auth and proxy settings, the Config its outlets use.
+func (rc RouteConfig) DestinationConfig(config Config) Config {
+	config.LogsURL = rc.LogsURL
+	config.BearerAuthToken = rc.BearerAuthToken
+	config.BearerAuthTokenFile = rc.BearerAuthTokenFile
+	config.CredentialsFile = rc.CredentialsFile
+	config.Auth = rc.Auth
+	if rc.Proxy != "" {
+		config.Proxy, config.NoProxy = rc.Proxy, rc.NoProxy
+	}
+	return config
+}
+
+// newRoute returns a Route for rc, using config for everything that the route
+// doesn't override.
+func newRoute(rc RouteConfig, config Config) *Route {
+	config = rc.DestinationConfig(config)
+
+	r := &Route{
+		Name:             rc.Name,
+		Batches:          make(chan Batch, config.BackBuff),
+		Drops:            NewCounter(0),
+		Lost:             NewCounter(0),
+		config:           config,
+		newFormatterFunc: rc.FormatterFunc,
+		inputFormat:      config.InputFormat,
+		appName:          config.Appname,
+		appNames:         make(map[string]struct{}, len(rc.AppNames)),
+		patterns:         rc.Patterns,
+		targets:          newAdaptiveTargets(config),
+		undelivered:      newUndeliveredBatches(),
+	}
+	for _, an := range rc.AppNames {
+		r.appNames[an] = struct{}{}
+	}
+	return r
+}
+
+// reload the route's delivery settings from rc, using config for everything
+// that the route doesn't override. The route's rules are left untouched.
+func (r *Route) reload(rc RouteConfig, config Config) {
+	r.config = rc.DestinationConfig(config)
+	r.newFormatterFunc = rc.FormatterFunc
+}
+
+// Match reports whether line, read in the shuttle's InputFormat, should be
+// delivered via the route.
+func (r *Route) Match(line []byte) bool {
+	return r.match(line, r.appName)
+}
+
+// match is Match, with appName as the app-name of raw lines
+func (r *Route) match(line []byte, appName string) bool {
+	if len(r.appNames) > 0 {
+		if _, ok := r.appNames[lineAppName(line, r.inputFormat, appName)]; ok {
+			return true
+		}
+	}
+	if len(r.patterns) > 0 {
+		msg := lineMessage(line, r.inputFormat)
+		for _, p := range r.patterns {
+			if p.Match(msg) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// metricName returns name scoped to the route. The nil Route is the shuttle's
+// default destination, whose metrics aren't scoped.
+func (r *Route) metricName(name string) string {
+	if r == nil {
+		return name
+	}
+	return "route." + r.Name + "." + name
+}
+
+// lineAppName returns the RFC5424 app-name of line. Raw lines get appName
+// when formatted, so that is what is returned for them.
+func lineAppName(line []byte, inputFormat int, appName string) string {
+	switch inputFormat {
+	case InputFormatRFC5424:
+		return fourthField(line)
+	case InputFormatLengthPrefixedRFC5424:
+		if i := bytes.IndexByte(line, ' '); i >= 0 {
+			return fourthField(line[i+1:])
+		}
+		return ""
+	}
+	return appName
+}
+
+// lineMessage returns the MSG part of an RFC5424 formatted line, skipping the
+// header and structured data. Raw lines are all message.
+func lineMessage(line []byte, inputFormat int) []byte {
+	switch inputFormat {
+	case InputFormatRFC5424:
+	case InputFormatLengthPrefixedRFC5424:
+		i := bytes.IndexByte(line, ' ')
+		if i < 0 {
+			return line
+		}
+		line = line[i+1:]
+	default:
+		return line
+	}
+
+	// PRI+VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID
+	for f := 0; f < 6; f++ {
+		i := bytes.IndexByte(line, ' ')
+		if i < 0 {
+			return nil
+		}
+		line = line[i+1:]
+	}
+
+	// STRUCTURED-DATA is either NILVALUE or one or more [SD-ELEMENT]s, which
+	// may contain escaped ']' characters in their param values.
+	if len(line) > 0 && line[0] == '-' {
+		line = line[1:]
+	}
+	for len(line) > 0 && line[0] == '[' {
+		var escaped bool
+		i := 1
+		for ; i < len(line); i++ {
+			if escaped {
+				escaped = false
+				continue
+			}
+			if line[i] == '\\' {
+				escaped = true
+			} else if line[i] == ']' {
+				break
+			}
+		}
+		if i >= len(line) {
+			return nil
+		}
+		line = line[i+1:]
+	}
+	return bytes.TrimPrefix(line, []byte{' '})
+}
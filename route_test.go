@@ -0,0 +1,133 @@
+package shuttle
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestLineMessage(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		inputFormat int
+		line        string
+		expected    string
+	}{
+		{"raw", InputFormatRaw, "Hello World\n", "Hello World\n"},
+		{"rfc5424 nil sd", InputFormatRFC5424, "<13>1 2013-09-25T01:16:49.371356+00:00 host token web.1 - - message 1\n", "message 1\n"},
+		{"rfc5424 sd", InputFormatRFC5424, `<13>1 2013-09-25T01:16:49.371356+00:00 host token web.1 - [meta sequenceId="1"] message 1`, "message 1"},
+		{"rfc5424 multiple sd", InputFormatRFC5424, `<13>1 2013-09-25T01:16:49.371356+00:00 host token web.1 - [a x="\]"][b y="2"] message 1`, "message 1"},
+		{"rfc5424 no msg", InputFormatRFC5424, `<13>1 2013-09-25T01:16:49.371356+00:00 host token web.1 - -`, ""},
+		{"rfc5424 truncated", InputFormatRFC5424, `<13>1 2013-09-25T01:16:49.371356+00:00 host`, ""},
+		{"lprfc5424", InputFormatLengthPrefixedRFC5424, `90 <13>1 2013-09-25T01:16:49.371356+00:00 host token web.1 - [meta sequenceId="1"] message 1`, "message 1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if msg := string(lineMessage([]byte(tc.line), tc.inputFormat)); msg != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, msg)
+			}
+		})
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	config := newTestConfig()
+	config.InputFormat = InputFormatRFC5424
+	r := newRoute(RouteConfig{
+		Name:     "audit",
+		AppNames: []string{"audit"},
+		Patterns: []*regexp.Regexp{regexp.MustCompile(`^AUDIT `)},
+	}, config)
+
+	for _, tc := range []struct {
+		line     string
+		expected bool
+	}{
+		{"<13>1 2013-09-25T01:16:49.371356+00:00 host audit web.1 - - message 1\n", true},
+		{"<13>1 2013-09-25T01:16:49.371356+00:00 host token web.1 - - AUDIT message 1\n", true},
+		{"<13>1 2013-09-25T01:16:49.371356+00:00 host token web.1 - - message AUDIT 1\n", false},
+		{"<13>1 2013-09-25T01:16:49.371356+00:00 AUDIT token web.1 - - message 1\n", false},
+	} {
+		if m := r.Match([]byte(tc.line)); m != tc.expected {
+			t.Errorf("expected Match(%q) to be %t, got %t", tc.line, tc.expected, m)
+		}
+	}
+}
+
+func TestRouteMatchRawAppName(t *testing.T) {
+	config := newTestConfig()
+	config.Appname = "audit"
+	r := newRoute(RouteConfig{Name: "audit", AppNames: []string{"audit"}}, config)
+	if !r.Match([]byte("Hello World\n")) {
+		t.Error("expected raw lines to match the configured app-name")
+	}
+}
+
+func TestRoutingIntegration(t *testing.T) {
+	th := new(testHelper)
+	ts := httptest.NewServer(th)
+	defer ts.Close()
+
+	rth := new(testHelper)
+	rts := httptest.NewServer(rth)
+	defer rts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.Routes = []RouteConfig{
+		{
+			Name:            "second",
+			LogsURL:         rts.URL,
+			BearerAuthToken: "route-token",
+			Patterns:        []*regexp.Regexp{regexp.MustCompile(`Line 2`)},
+		},
+	}
+
+	shut := NewShuttle(config)
+	shut.LoadReader(NewTestInput())
+	shut.Launch()
+	shut.WaitForReadersToFinish()
+	shut.Land()
+
+	pat1 := regexp.MustCompile(`78 <190>1 [0-9T:\+\-\.]+ shuttle token shuttle - - Hello World`)
+	pat2 := regexp.MustCompile(`78 <190>1 [0-9T:\+\-\.]+ shuttle token shuttle - - Test Line 2`)
+
+	if !pat1.Match(th.Actual) || pat2.Match(th.Actual) {
+		t.Errorf("default actual=%s\n", string(th.Actual))
+	}
+	if !pat2.Match(rth.Actual) || pat1.Match(rth.Actual) {
+		t.Errorf("route actual=%s\n", string(rth.Actual))
+	}
+	if auth := rth.Headers.Get("Authorization"); auth != "Bearer route-token" {
+		t.Errorf("expected route Authorization header, got %q", auth)
+	}
+	if auth := th.Headers.Get("Authorization"); auth == "Bearer route-token" {
+		t.Error("expected default destination not to use the route's token")
+	}
+}
+
+func TestRouteFlushKeepsWaitDuration(t *testing.T) {
+	config := newTestConfig()
+	config.BatchSize = 2
+	config.WaitDuration = 200 * time.Millisecond
+	config.Routes = []RouteConfig{{Name: "audit", LogsURL: "http://localhost", AppNames: []string{"audit"}}}
+	s := NewShuttle(config)
+	rdr := NewLogLineReader(NewTestInput(), s)
+	defer rdr.finish()
+
+	start := time.Now()
+	rdr.inject(LogLine{line: []byte("waiting\n"), when: start})
+	time.Sleep(150 * time.Millisecond)
+	for i := 0; i < 2; i++ { // fills & flushes the route's batch
+		rdr.inject(NewLogLineWithMetadata([]byte("audit\n"), LineMetadata{AppName: "audit"}))
+	}
+
+	select {
+	case <-s.Batches:
+		if waited := time.Since(start); waited > 300*time.Millisecond {
+			t.Errorf("expected the default batch within the wait duration, waited %s", waited)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the default batch to be delivered")
+	}
+}
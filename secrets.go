@@ -0,0 +1,153 @@
+package shuttle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redacted replaces secrets in logged errors & response bodies
+const redacted = "[REDACTED]"
+
+// minRedactedLength is the length below which secrets are only redacted as
+// the userinfo of URLs. Shorter ones, like the default "token" password, would
+// also redact unrelated words.
+const minRedactedLength = 8
+
+// secretFile is a secret read from a file, which is re-read when it changes.
+// Surrounding whitespace, like a trailing newline, is trimmed. If re-reading
+// fails the previously read secret is kept.
+type secretFile struct {
+	mu     sync.Mutex // protects the below
+	file   reloadingFile
+	secret string
+	loaded bool
+}
+
+// newSecretFile returns a secretFile for path, or nil if path is empty
+func newSecretFile(path string) *secretFile {
+	if path == "" {
+		return nil
+	}
+	return &secretFile{file: reloadingFile{path: path}}
+}
+
+// get the secret, (re)reading the file if it changed
+func (s *secretFile) get() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed, err := s.file.changed()
+	if err == nil && changed {
+		var d []byte
+		if d, err = ioutil.ReadFile(s.file.path); err == nil {
+			s.secret, s.loaded = strings.TrimSpace(string(d)), true
+		}
+	}
+	if !s.loaded {
+		s.file.modTime = time.Time{} // try again next time
+		if err == nil {
+			err = fmt.Errorf("no secret read from %s", s.file.path)
+		}
+		return "", err
+	}
+	return s.secret, nil
+}
+
+// secrets applies the secrets read from Config.BearerAuthTokenFile &
+// Config.CredentialsFile to configs.
+type secrets struct {
+	bearerAuthToken *secretFile
+	credentials     *secretFile
+}
+
+func newSecrets(config Config) *secrets {
+	return &secrets{
+		bearerAuthToken: newSecretFile(config.BearerAuthTokenFile),
+		credentials:     newSecretFile(config.CredentialsFile),
+	}
+}
+
+// apply sets config's BearerAuthToken and the credentials of its LogsURL from
+// their files, if they are configured.
+func (s *secrets) apply(config *Config) error {
+	if s.bearerAuthToken != nil {
+		token, err := s.bearerAuthToken.get()
+		if err != nil {
+			return err
+		}
+		config.BearerAuthToken = token
+	}
+
+	if s.credentials != nil {
+		creds, err := s.credentials.get()
+		if err != nil {
+			return err
+		}
+		u, err := url.Parse(config.LogsURL)
+		if err != nil {
+			return err
+		}
+		u.User = parseCredentials(creds, u.User)
+		config.LogsURL = u.String()
+	}
+	return nil
+}
+
+// parseCredentials parses "user:password", or a lone password which is paired
+// with the username of current, or "token" if there is none.
+func parseCredentials(creds string, current *url.Userinfo) *url.Userinfo {
+	if i := strings.IndexByte(creds, ':'); i >= 0 {
+		return url.UserPassword(creds[:i], creds[i+1:])
+	}
+	user := "token"
+	if current != nil && current.Username() != "" {
+		user = current.Username()
+	}
+	return url.UserPassword(user, creds)
+}
+
+// ValidateSecretFiles checks that the secret files of config and its routes
+// can be read, so that problems can be reported before any delivery is
+// attempted.
+func ValidateSecretFiles(config Config) error {
+	paths := []string{config.BearerAuthTokenFile, config.CredentialsFile}
+	for _, rc := range config.Routes {
+		paths = append(paths, rc.BearerAuthTokenFile, rc.CredentialsFile)
+	}
+	for _, p := range paths {
+		if sf := newSecretFile(p); sf != nil {
+			if _, err := sf.get(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newRedactor returns a Replacer that scrubs the secrets of config, its
+// BearerAuthToken and the credentials of its LogsURL, from text. Secrets
+// shorter than minRedactedLength are only scrubbed from URLs.
+func newRedactor(config Config) *strings.Replacer {
+	var oldnew []string
+	secret := func(s string) {
+		if len(s) >= minRedactedLength {
+			oldnew = append(oldnew, s, redacted)
+		}
+	}
+	if u, err := url.Parse(config.LogsURL); err == nil && u.User != nil {
+		if p, ok := u.User.Password(); ok && p != "" {
+			// The full userinfo first so that AWS access keys are scrubbed too
+			oldnew = append(oldnew, u.User.String()+"@", redacted+"@")
+			if pe := url.QueryEscape(p); pe != p {
+				secret(pe)
+			}
+			secret(p)
+		}
+	}
+	secret(config.BearerAuthToken)
+	return strings.NewReplacer(oldnew...)
+}
@@ -0,0 +1,135 @@
+package shuttle
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// selfLogger sends the warnings & errors of EventLoggers through the shuttle,
+// as RFC5424 lines with Config.SelfLogAppName & Config.SelfLogProcid, see
+// Config.SelfLog. It batches with its own reader that drops instead of
+// blocking, so failing deliveries can't hold up the outlets. Its lines are
+// routed and delivered like any other, so the diagnostics of a failing
+// destination may go to it and fail too, logging more. At most
+// Config.SelfLogRate lines are sent per second, which bounds that feedback:
+// each failed batch logs a line, and the chain ends once one is suppressed.
+type selfLogger struct {
+	rdr    *LogLineReader
+	config Config
+
+	mu    sync.Mutex // protects limit
+	limit *tokenBucket
+
+	linesCount      metrics.Counter
+	suppressedCount metrics.Counter
+}
+
+// ValidateSelfLog returns an error if config's SelfLogAppName or
+// SelfLogProcid can't be RFC5424 header fields. Nothing is checked unless
+// SelfLog is set.
+func ValidateSelfLog(config Config) error {
+	if !config.SelfLog {
+		return nil
+	}
+	for _, f := range []struct {
+		name, v string
+		max     int
+	}{
+		{"app-name", config.SelfLogAppName, 48},
+		{"procid", config.SelfLogProcid, 128},
+	} {
+		if f.v == "" || len(f.v) > f.max {
+			return fmt.Errorf("%s must be 1 to %d characters long, got %q", f.name, f.max, f.v)
+		}
+		for i := 0; i < len(f.v); i++ {
+			if c := f.v[i]; c <= ' ' || c > '~' {
+				return fmt.Errorf("%s must be printable ASCII without spaces, got %q", f.name, f.v)
+			}
+		}
+	}
+	return nil
+}
+
+// newSelfLogger returns the selfLogger of s, or nil without Config.SelfLog
+func newSelfLogger(s *Shuttle) *selfLogger {
+	if !s.config.SelfLog {
+		return nil
+	}
+	rate := s.config.SelfLogRate
+	if rate <= 0 {
+		rate = DefaultSelfLogRate
+	}
+
+	// The reader is only injected into, its input is never read
+	rdr := NewLogLineReader(ioutil.NopCloser(bytes.NewReader(nil)), s)
+	rdr.drop = true // also when its batches expire
+	return &selfLogger{
+		rdr:             rdr,
+		config:          s.config,
+		limit:           newTokenBucket(rate),
+		linesCount:      metrics.GetOrRegisterCounter("selflog.lines", s.MetricsRegistry),
+		suppressedCount: metrics.GetOrRegisterCounter("selflog.suppressed", s.MetricsRegistry),
+	}
+}
+
+// log sends msg at level, unless over the rate limit or the shuttle landed. A
+// nil selfLogger does nothing.
+func (sl *selfLogger) log(level int, msg string) {
+	if sl == nil {
+		return
+	}
+	sl.mu.Lock()
+	allowed := sl.limit.available(1)
+	if allowed {
+		sl.limit.take(1)
+	}
+	sl.mu.Unlock()
+	if !allowed {
+		sl.suppressedCount.Inc(1)
+		return
+	}
+	if sl.rdr.inject(sl.line(level, msg)) {
+		sl.linesCount.Inc(1)
+	}
+}
+
+// line returns msg at level as a LogLine of the shuttle's input format.
+// Lines of the RFC5424 input formats are framed here, raw ones by the
+// formatters with the line's metadata.
+func (sl *selfLogger) line(level int, msg string) LogLine {
+	md := LineMetadata{AppName: sl.config.SelfLogAppName, Procid: sl.config.SelfLogProcid, Severity: SeverityWarning}
+	if level >= LogLevelError {
+		md.Severity = SeverityError
+	}
+	if sl.config.InputFormat == InputFormatRaw {
+		return NewLogLineWithMetadata([]byte(msg), md)
+	}
+
+	md.Time = time.Now()
+	ll := LogLine{severity: md.Severity}
+	line := "<" + ll.privalOr(sl.config.Prival) + ">" + sl.config.Version + " " +
+		md.Time.UTC().Format(LogplexBatchTimeFormat) + " " +
+		sl.config.Hostname + " " +
+		md.AppName + " " +
+		md.Procid + " " +
+		sl.config.Msgid + " " +
+		msg + "\n"
+	if sl.config.InputFormat == InputFormatLengthPrefixedRFC5424 {
+		line = strconv.Itoa(len(line)) + " " + line
+	}
+	return NewLogLineWithMetadata([]byte(line), md)
+}
+
+// finish delivers the last batches, lines logged afterwards are discarded. A
+// nil selfLogger does nothing.
+func (sl *selfLogger) finish() {
+	if sl != nil {
+		sl.rdr.finish()
+	}
+}
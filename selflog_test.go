@@ -0,0 +1,160 @@
+package shuttle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rejectFirstHelper rejects the first post with a 400 and records the bodies
+// of the others
+type rejectFirstHelper struct {
+	sync.Mutex
+	called int
+	bodies string
+}
+
+func (ts *rejectFirstHelper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	ts.Lock()
+	defer ts.Unlock()
+	ts.called++
+	if ts.called == 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ts.bodies += string(b)
+}
+
+func TestSelfLog(t *testing.T) {
+	th := new(rejectFirstHelper)
+	ts := httptest.NewServer(th)
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.SelfLog = true
+	config.NumOutlets = 1
+	config.BatchSize = 1
+
+	s := NewShuttle(config)
+	s.Launch()
+	s.TrySend(NewLogLine([]byte("rejected")))
+	// Diagnostics logged once landing are discarded, so wait for the rejection
+	for deadline := time.Now().Add(5 * time.Second); s.selfLog.linesCount.Count() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the rejection to be self logged")
+		}
+	}
+	s.Land()
+
+	th.Lock()
+	defer th.Unlock()
+	for _, e := range []string{"<187>1 ", " " + config.Hostname + " log-shuttle self " + config.Msgid + " level=error at=post ", " status=400 "} {
+		if !strings.Contains(th.bodies, e) {
+			t.Errorf("expected the delivered bodies to contain %q, got %q", e, th.bodies)
+		}
+	}
+	if n := s.selfLog.linesCount.Count(); n != 1 {
+		t.Errorf("expected 1 self logged line, got %d", n)
+	}
+}
+
+func TestSelfLogRateLimit(t *testing.T) {
+	config := newTestConfig()
+	config.SelfLog = true
+	config.SelfLogRate = 2
+
+	s := NewShuttle(config)
+	for i := 0; i < 5; i++ {
+		s.Events().Warn("test", "i", i)
+	}
+	if n := s.selfLog.suppressedCount.Count(); n != 3 {
+		t.Errorf("expected 3 suppressed lines, got %d", n)
+	}
+	if n := s.selfLog.linesCount.Count(); n != 2 {
+		t.Errorf("expected 2 self logged lines, got %d", n)
+	}
+	s.Events().Info("test") // Not self logged
+	if n := s.selfLog.linesCount.Count() + s.selfLog.suppressedCount.Count(); n != 5 {
+		t.Errorf("expected info lines not to be self logged, got %d", n)
+	}
+}
+
+// TestSelfLogFeedback checks that self logged lines failing delivery to the
+// destination they report on can't log more than the rate limit allows.
+func TestSelfLogFeedback(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.SelfLog = true
+	config.SelfLogRate = 2
+	config.BatchSize = 1
+
+	s := NewShuttle(config)
+	if err := s.selfLog.rdr.Close(); err != nil {
+		t.Errorf("unexpected error closing the self log reader: %v", err)
+	}
+	start := time.Now()
+	s.Launch()
+	s.TrySend(NewLogLine([]byte("rejected")))
+	for deadline := time.Now().Add(5 * time.Second); s.selfLog.suppressedCount.Count() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the rejections of self logged lines to be suppressed")
+		}
+	}
+	time.Sleep(100 * time.Millisecond) // Nothing more is logged once suppressed
+	lines, elapsed := s.selfLog.linesCount.Count(), time.Since(start)
+	s.Land()
+
+	if max := int64(float64(config.SelfLogRate) * (1 + elapsed.Seconds())); lines > max {
+		t.Errorf("expected at most %d self logged lines in %s, got %d", max, elapsed, lines)
+	}
+	if n := s.selfLog.suppressedCount.Count(); n != 1 {
+		t.Errorf("expected the chain to end with 1 suppressed line, got %d", n)
+	}
+}
+
+func TestSelfLogFraming(t *testing.T) {
+	config := newTestConfig()
+	config.SelfLog = true
+	header := " " + config.Hostname + " log-shuttle self " + config.Msgid + " level=warn at=test\n"
+
+	config.InputFormat = InputFormatRFC5424
+	line := string(newSelfLogger(NewShuttle(config)).line(LogLevelWarn, "level=warn at=test").Bytes())
+	if !strings.HasPrefix(line, "<188>1 ") || !strings.HasSuffix(line, header) {
+		t.Errorf("expected an rfc5424 line ending in %q, got %q", header, line)
+	}
+
+	config.InputFormat = InputFormatLengthPrefixedRFC5424
+	lpLine := string(newSelfLogger(NewShuttle(config)).line(LogLevelWarn, "level=warn at=test").Bytes())
+	if i := strings.IndexByte(lpLine, ' '); i < 0 || lpLine[:i] != fmt.Sprint(len(lpLine)-i-1) {
+		t.Errorf("expected a length prefixed line, got %q", lpLine)
+	}
+}
+
+func TestValidateSelfLog(t *testing.T) {
+	config := newTestConfig()
+	config.SelfLogProcid = "has space"
+	if err := ValidateSelfLog(config); err != nil {
+		t.Errorf("expected nothing to be checked without SelfLog, got %v", err)
+	}
+	config.SelfLog = true
+	if err := ValidateSelfLog(config); err == nil {
+		t.Error("expected an error for a procid with a space")
+	}
+	config.SelfLogProcid = DefaultSelfLogProcid
+	config.SelfLogAppName = strings.Repeat("a", 49)
+	if err := ValidateSelfLog(config); err == nil {
+		t.Error("expected an error for an app-name longer than 48 characters")
+	}
+}
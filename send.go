@@ -0,0 +1,52 @@
+package shuttle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrLanded is returned by Send once the shuttle has landed.
+var ErrLanded = errors.New("shuttle has landed")
+
+// Send a line through the shuttle, after Launch or Run, without going through
+// a reader's newline parsing. Lines are filtered, rate limited, routed and
+// batched like the lines of readers. Sending blocks like readers do when the
+// outlets fall behind and Config.Drop isn't set, until ctx is done, in which
+// case the batch is dropped and ctx's error returned. Use NewLogLine & NewLogLineWithMetadata to make
+// lines.
+func (s *Shuttle) Send(ctx context.Context, ll LogLine) error {
+	return s.sender.send(ctx, ll, s.sender.drop)
+}
+
+// TrySend is like Send, but drops the batch instead of blocking when the
+// outlets fall behind, even if Config.Drop isn't set.
+func (s *Shuttle) TrySend(ll LogLine) error {
+	return s.sender.send(context.Background(), ll, true)
+}
+
+// Writer returns an io.Writer that sends every Write as one line, with the
+// app-name & severity of md, see Send. Lines get the time of their Write.
+// log.Logger does a Write per message, so log.New(s.Writer(md), "", 0) logs
+// through the shuttle.
+func (s *Shuttle) Writer(md LineMetadata) io.Writer {
+	md.Time = time.Time{}
+	return &lineWriter{s: s, md: md}
+}
+
+type lineWriter struct {
+	s  *Shuttle
+	md LineMetadata
+}
+
+// Write p as one line, it's copied. An empty p is ignored.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := w.s.Send(context.Background(), NewLogLineWithMetadata(p, w.md)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,137 @@
+package shuttle
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewLogLine(t *testing.T) {
+	line := []byte("hello")
+	ll := NewLogLine(line)
+	line[0] = 'j'
+	if got := string(ll.Bytes()); got != "hello\n" {
+		t.Errorf("expected a terminated copy of the line, got %q", got)
+	}
+	if ll.Time().IsZero() {
+		t.Error("expected the line to get the current time")
+	}
+	if got := NewLogLine([]byte("hello\n")).Bytes(); string(got) != "hello\n" {
+		t.Errorf("expected the new line not to be doubled, got %q", got)
+	}
+
+	md := LineMetadata{Time: time.Unix(1, 0), AppName: "app", Severity: SeverityError}
+	if got := NewLogLineWithMetadata(line, md).Metadata(); got != md {
+		t.Errorf("expected metadata %+v, got %+v", md, got)
+	}
+}
+
+func TestLogLinePrival(t *testing.T) {
+	for _, tc := range []struct {
+		severity Severity
+		def      string
+		expected string
+	}{
+		{SeverityDefault, "190", "190"},
+		{SeverityError, "190", "187"},
+		{SeverityEmergency, "190", "184"},
+		{SeverityDebug, "13", "15"},
+		{SeverityError, "foo", "foo"},
+	} {
+		ll := LogLine{severity: tc.severity}
+		if got := ll.privalOr(tc.def); got != tc.expected {
+			t.Errorf("severity %d of %s: expected %s, got %s", tc.severity, tc.def, tc.expected, got)
+		}
+	}
+}
+
+func TestLogplexLineFormatterMetadata(t *testing.T) {
+	config := newTestConfig()
+	config.ComputeHeader()
+	when := time.Date(2013, 9, 25, 1, 2, 3, 0, time.UTC)
+	ll := NewLogLineWithMetadata([]byte("hi"), LineMetadata{Time: when, AppName: "worker.1", Severity: SeverityWarning})
+
+	var body bytes.Buffer
+	body.ReadFrom(NewLogplexLineFormatter(ll, &config))
+	expected := fmt.Sprintf("<188>1 2013-09-25T01:02:03.000000+00:00 %s worker.1 %s %s hi\n", config.Hostname, config.Procid, config.Msgid)
+	expected = fmt.Sprintf("%d %s", len(expected), expected)
+	if got := body.String(); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if n := config.formattedLength(ll); n != body.Len() {
+		t.Errorf("expected a formatted length of %d, got %d", body.Len(), n)
+	}
+}
+
+func TestSend(t *testing.T) {
+	th := new(testHelper)
+	ts := httptest.NewServer(th)
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.Routes = []RouteConfig{{Name: "worker", LogsURL: ts.URL, AppNames: []string{"worker"}}}
+
+	s := NewShuttle(config)
+	s.Launch()
+	if err := s.Send(context.Background(), NewLogLine([]byte("sent"))); err != nil {
+		t.Fatalf("expected Send to succeed, got %v", err)
+	}
+	log.New(s.Writer(LineMetadata{AppName: "worker"}), "", 0).Print("written")
+	s.Land()
+
+	if err := s.Send(context.Background(), NewLogLine([]byte("late"))); err != ErrLanded {
+		t.Errorf("expected ErrLanded after landing, got %v", err)
+	}
+
+	sum := s.Summary()
+	if sum.Read != 2 || sum.Delivered != 2 {
+		t.Errorf("expected 2 lines to be read & delivered, got %+v", sum)
+	}
+	for _, name := range []string{"msg.delivered", "route.worker.msg.delivered"} {
+		if n := s.MetricsRegistry.Get(name).(interface{ Count() int64 }).Count(); n != 1 {
+			t.Errorf("expected %s to be 1, got %d", name, n)
+		}
+	}
+}
+
+func TestSendCancelled(t *testing.T) {
+	config := newTestConfig()
+	config.BatchSize = 1
+	config.BackBuff = 0
+	config.Drop = false
+
+	// Without outlets the first batch can't be handed over
+	s := NewShuttle(config)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Send(ctx, NewLogLine([]byte("hello"))); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if d := s.Drops.Read(); d != 1 {
+		t.Errorf("expected the line to be dropped, got %d drops", d)
+	}
+	if u := s.Undelivered(); u != 0 {
+		t.Errorf("expected nothing to be undelivered, got %d", u)
+	}
+}
+
+func TestTrySend(t *testing.T) {
+	config := newTestConfig()
+	config.BatchSize = 1
+	config.BackBuff = 0
+	config.Drop = false
+
+	// Without outlets the first batch can't be handed over
+	s := NewShuttle(config)
+	if err := s.TrySend(NewLogLine([]byte("hello"))); err != nil {
+		t.Errorf("expected TrySend to drop without an error, got %v", err)
+	}
+	if d := s.Drops.Read(); d != 1 {
+		t.Errorf("expected the line to be dropped, got %d drops", d)
+	}
+}
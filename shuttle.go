@@ -1,10 +1,14 @@
 package shuttle
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	metrics "github.com/rcrowley/go-metrics"
 )
@@ -19,13 +23,47 @@ type Shuttle struct {
 	LogLineReader
 	config           Config
 	Batches          chan Batch
+	Routes           []*Route
 	readers          []*LogLineReader
 	MetricsRegistry  metrics.Registry
 	oWaiter, rWaiter *sync.WaitGroup
 	Drops, Lost      *Counter
+	RateLimited      *Counter
 	NewFormatterFunc NewHTTPFormatterFunc
 	Logger           *log.Logger
 	ErrLogger        *log.Logger
+
+	configMu   sync.Mutex    // protects config, NewFormatterFunc, Routes' configs, outletStop, launched & landed while (re)starting outlets
+	outletStop chan struct{} // closed to retire the current generation of outlets
+	launched   bool
+	landed     bool
+
+	inFlight int64 // lines read but not yet delivered, dropped or lost, accessed atomically
+
+	targets *adaptiveTargets // the default destination's active outlets & batch size
+	landing chan struct{}    // closed by Land to stop the adaptive controllers & connection refreshing
+	aWaiter sync.WaitGroup   // the running adaptive controllers
+
+	undelivered *undeliveredBatches // the default destination's batches not yet delivered
+
+	ctx    context.Context // done once Shutdown gives up waiting for delivery
+	cancel context.CancelFunc
+
+	sender  *LogLineReader // batches the lines given to Send
+	selfLog *selfLogger    // nil without Config.SelfLog
+}
+
+// Summary of what a shuttle did with the lines it read, see Shutdown. Lines
+// that were neither delivered, dropped nor lost were filtered, rate limited
+// or are still in flight.
+type Summary struct {
+	Read        int64 // Lines read from all readers
+	Filtered    int64 // Lines discarded by Config.Filters
+	RateLimited int64 // Lines discarded by the rate limits
+	Delivered   int64 // Lines delivered to all destinations
+	Dropped     int64 // Lines dropped because the outlets fell behind
+	Lost        int64 // Lines whose delivery failed, or that were undelivered at shutdown
+	Undelivered int64 // Lines undelivered when Shutdown's ctx was done, included in Lost
 }
 
 // NewShuttle returns a properly constructed Shuttle with a given config
@@ -33,25 +71,59 @@ func NewShuttle(config Config) *Shuttle {
 	b := make(chan Batch, config.BackBuff)
 	mr := metrics.NewRegistry()
 
-	return &Shuttle{
+	if config.Transport == nil {
+		config.Transport = NewHTTPTransport(config)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	routes := make([]*Route, 0, len(config.Routes))
+	for _, rc := range config.Routes {
+		routes = append(routes, newRoute(rc, config))
+	}
+
+	s := &Shuttle{
 		config:           config,
 		Batches:          b,
+		Routes:           routes,
 		Drops:            NewCounter(0),
 		Lost:             NewCounter(0),
+		RateLimited:      NewCounter(0),
 		MetricsRegistry:  mr,
 		NewFormatterFunc: config.FormatterFunc,
 		readers:          make([]*LogLineReader, 0),
 		oWaiter:          new(sync.WaitGroup),
+		outletStop:       make(chan struct{}),
+		targets:          newAdaptiveTargets(config),
+		undelivered:      newUndeliveredBatches(),
+		landing:          make(chan struct{}),
+		ctx:              ctx,
+		cancel:           cancel,
 		rWaiter:          new(sync.WaitGroup),
 		Logger:           discardLogger,
 		ErrLogger:        discardLogger,
 	}
+	mr.Register("msg.undelivered.oldest.seconds", s.undelivered)
+	for _, r := range routes {
+		mr.Register(r.metricName("msg.undelivered.oldest.seconds"), r.undelivered)
+	}
+	s.sender = NewLogLineReader(nil, s) // batches the lines given to Send, it has no input
+	s.selfLog = newSelfLogger(s)
+	return s
 }
 
 // Launch a shuttle by spawing it's outlets and batchers (in that order), which
-// is the reverse of shutdown.
+// is the reverse of shutdown. With Config.Adaptive an adaptive controller per
+// destination is started too, and with Config.DNSRefreshInterval the
+// connection refreshing.
 func (s *Shuttle) Launch() {
 	s.startOutlets()
+	if s.config.Adaptive {
+		s.startAdaptive()
+	}
+	if s.config.DNSRefreshInterval > 0 {
+		go s.refreshConnections(s.landing)
+	}
 	for _, rdr := range s.readers {
 		s.rWaiter.Add(1)
 		go func(rdr *LogLineReader) {
@@ -61,19 +133,156 @@ func (s *Shuttle) Launch() {
 	}
 }
 
-// startOutlet launches config.NumOutlets number of outlets. When inbox is
-// closed the outlets will finish up their output and exit.
+// startOutlet launches config.NumOutlets number of outlets for the default
+// destination and each route, or the most adaptive outlets with Config.Adaptive.
+// When inbox is closed, or the outlets are retired by Reload, the outlets will
+// finish up their output and exit.
 func (s *Shuttle) startOutlets() {
-	for i := 0; i < s.config.NumOutlets; i++ {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	s.launched = true
+	s.startOutletsLocked()
+}
+
+// startOutletsLocked should only be called when s.configMu is held
+func (s *Shuttle) startOutletsLocked() {
+	s.startRouteOutlets(nil)
+	for _, r := range s.Routes {
+		s.startRouteOutlets(r)
+	}
+}
+
+func (s *Shuttle) startRouteOutlets(r *Route) {
+	n := s.config.NumOutlets
+	if s.config.Adaptive {
+		_, n, _, _ = s.config.adaptiveBounds()
+	}
+	for i := 0; i < n; i++ {
+		outlet := newHTTPOutlet(s, r)
+		outlet.stop = s.outletStop
+		if s.config.Adaptive {
+			// Outlets beyond the active number park until the controller needs them
+			outlet.index, outlet.active = i, &s.targetsFor(r).outlets
+		}
 		s.oWaiter.Add(1)
 		go func() {
-			outlet := NewHTTPOutlet(s)
 			outlet.Outlet()
 			s.oWaiter.Done()
 		}()
 	}
 }
 
+// startAdaptive starts an adaptive controller for the default destination and
+// each route, which run until the shuttle lands.
+func (s *Shuttle) startAdaptive() {
+	for _, r := range append([]*Route{nil}, s.Routes...) {
+		c := newAdaptiveController(s, r)
+		s.aWaiter.Add(1)
+		go func() {
+			c.run(s.config.AdaptiveInterval, s.landing)
+			s.aWaiter.Done()
+		}()
+	}
+}
+
+// activateOutlets activates all of the adaptive outlets, so that the parked
+// ones exit once their inbox is closed.
+func (s *Shuttle) activateOutlets() {
+	_, maxOutlets, _, _ := s.config.adaptiveBounds()
+	for _, r := range append([]*Route{nil}, s.Routes...) {
+		atomic.StoreInt32(&s.targetsFor(r).outlets, int32(maxOutlets))
+	}
+}
+
+// targetsFor returns the adaptive targets of route r, or of the default
+// destination when r is nil.
+func (s *Shuttle) targetsFor(r *Route) *adaptiveTargets {
+	if r == nil {
+		return s.targets
+	}
+	return r.targets
+}
+
+// Reload swaps the shuttle's outlets for ones using the delivery settings of
+// config: LogsURL, BearerAuthToken, the secret files, Auth, FormatterFunc,
+// SkipVerify, the TLS options, the proxy & connection options, Transport,
+// Timeout, MaxAttempts, UseGzip, the compression options, Verbose, LogLevel,
+// LogFormat & NumOutlets, and the LogsURL, BearerAuthToken, secret files, Auth,
+// FormatterFunc & proxy options of its Routes. Readers keep running and the
+// retired outlets deliver the batches they have already taken before exiting,
+// so nothing buffered is lost. Other settings, including the adaptive ones,
+// are ignored. If config's routes don't have the same names as the shuttle's
+// an error is returned and nothing is changed, as it is when called before
+// Launch or after Land.
+func (s *Shuttle) Reload(config Config) error {
+	if len(config.Routes) != len(s.Routes) {
+		return fmt.Errorf("can't reload a different number of routes, have %d, got %d", len(s.Routes), len(config.Routes))
+	}
+	for i, rc := range config.Routes {
+		if rc.Name != s.Routes[i].Name {
+			return fmt.Errorf("can't reload routes with different names, have %q, got %q", s.Routes[i].Name, rc.Name)
+		}
+	}
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	if !s.launched {
+		return fmt.Errorf("can't reload a shuttle that hasn't launched")
+	}
+	if s.landed {
+		return fmt.Errorf("can't reload a shuttle that has landed")
+	}
+
+	s.config.LogsURL = config.LogsURL
+	s.config.BearerAuthToken = config.BearerAuthToken
+	s.config.BearerAuthTokenFile = config.BearerAuthTokenFile
+	s.config.CredentialsFile = config.CredentialsFile
+	s.config.Auth = config.Auth
+	s.config.FormatterFunc = config.FormatterFunc
+	s.config.SkipVerify = config.SkipVerify
+	s.config.TLSCAFile = config.TLSCAFile
+	s.config.TLSCertFile = config.TLSCertFile
+	s.config.TLSKeyFile = config.TLSKeyFile
+	s.config.TLSPins = config.TLSPins
+	s.config.TLSMinVersion = config.TLSMinVersion
+	s.config.MaxIdleConns = config.MaxIdleConns
+	s.config.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	s.config.MaxConnsPerHost = config.MaxConnsPerHost
+	s.config.IdleConnTimeout = config.IdleConnTimeout
+	s.config.KeepAlive = config.KeepAlive
+	s.config.HTTP2 = config.HTTP2
+	s.config.Proxy = config.Proxy
+	s.config.NoProxy = config.NoProxy
+	s.config.Transport = config.Transport
+	if s.config.Transport == nil {
+		s.config.Transport = NewHTTPTransport(s.config)
+	}
+	s.config.Timeout = config.Timeout
+	s.config.MaxAttempts = config.MaxAttempts
+	s.config.UseGzip = config.UseGzip
+	s.config.Compression = config.Compression
+	s.config.CompressionLevel = config.CompressionLevel
+	s.config.CompressionFallback = config.CompressionFallback
+	s.config.Verbose = config.Verbose
+	s.config.LogLevel = config.LogLevel
+	s.config.LogFormat = config.LogFormat
+	s.config.NumOutlets = config.NumOutlets
+	s.config.Routes = config.Routes
+	s.NewFormatterFunc = config.FormatterFunc
+
+	for i, rc := range config.Routes {
+		s.Routes[i].reload(rc, s.config)
+	}
+
+	retired := s.outletStop
+	s.outletStop = make(chan struct{})
+	s.startOutletsLocked()
+	close(retired)
+
+	return nil
+}
+
 // LoadReader into the shuttle for processing it's lines. Use this if you want
 // log-shuttle to track the readers for you. The errors returned by ReadLogLines
 // are discarded.
@@ -112,6 +321,134 @@ func (s *Shuttle) DockReaders() []error {
 // called before any readers passed to any ReadLogLines() calls aren't closed.
 func (s *Shuttle) Land() {
 	s.DockReaders()
-	close(s.Batches) // Close the batch channel, all of the outlets will stop once they are done
+	s.sender.finish()
+	s.selfLog.finish()
+
+	s.configMu.Lock()
+	s.landed = true
+	close(s.landing)
+	s.configMu.Unlock()
+
+	// A controller mid adjustment would otherwise park outlets again. It may
+	// log through Events, so configMu mustn't be held while waiting.
+	s.aWaiter.Wait()
+	s.configMu.Lock()
+	if s.config.Adaptive {
+		s.activateOutlets()
+	}
+	s.configMu.Unlock()
+
+	close(s.Batches) // Close the batch channels, all of the outlets will stop once they are done
+	for _, r := range s.Routes {
+		close(r.Batches)
+	}
 	s.oWaiter.Wait() // Wait for them to be done
 }
+
+// LandWithin is like Land, but gives up waiting after d. Lines that were read
+// but not delivered by then are counted as lost and their number is
+// returned. A d of 0 waits forever.
+func (s *Shuttle) LandWithin(d time.Duration) int {
+	ctx := context.Background()
+	if d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	return s.land(ctx)
+}
+
+// Run launches the shuttle and blocks until its readers reach the end of
+// their input, or until ctx is done, in which case the readers are closed and
+// ctx's error is returned. Use Shutdown afterwards to deliver what was read.
+func (s *Shuttle) Run(ctx context.Context) error {
+	s.Launch()
+
+	done := make(chan struct{})
+	go func() {
+		s.WaitForReadersToFinish()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.CloseReaders()
+		return ctx.Err()
+	}
+}
+
+// Shutdown lands the shuttle like Land, waiting for what was read to be
+// delivered until ctx is done. Then whatever is undelivered is counted as
+// lost, in-flight requests, retries and blocked readers are cancelled and
+// ctx's error is returned. The returned Summary covers the shuttle's whole
+// life.
+func (s *Shuttle) Shutdown(ctx context.Context) (Summary, error) {
+	undelivered := s.land(ctx)
+	sum := s.Summary()
+	sum.Undelivered = int64(undelivered)
+	return sum, ctx.Err()
+}
+
+// land the shuttle, giving up when ctx is done. It returns the number of
+// lines that were undelivered by then, which are counted as lost.
+func (s *Shuttle) land(ctx context.Context) int {
+	landed := make(chan struct{})
+	go func() {
+		s.Land()
+		close(landed)
+	}()
+
+	select {
+	case <-landed:
+		return 0
+	case <-ctx.Done():
+	}
+
+	n := s.Undelivered()
+	if n > 0 {
+		s.Lost.Add(n)
+		metrics.GetOrRegisterCounter("msg.lost", s.MetricsRegistry).Inc(int64(n))
+	}
+	s.cancel()
+	return n
+}
+
+// Events returns an EventLogger writing through the shuttle's Logger &
+// ErrLogger, with its Config's LogLevel & LogFormat.
+func (s *Shuttle) Events() EventLogger {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	events := NewEventLogger(s.Logger, s.ErrLogger, s.config)
+	events.self = s.selfLog
+	return events
+}
+
+// Summary returns the shuttle's line counts so far, from its metrics.
+func (s *Shuttle) Summary() Summary {
+	count := func(name string) int64 {
+		return metrics.GetOrRegisterCounter(name, s.MetricsRegistry).Count()
+	}
+	sum := Summary{
+		Read:        count("lines.read"),
+		Filtered:    count("lines.filtered"),
+		RateLimited: count("lines.ratelimited"),
+	}
+	for _, r := range append([]*Route{nil}, s.Routes...) {
+		sum.Delivered += count(r.metricName("msg.delivered"))
+		sum.Dropped += count(r.metricName("lines.dropped"))
+		sum.Lost += count(r.metricName("msg.lost"))
+	}
+	return sum
+}
+
+// Undelivered returns the number of lines that have been read but not yet
+// delivered, dropped or lost.
+func (s *Shuttle) Undelivered() int {
+	n := atomic.LoadInt64(&s.inFlight)
+	if n < 0 {
+		return 0
+	}
+	return int(n)
+}
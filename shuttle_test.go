@@ -2,6 +2,7 @@ package shuttle
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,6 +13,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
 )
 
 var longerTestData = []byte(`Lebowski ipsum what in God's holy name are you blathering about?
@@ -266,6 +269,34 @@ func TestLost(t *testing.T) {
 	}
 }
 
+func TestRateLimited(t *testing.T) {
+	th := new(testHelper)
+	ts := httptest.NewServer(th)
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.InputFormat = InputFormatRaw
+
+	shut := NewShuttle(config)
+	input := NewTestInput()
+	shut.LoadReader(input)
+	shut.Launch()
+	shut.RateLimited.Add(3)
+	shut.WaitForReadersToFinish()
+	shut.Land()
+
+	pat1 := regexp.MustCompile(`143 <172>1 [0-9T:\+\-\.]+ heroku token log-shuttle - - Error L16: 3 messages rate limited since [0-9T:\+\-\.]+\n`)
+	if !pat1.Match(th.Actual) {
+		t.Fatalf("actual=%s\n", string(th.Actual))
+	}
+
+	//Should be 0 because it was reset during delivery to the testHelper
+	if afterLimited, _ := shut.RateLimited.ReadAndReset(); afterLimited != 0 {
+		t.Fatalf("afterLimited=%d\n", afterLimited)
+	}
+}
+
 func TestUserAgentHeader(t *testing.T) {
 	th := new(testHelper)
 	ts := httptest.NewServer(th)
@@ -344,6 +375,264 @@ func TestBearerAuthHeader(t *testing.T) {
 	}
 }
 
+func TestReload(t *testing.T) {
+	th := new(testHelper)
+	ts := httptest.NewServer(th)
+	defer ts.Close()
+
+	rth := new(testHelper)
+	rts := httptest.NewServer(rth)
+	defer rts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.WaitDuration = time.Millisecond
+
+	pr, pw := io.Pipe()
+	shut := NewShuttle(config)
+	shut.LoadReader(pr)
+	shut.Launch()
+
+	waitForCalls := func(th *testHelper) {
+		for i := 0; i < 1000; i++ {
+			th.Lock()
+			called := th.Called
+			th.Unlock()
+			if called > 0 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatal("timed out waiting for a request")
+	}
+
+	fmt.Fprintln(pw, "Hello World")
+	waitForCalls(th)
+
+	reloaded := config
+	reloaded.LogsURL = rts.URL
+	reloaded.BearerAuthToken = "reloaded-token"
+	if err := shut.Reload(reloaded); err != nil {
+		t.Fatal("unexpected error reloading: ", err)
+	}
+
+	fmt.Fprintln(pw, "Test Line 2")
+	waitForCalls(rth)
+	pw.Close()
+	shut.Land()
+
+	pat2 := regexp.MustCompile(`78 <190>1 [0-9T:\+\-\.]+ shuttle token shuttle - - Test Line 2`)
+	if !pat2.Match(rth.Actual) {
+		t.Errorf("reloaded actual=%s\n", string(rth.Actual))
+	}
+	if auth := rth.Headers.Get("Authorization"); auth != "Bearer reloaded-token" {
+		t.Errorf("expected reloaded Authorization header, got %q", auth)
+	}
+	if th.Called != 1 {
+		t.Errorf("expected 1 request before the reload, got %d", th.Called)
+	}
+}
+
+func TestReloadRoutesMismatch(t *testing.T) {
+	config := newTestConfig()
+	config.Routes = []RouteConfig{{Name: "a"}}
+	shut := NewShuttle(config)
+
+	reloaded := config
+	reloaded.Routes = []RouteConfig{{Name: "b"}}
+	if err := shut.Reload(reloaded); err == nil {
+		t.Error("expected an error reloading routes with different names")
+	}
+
+	reloaded.Routes = nil
+	if err := shut.Reload(reloaded); err == nil {
+		t.Error("expected an error reloading a different number of routes")
+	}
+}
+
+func TestReloadBeforeLaunch(t *testing.T) {
+	config := newTestConfig()
+	shut := NewShuttle(config)
+	if err := shut.Reload(config); err == nil || err.Error() != "can't reload a shuttle that hasn't launched" {
+		t.Errorf("expected an error reloading before launch, got %v", err)
+	}
+
+	shut.Launch()
+	if err := shut.Reload(config); err != nil {
+		t.Errorf("unexpected error reloading once launched: %v", err)
+	}
+	shut.Land()
+	if err := shut.Reload(config); err == nil {
+		t.Error("expected an error reloading once landed")
+	}
+}
+
+func TestLandWithin(t *testing.T) {
+	th := new(testHelper)
+	ts := httptest.NewServer(th)
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+
+	shut := NewShuttle(config)
+	shut.LoadReader(NewTestInput())
+	shut.Launch()
+	shut.WaitForReadersToFinish()
+
+	if lost := shut.LandWithin(time.Second); lost != 0 {
+		t.Errorf("expected nothing to be lost, got %d", lost)
+	}
+	if u := shut.Undelivered(); u != 0 {
+		t.Errorf("expected nothing to be undelivered, got %d", u)
+	}
+}
+
+func TestLandWithinTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer ts.Close()
+	defer close(unblock)
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.Timeout = time.Minute
+
+	shut := NewShuttle(config)
+	shut.LoadReader(NewTestInput())
+	shut.Launch()
+	shut.WaitForReadersToFinish()
+
+	if lost := shut.LandWithin(50 * time.Millisecond); lost != 2 {
+		t.Errorf("expected 2 lines to be lost, got %d", lost)
+	}
+	if lost := shut.Lost.Read(); lost != 2 {
+		t.Errorf("expected Lost to be 2, got %d", lost)
+	}
+	if lost := metrics.GetOrRegisterCounter("msg.lost", shut.MetricsRegistry).Count(); lost != 2 {
+		t.Errorf("expected msg.lost to be 2, got %d", lost)
+	}
+}
+
+func TestRunShutdown(t *testing.T) {
+	th := new(testHelper)
+	ts := httptest.NewServer(th)
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+
+	shut := NewShuttle(config)
+	shut.LoadReader(NewTestInput())
+	if err := shut.Run(context.Background()); err != nil {
+		t.Fatalf("expected Run to succeed, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sum, err := shut.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("expected Shutdown to succeed, got %v", err)
+	}
+	if expected := (Summary{Read: 2, Delivered: 2}); sum != expected {
+		t.Errorf("expected summary %+v, got %+v", expected, sum)
+	}
+}
+
+func TestShutdownRejected(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+
+	shut := NewShuttle(config)
+	shut.LoadReader(NewTestInput())
+	if err := shut.Run(context.Background()); err != nil {
+		t.Fatalf("expected Run to succeed, got %v", err)
+	}
+	sum, err := shut.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("expected Shutdown to succeed, got %v", err)
+	}
+	if expected := (Summary{Read: 2, Lost: 2}); sum != expected {
+		t.Errorf("expected the rejected lines to be lost, got %+v", sum)
+	}
+	if n := metrics.GetOrRegisterTimer("msg.delivery.latency", shut.MetricsRegistry).Count(); n != 0 {
+		t.Errorf("expected no delivery latency for rejected lines, got %d", n)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	th := new(testHelper)
+	ts := httptest.NewServer(th)
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+
+	r, w := io.Pipe()
+	defer w.Close()
+	shut := NewShuttle(config)
+	shut.LoadReader(r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := shut.Run(ctx); err != context.Canceled {
+		t.Errorf("expected Run to return context.Canceled, got %v", err)
+	}
+	shut.Land()
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	// The server never responds, the cancellation must interrupt the outlet
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer ts.Close()
+	defer close(unblock)
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.Timeout = time.Minute
+
+	shut := NewShuttle(config)
+	shut.LoadReader(NewTestInput())
+	if err := shut.Run(context.Background()); err != nil {
+		t.Fatalf("expected Run to succeed, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	sum, err := shut.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if expected := (Summary{Read: 2, Lost: 2, Undelivered: 2}); sum != expected {
+		t.Errorf("expected summary %+v, got %+v", expected, sum)
+	}
+
+	// The outlet gives up on the cancelled request without counting it again
+	landed := make(chan struct{})
+	go func() {
+		shut.oWaiter.Wait()
+		close(landed)
+	}()
+	select {
+	case <-landed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the outlet to give up")
+	}
+	if lost := shut.Summary().Lost; lost != 2 {
+		t.Errorf("expected 2 lines to be lost, got %d", lost)
+	}
+}
+
 func BenchmarkPipeline(b *testing.B) {
 	th := new(noopTestHelper)
 	ts := httptest.NewServer(th)
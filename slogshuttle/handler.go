@@ -0,0 +1,380 @@
+// Package slogshuttle provides a log/slog Handler that ships records through a
+// log-shuttle Shuttle, with its batching, retries and drop accounting.
+//
+//	s := shuttle.NewShuttle(config)
+//	s.Launch()
+//	defer s.Land()
+//	logger := slog.New(slogshuttle.NewHandler(s, &slogshuttle.Options{AppName: "web"}))
+package slogshuttle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	shuttle "github.com/heroku/log-shuttle"
+)
+
+// Format of the lines a Handler sends
+type Format int
+
+// Formats of lines, see Options.Format
+const (
+	// FormatLogfmt renders records as logfmt message bodies, framed as RFC5424
+	// by the shuttle like raw lines, with the record's time & severity.
+	FormatLogfmt Format = iota
+	// FormatJSON renders records as JSON object message bodies, framed like
+	// FormatLogfmt.
+	FormatJSON
+	// FormatRFC5424 renders records as complete RFC5424 lines with their
+	// attributes as structured data, for shuttles with the rfc5424 input format.
+	FormatRFC5424
+)
+
+const (
+	// DefaultSDID is the SD-ID of the structured data of FormatRFC5424 lines.
+	// 32473 is the enterprise number reserved for documentation by RFC5612.
+	DefaultSDID = "slog@32473"
+	// DefaultFacility is the syslog facility of FormatRFC5424 lines, local7 like
+	// log-shuttle's default -prival.
+	DefaultFacility = 23
+
+	// The longest RFC5424 PARAM-NAME
+	maxParamName = 32
+)
+
+// Options of a Handler. The zero value renders logfmt bodies of records at
+// or above slog.LevelInfo, blocking when the shuttle's outlets fall behind.
+type Options struct {
+	Level  slog.Leveler // The minimum level of records to send, slog.LevelInfo if nil
+	Format Format
+
+	// AppName of the lines. The shuttle's -appname is used for logfmt & JSON
+	// bodies when empty, the program's name for RFC5424 lines.
+	AppName string
+
+	// The header fields of FormatRFC5424 lines. Hostname defaults to the
+	// host's name, Procid & Msgid to NILVALUE.
+	Hostname, Procid, Msgid string
+	Facility                int    // DefaultFacility if 0
+	SDID                    string // DefaultSDID if empty
+
+	// Drop lines when the shuttle's outlets fall behind instead of blocking,
+	// even if its Config.Drop isn't set. Dropped lines are counted and
+	// reported like those of readers.
+	Drop bool
+}
+
+// Handler is a slog.Handler sending records to a Shuttle, see Shuttle.Send.
+type Handler struct {
+	s     *shuttle.Shuttle
+	opts  Options
+	attrs []field // Flattened attributes of WithAttrs
+	group string  // The key prefix of WithGroup, "" or ending in a dot
+}
+
+// field is an attribute flattened to a dotted key
+type field struct {
+	key   string
+	value slog.Value
+}
+
+// NewHandler returns a Handler sending to s, which should be launched. opts
+// may be nil.
+func NewHandler(s *shuttle.Shuttle, opts *Options) *Handler {
+	h := &Handler{s: s}
+	if opts != nil {
+		h.opts = *opts
+	}
+	if h.opts.Level == nil {
+		h.opts.Level = slog.LevelInfo
+	}
+	if h.opts.Format == FormatRFC5424 {
+		if h.opts.AppName == "" {
+			h.opts.AppName = filepath.Base(os.Args[0])
+		}
+		if h.opts.Hostname == "" {
+			h.opts.Hostname, _ = os.Hostname()
+		}
+	}
+	if h.opts.Facility == 0 {
+		h.opts.Facility = DefaultFacility
+	}
+	if h.opts.SDID == "" {
+		h.opts.SDID = DefaultSDID
+	}
+	return h
+}
+
+// Enabled reports whether level is at or above Options.Level.
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.opts.Level.Level()
+}
+
+// Handle renders r and sends it to the shuttle. Sending gives up when ctx is
+// done, unless Options.Drop is set.
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	ll := shuttle.NewLogLineWithMetadata(h.format(r), shuttle.LineMetadata{
+		Time:     r.Time,
+		AppName:  h.opts.AppName,
+		Severity: Severity(r.Level),
+	})
+	if h.opts.Drop {
+		return h.s.TrySend(ll)
+	}
+	return h.s.Send(ctx, ll)
+}
+
+// WithAttrs returns a Handler adding attrs to every record.
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	h2 := *h
+	h2.attrs = h.attrs[:len(h.attrs):len(h.attrs)]
+	for _, a := range attrs {
+		h2.attrs = flatten(h2.attrs, h.group, a)
+	}
+	return &h2
+}
+
+// WithGroup returns a Handler prefixing the keys of later attributes with
+// name and a dot.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group = h.group + name + "."
+	return &h2
+}
+
+// Severity returns the shuttle severity of level. slog has no levels above
+// error, so LevelError+4 and more are critical.
+func Severity(level slog.Level) shuttle.Severity {
+	switch {
+	case level < slog.LevelInfo:
+		return shuttle.SeverityDebug
+	case level < slog.LevelWarn:
+		return shuttle.SeverityInfo
+	case level < slog.LevelError:
+		return shuttle.SeverityWarning
+	case level < slog.LevelError+4:
+		return shuttle.SeverityError
+	}
+	return shuttle.SeverityCritical
+}
+
+// flatten appends a to fields, with the keys of groups joined by dots. Empty
+// keys & groups are skipped, and groups without a key are inlined, like
+// slog's own handlers.
+func flatten(fields []field, prefix string, a slog.Attr) []field {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			fields = flatten(fields, prefix, ga)
+		}
+		return fields
+	}
+	if a.Key == "" {
+		return fields
+	}
+	return append(fields, field{key: prefix + a.Key, value: v})
+}
+
+// format r as a line, without the new line
+func (h *Handler) format(r slog.Record) []byte {
+	fields := make([]field, len(h.attrs), len(h.attrs)+r.NumAttrs())
+	copy(fields, h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		fields = flatten(fields, h.group, a)
+		return true
+	})
+
+	var buf bytes.Buffer
+	switch h.opts.Format {
+	case FormatJSON:
+		h.formatJSON(&buf, r, fields)
+	case FormatRFC5424:
+		h.formatRFC5424(&buf, r, fields)
+	default:
+		h.formatLogfmt(&buf, r, fields)
+	}
+	return buf.Bytes()
+}
+
+func (h *Handler) formatLogfmt(buf *bytes.Buffer, r slog.Record, fields []field) {
+	buf.WriteString("level=")
+	buf.WriteString(logfmtString(r.Level.String()))
+	buf.WriteString(" msg=")
+	buf.WriteString(logfmtString(r.Message))
+	for _, f := range fields {
+		buf.WriteByte(' ')
+		buf.WriteString(logfmtString(f.key))
+		buf.WriteByte('=')
+		buf.WriteString(logfmtString(valueString(f.value)))
+	}
+}
+
+func (h *Handler) formatJSON(buf *bytes.Buffer, r slog.Record, fields []field) {
+	buf.WriteString(`{"level":`)
+	buf.Write(jsonString(r.Level.String()))
+	buf.WriteString(`,"msg":`)
+	buf.Write(jsonString(r.Message))
+	for _, f := range fields {
+		buf.WriteByte(',')
+		buf.Write(jsonString(f.key))
+		buf.WriteByte(':')
+		buf.Write(jsonValue(f.value))
+	}
+	buf.WriteByte('}')
+}
+
+func (h *Handler) formatRFC5424(buf *bytes.Buffer, r slog.Record, fields []field) {
+	when := r.Time
+	if when.IsZero() {
+		when = time.Now()
+	}
+	pri := h.opts.Facility*8 + int(Severity(r.Level)-1)
+
+	buf.WriteByte('<')
+	buf.WriteString(strconv.Itoa(pri))
+	buf.WriteString(">1 ")
+	buf.WriteString(when.UTC().Format(shuttle.LogplexBatchTimeFormat))
+	for _, hf := range []string{h.opts.Hostname, h.opts.AppName, h.opts.Procid, h.opts.Msgid} {
+		buf.WriteByte(' ')
+		buf.WriteString(headerField(hf))
+	}
+
+	buf.WriteByte(' ')
+	if len(fields) == 0 {
+		buf.WriteByte('-')
+	} else {
+		buf.WriteByte('[')
+		buf.WriteString(h.opts.SDID)
+		for _, f := range fields {
+			buf.WriteByte(' ')
+			buf.WriteString(paramName(f.key))
+			buf.WriteString(`="`)
+			writeParamValue(buf, valueString(f.value))
+			buf.WriteByte('"')
+		}
+		buf.WriteByte(']')
+	}
+
+	if r.Message != "" {
+		buf.WriteByte(' ')
+		buf.WriteString(r.Message)
+	}
+}
+
+// valueString returns v as text
+func valueString(v slog.Value) string {
+	switch v.Kind() {
+	case slog.KindTime:
+		return v.Time().Format(time.RFC3339Nano)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return err.Error()
+		}
+	}
+	return v.String()
+}
+
+// logfmtString quotes s if it's empty or has spaces, quotes, equal signs or
+// non printable characters
+func logfmtString(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError || !strconv.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+func jsonString(s string) []byte {
+	b, _ := json.Marshal(s) // strings always marshal
+	return b
+}
+
+// jsonValue returns v as JSON. Durations are nanoseconds like slog's
+// JSONHandler, non finite floats & unmarshalable values are strings.
+func jsonValue(v slog.Value) []byte {
+	switch v.Kind() {
+	case slog.KindInt64:
+		return strconv.AppendInt(nil, v.Int64(), 10)
+	case slog.KindUint64:
+		return strconv.AppendUint(nil, v.Uint64(), 10)
+	case slog.KindFloat64:
+		if f := v.Float64(); !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return strconv.AppendFloat(nil, f, 'g', -1, 64)
+		}
+	case slog.KindBool:
+		return strconv.AppendBool(nil, v.Bool())
+	case slog.KindDuration:
+		return strconv.AppendInt(nil, int64(v.Duration()), 10)
+	case slog.KindAny:
+		if _, ok := v.Any().(error); !ok {
+			if b, err := json.Marshal(v.Any()); err == nil {
+				return b
+			}
+		}
+	}
+	return jsonString(valueString(v))
+}
+
+// headerField returns s as an RFC5424 header field, NILVALUE if empty, with
+// anything but printable ASCII replaced
+func headerField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		if c <= ' ' || c > '~' {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// paramName returns key as an RFC5424 PARAM-NAME: printable ASCII other than
+// '=', ']' & '"', at most 32 characters long
+func paramName(key string) string {
+	b := []byte(headerField(key))
+	for i, c := range b {
+		if c == '=' || c == ']' || c == '"' {
+			b[i] = '_'
+		}
+	}
+	if len(b) > maxParamName {
+		b = b[:maxParamName]
+	}
+	return string(b)
+}
+
+// writeParamValue writes s as an RFC5424 PARAM-VALUE, escaping '"', '\' & ']'
+func writeParamValue(buf *bytes.Buffer, s string) {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\', ']':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package slogshuttle
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	shuttle "github.com/heroku/log-shuttle"
+)
+
+var testTime = time.Date(2013, 9, 25, 1, 2, 3, 0, time.UTC)
+
+func testRecord(level slog.Level, msg string, attrs ...slog.Attr) slog.Record {
+	r := slog.NewRecord(testTime, level, msg, 0)
+	r.AddAttrs(attrs...)
+	return r
+}
+
+func TestFormat(t *testing.T) {
+	attrs := []slog.Attr{
+		slog.String("user", "a b"),
+		slog.Int("n", 42),
+		slog.Group("req", slog.String("path", "/x]"), slog.Duration("took", time.Second)),
+		slog.Any("err", errors.New(`bad "thing"`)),
+		slog.Group("", slog.Bool("inlined", true)),
+		slog.Group("empty"),
+	}
+
+	for _, tc := range []struct {
+		opts     Options
+		expected string
+	}{
+		{
+			Options{},
+			`level=INFO msg="hello world" svc=api user="a b" n=42 req.path=/x] req.took=1s err="bad \"thing\"" inlined=true`,
+		},
+		{
+			Options{Format: FormatJSON},
+			`{"level":"INFO","msg":"hello world","svc":"api","user":"a b","n":42,"req.path":"/x]","req.took":1000000000,"err":"bad \"thing\"","inlined":true}`,
+		},
+		{
+			Options{Format: FormatRFC5424, AppName: "app", Hostname: "host", Procid: "web.1"},
+			`<190>1 2013-09-25T01:02:03.000000+00:00 host app web.1 - [slog@32473 svc="api" user="a b" n="42" req.path="/x\]" req.took="1s" err="bad \"thing\"" inlined="true"] hello world`,
+		},
+	} {
+		h := NewHandler(nil, &tc.opts).WithAttrs([]slog.Attr{slog.String("svc", "api")}).(*Handler)
+		if got := string(h.format(testRecord(slog.LevelInfo, "hello world", attrs...))); got != tc.expected {
+			t.Errorf("format %d:\nexpected %s\n     got %s", tc.opts.Format, tc.expected, got)
+		}
+	}
+}
+
+func TestGroups(t *testing.T) {
+	h := NewHandler(nil, nil).
+		WithAttrs([]slog.Attr{slog.Int("a", 1)}).
+		WithGroup("g").
+		WithAttrs([]slog.Attr{slog.Int("b", 2)}).
+		WithGroup("h").(*Handler)
+	expected := `level=WARN msg=hi a=1 g.b=2 g.h.c=3`
+	if got := string(h.format(testRecord(slog.LevelWarn, "hi", slog.Int("c", 3)))); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestRFC5424Sanitizing(t *testing.T) {
+	h := NewHandler(nil, &Options{Format: FormatRFC5424, AppName: "my app", Hostname: "host", Facility: 1, SDID: "x@1"})
+	key := `a"b=c]` + strings.Repeat("d", 40)
+	expected := `<11>1 2013-09-25T01:02:03.000000+00:00 host my_app - - [x@1 a_b_c_` + strings.Repeat("d", 26) + `="v"] boom`
+	if got := string(h.format(testRecord(slog.LevelError, "boom", slog.String(key, "v")))); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestSeverity(t *testing.T) {
+	for level, expected := range map[slog.Level]shuttle.Severity{
+		slog.LevelDebug:     shuttle.SeverityDebug,
+		slog.LevelInfo:      shuttle.SeverityInfo,
+		slog.LevelInfo + 2:  shuttle.SeverityInfo,
+		slog.LevelWarn:      shuttle.SeverityWarning,
+		slog.LevelError:     shuttle.SeverityError,
+		slog.LevelError + 4: shuttle.SeverityCritical,
+	} {
+		if s := Severity(level); s != expected {
+			t.Errorf("%s: expected severity %d, got %d", level, expected, s)
+		}
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	h := NewHandler(nil, &Options{Level: slog.LevelWarn})
+	if h.Enabled(context.Background(), slog.LevelInfo) || !h.Enabled(context.Background(), slog.LevelError) {
+		t.Error("expected only records at or above warn to be enabled")
+	}
+}
+
+type testServer struct {
+	sync.Mutex
+	body string
+}
+
+func (ts *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	ts.Lock()
+	defer ts.Unlock()
+	ts.body += string(b)
+}
+
+func TestHandler(t *testing.T) {
+	th := new(testServer)
+	ts := httptest.NewServer(th)
+	defer ts.Close()
+
+	config := shuttle.NewConfig()
+	config.LogsURL = ts.URL
+	config.ComputeHeader()
+
+	s := shuttle.NewShuttle(config)
+	s.Launch()
+	logger := slog.New(NewHandler(s, &Options{AppName: "worker"}))
+	logger.Info("started", "jobs", 3)
+	logger.Debug("not enabled")
+	slog.New(NewHandler(s, &Options{Drop: true})).Error("failed")
+	s.Land()
+
+	th.Lock()
+	defer th.Unlock()
+	for _, expected := range []string{
+		" worker " + config.Procid + " " + config.Msgid + " level=INFO msg=started jobs=3\n",
+		"<187>1 ",
+		" " + config.Appname + " " + config.Procid + " " + config.Msgid + " level=ERROR msg=failed\n",
+	} {
+		if !strings.Contains(th.body, expected) {
+			t.Errorf("expected the body to contain %q, got %q", expected, th.body)
+		}
+	}
+	if strings.Contains(th.body, "not enabled") {
+		t.Errorf("expected the debug record to be skipped, got %q", th.body)
+	}
+}
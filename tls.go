@@ -0,0 +1,253 @@
+package shuttle
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSPinPrefix is the optional prefix of Config.TLSPins entries
+const TLSPinPrefix = "sha256/"
+
+// TLSVersions maps the names of the TLS versions accepted for
+// Config.TLSMinVersion to their values
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var errNoPinMatch = errors.New("tls: no certificate in the chain matches a configured pin")
+
+// reloadingFile tracks a file's modification time so that what was loaded
+// from it can be reloaded when the file is rotated.
+type reloadingFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// changed reports whether the file changed since the last call, along with
+// any error stat'ing it.
+func (f *reloadingFile) changed() (bool, error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+	if fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return false, nil
+	}
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	return true, nil
+}
+
+// tlsFiles loads the CA bundle and client certificate & key configured for
+// outlets, reloading them when they change on disk. If reloading fails the
+// previously loaded version is kept. tlsFiles are safe for concurrent use.
+type tlsFiles struct {
+	ca, cert, key *reloadingFile // nil when not configured
+
+	mu         sync.Mutex // protects the below
+	rootCAs    *x509.CertPool
+	clientCert *tls.Certificate
+}
+
+func newTLSFiles(config Config) *tlsFiles {
+	f := new(tlsFiles)
+	if config.TLSCAFile != "" {
+		f.ca = &reloadingFile{path: config.TLSCAFile}
+	}
+	if config.TLSCertFile != "" {
+		f.cert = &reloadingFile{path: config.TLSCertFile}
+		f.key = &reloadingFile{path: config.TLSKeyFile}
+	}
+	return f
+}
+
+// roots returns the CA pool to verify servers with, (re)loading it if needed
+func (f *tlsFiles) roots() (*x509.CertPool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	changed, err := f.ca.changed()
+	if err != nil || !changed {
+		if f.rootCAs != nil {
+			return f.rootCAs, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("tls: no CA certificates loaded from %s", f.ca.path)
+		}
+		return nil, err
+	}
+
+	pem, err := ioutil.ReadFile(f.ca.path)
+	if err != nil {
+		return f.keepRoots(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return f.keepRoots(fmt.Errorf("tls: no CA certificates found in %s", f.ca.path))
+	}
+	f.rootCAs = pool
+	return pool, nil
+}
+
+// keepRoots returns the previously loaded pool, or err if there is none
+func (f *tlsFiles) keepRoots(err error) (*x509.CertPool, error) {
+	if f.rootCAs != nil {
+		return f.rootCAs, nil
+	}
+	f.ca.modTime = time.Time{} // try again next time
+	return nil, err
+}
+
+// clientCertificate returns the client certificate, (re)loading it if the
+// certificate or key changed. It conforms to tls.Config.GetClientCertificate.
+func (f *tlsFiles) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	certChanged, certErr := f.cert.changed()
+	keyChanged, keyErr := f.key.changed()
+	if certErr == nil && keyErr == nil && (certChanged || keyChanged) {
+		cert, err := tls.LoadX509KeyPair(f.cert.path, f.key.path)
+		if err == nil {
+			f.clientCert = &cert
+		} else if f.clientCert == nil {
+			f.cert.modTime, f.key.modTime = time.Time{}, time.Time{} // try again next time
+			return nil, err
+		}
+	}
+	if f.clientCert == nil {
+		if certErr == nil {
+			certErr = keyErr
+		}
+		return nil, certErr
+	}
+	return f.clientCert, nil
+}
+
+// parsePins decodes pins into SHA-256 SPKI digests
+func parsePins(pins []string) ([][]byte, error) {
+	digests := make([][]byte, 0, len(pins))
+	for _, p := range pins {
+		d, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(p, TLSPinPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls pin %q: %s", p, err)
+		}
+		if len(d) != sha256.Size {
+			return nil, fmt.Errorf("invalid tls pin %q: not a sha256 digest", p)
+		}
+		digests = append(digests, d)
+	}
+	return digests, nil
+}
+
+// SPKIPin returns the pin of cert as accepted by Config.TLSPins
+func SPKIPin(cert *x509.Certificate) string {
+	d := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return TLSPinPrefix + base64.StdEncoding.EncodeToString(d[:])
+}
+
+// matchesPin reports whether any of certs has a public key matching a pin
+func matchesPin(certs []*x509.Certificate, pins [][]byte) bool {
+	for _, c := range certs {
+		d := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+		for _, p := range pins {
+			if string(d[:]) == string(p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ValidateTLSConfig checks the TLS options of config, loading any files they
+// refer to, so that problems can be reported before any delivery is attempted.
+func ValidateTLSConfig(config Config) error {
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return fmt.Errorf("a tls client certificate requires a key and vice versa")
+	}
+	if _, err := parsePins(config.TLSPins); err != nil {
+		return err
+	}
+	f := newTLSFiles(config)
+	if f.ca != nil {
+		if _, err := f.roots(); err != nil {
+			return err
+		}
+	}
+	if f.cert != nil {
+		if _, err := f.clientCertificate(nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewTLSConfig returns the tls.Config outlets use for config. The CA bundle
+// and client certificate are loaded on use and reloaded when they change on
+// disk, so errors loading them surface as delivery errors. Invalid pins are
+// ignored, see ValidateTLSConfig.
+func NewTLSConfig(config Config) *tls.Config {
+	tc := &tls.Config{
+		InsecureSkipVerify: config.SkipVerify,
+		MinVersion:         config.TLSMinVersion,
+	}
+
+	f := newTLSFiles(config)
+	if f.cert != nil {
+		tc.GetClientCertificate = f.clientCertificate
+	}
+
+	pins, _ := parsePins(config.TLSPins)
+	if f.ca == nil && len(pins) == 0 {
+		return tc
+	}
+
+	// Verification against a reloadable CA bundle needs to be done by hand,
+	// so the standard verification is skipped and done in VerifyConnection.
+	verify := !config.SkipVerify
+	if f.ca != nil {
+		tc.InsecureSkipVerify = true
+	}
+	tc.VerifyConnection = func(cs tls.ConnectionState) error {
+		chain := cs.PeerCertificates
+		if verify && f.ca != nil {
+			roots, err := f.roots()
+			if err != nil {
+				return err
+			}
+			opts := x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         roots,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			chains, err := cs.PeerCertificates[0].Verify(opts)
+			if err != nil {
+				return err
+			}
+			chain = chains[0]
+		} else if len(cs.VerifiedChains) > 0 {
+			chain = cs.VerifiedChains[0]
+		}
+
+		if len(pins) > 0 && !matchesPin(chain, pins) {
+			return errNoPinMatch
+		}
+		return nil
+	}
+	return tc
+}
@@ -0,0 +1,267 @@
+package shuttle
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCA issues client certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// writeClientCert issues a client certificate named cn and writes it and its
+// key to certFile & keyFile.
+func (ca *testCA) writeClientCert(t *testing.T, cn, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", kder)
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// clientCNHelper records the common names of the client certificates that
+// requests were made with.
+type clientCNHelper struct {
+	sync.Mutex
+	cns []string
+}
+
+func (h *clientCNHelper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	if len(r.TLS.PeerCertificates) > 0 {
+		h.cns = append(h.cns, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+}
+
+func (h *clientCNHelper) last() string {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.cns) == 0 {
+		return ""
+	}
+	return h.cns[len(h.cns)-1]
+}
+
+// newMutualTLSServer returns a server requiring client certificates issued by
+// ca, and the path of a CA file for verifying it.
+func newMutualTLSServer(t *testing.T, dir string, ca *testCA, h http.Handler) (*httptest.Server, string) {
+	ts := httptest.NewUnstartedServer(h)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	ts.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	ts.StartTLS()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ts.Certificate().Raw)
+	return ts, caFile
+}
+
+func TestTLSMutualAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shuttle-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	h := new(clientCNHelper)
+	ts, caFile := newMutualTLSServer(t, dir, ca, h)
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.TLSCAFile = caFile
+	config.TLSCertFile = filepath.Join(dir, "client.pem")
+	config.TLSKeyFile = filepath.Join(dir, "client.key")
+	config.TLSPins = []string{SPKIPin(ts.Certificate())}
+	config.TLSMinVersion = tls.VersionTLS12
+	ca.writeClientCert(t, "first", config.TLSCertFile, config.TLSKeyFile)
+
+	if err := ValidateTLSConfig(config); err != nil {
+		t.Fatal("unexpected error validating the TLS config: ", err)
+	}
+
+	client := &http.Client{Transport: NewHTTPTransport(config)}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	resp.Body.Close()
+	if cn := h.last(); cn != "first" {
+		t.Fatalf("expected the first client certificate, got %q", cn)
+	}
+
+	// Rotate the client certificate, new connections should present it
+	ca.writeClientCert(t, "second", config.TLSCertFile, config.TLSKeyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(config.TLSCertFile, future, future)
+	client.Transport.(*http.Transport).CloseIdleConnections()
+
+	resp, err = client.Get(ts.URL)
+	if err != nil {
+		t.Fatal("unexpected error after rotation: ", err)
+	}
+	resp.Body.Close()
+	if cn := h.last(); cn != "second" {
+		t.Errorf("expected the rotated client certificate, got %q", cn)
+	}
+}
+
+func TestTLSMutualAuthShuttle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shuttle-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	h := new(clientCNHelper)
+	ts, caFile := newMutualTLSServer(t, dir, ca, h)
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.TLSCAFile = caFile
+	config.TLSCertFile = filepath.Join(dir, "client.pem")
+	config.TLSKeyFile = filepath.Join(dir, "client.key")
+	ca.writeClientCert(t, "shuttle", config.TLSCertFile, config.TLSKeyFile)
+
+	s := NewShuttle(config)
+	s.LoadReader(NewTestInput())
+	s.Launch()
+	s.WaitForReadersToFinish()
+	s.Land()
+
+	if cn := h.last(); cn != "shuttle" {
+		t.Errorf("expected delivery with the client certificate, got %q", cn)
+	}
+	if lost, _ := s.Lost.ReadAndReset(); lost != 0 {
+		t.Errorf("expected nothing to be lost, got %d", lost)
+	}
+}
+
+func TestTLSPinMismatch(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.SkipVerify = true
+	config.TLSPins = []string{TLSPinPrefix + "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}
+
+	client := &http.Client{Transport: NewHTTPTransport(config)}
+	_, err := client.Get(ts.URL)
+	if err == nil || !strings.Contains(err.Error(), errNoPinMatch.Error()) {
+		t.Errorf("expected a pin mismatch error, got %v", err)
+	}
+}
+
+func TestTLSUnknownCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shuttle-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.TLSCAFile = filepath.Join(dir, "ca.pem")
+	writePEM(t, config.TLSCAFile, "CERTIFICATE", newTestCA(t).cert.Raw)
+
+	client := &http.Client{Transport: NewHTTPTransport(config)}
+	if _, err := client.Get(ts.URL); err == nil {
+		t.Error("expected a server certificate from an unknown CA to be rejected")
+	}
+}
+
+func TestValidateTLSConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   func(*Config)
+		expected string
+	}{
+		{"cert without key", func(c *Config) { c.TLSCertFile = "client.pem" }, "requires a key"},
+		{"missing ca", func(c *Config) { c.TLSCAFile = "/does/not/exist.pem" }, "no such file"},
+		{"invalid pin", func(c *Config) { c.TLSPins = []string{"sha256/nope"} }, "invalid tls pin"},
+		{"short pin", func(c *Config) { c.TLSPins = []string{"sha256/AAAA"} }, "not a sha256 digest"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := newTestConfig()
+			tc.config(&config)
+			err := ValidateTLSConfig(config)
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("expected an error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package shuttle
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// HTTP/2 mode constants, see Config.HTTP2.
+const (
+	HTTP2Disable = iota // default, HTTP/1.1 only
+	HTTP2Auto           // negotiated with https servers that support it
+	HTTP2Force          // https servers must negotiate HTTP/2
+)
+
+var errNoHTTP2 = errors.New("tls: server did not negotiate HTTP/2")
+
+// NewHTTPTransport returns a transport using the TLS options of config, see
+// NewTLSConfig, its proxy settings and its connection pooling and HTTP/2
+// options. Outlets choose the proxy of their destination, see Config.Proxy. A
+// MaxIdleConnsPerHost of 0 keeps as many idle connections per host as a
+// destination has outlets.
+func NewHTTPTransport(config Config) *http.Transport {
+	idlePerHost := config.MaxIdleConnsPerHost
+	if idlePerHost == 0 {
+		idlePerHost = config.NumOutlets
+		if config.Adaptive {
+			_, idlePerHost, _, _ = config.adaptiveBounds()
+		}
+	}
+
+	dialer := &net.Dialer{KeepAlive: config.KeepAlive}
+	t := &http.Transport{
+		Proxy:               transportProxy(config),
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     NewTLSConfig(config),
+		MaxIdleConns:        config.MaxIdleConns,
+		MaxIdleConnsPerHost: idlePerHost,
+		MaxConnsPerHost:     config.MaxConnsPerHost,
+		IdleConnTimeout:     config.IdleConnTimeout,
+	}
+
+	switch config.HTTP2 {
+	case HTTP2Auto:
+		t.ForceAttemptHTTP2 = true
+	case HTTP2Force:
+		t.ForceAttemptHTTP2 = true
+		verify := t.TLSClientConfig.VerifyConnection
+		t.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if cs.NegotiatedProtocol != "h2" {
+				return errNoHTTP2
+			}
+			if verify != nil {
+				return verify(cs)
+			}
+			return nil
+		}
+	case HTTP2Disable:
+		// A non-nil, empty map stops the transport from upgrading to HTTP/2
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return t
+}
+
+// refreshConnections closes the idle connections of the shuttle's transport
+// every config.DNSRefreshInterval until stop is closed, so that the new
+// connections replacing them re-resolve their host's address.
+func (s *Shuttle) refreshConnections(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.config.DNSRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.configMu.Lock()
+			t := s.config.Transport
+			s.configMu.Unlock()
+			t.CloseIdleConnections()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// traceConnections returns ctx with a trace counting whether requests made
+// with it reuse a pooled connection or open a new one.
+func traceConnections(ctx context.Context, reused, opened metrics.Counter) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				reused.Inc(1)
+			} else {
+				opened.Inc(1)
+			}
+		},
+	})
+}
@@ -0,0 +1,148 @@
+package shuttle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewHTTPTransport(t *testing.T) {
+	config := newTestConfig()
+	config.MaxIdleConns = 10
+	config.MaxConnsPerHost = 3
+	config.IdleConnTimeout = time.Minute
+
+	tr := NewHTTPTransport(config)
+	if tr.MaxIdleConns != 10 || tr.MaxConnsPerHost != 3 || tr.IdleConnTimeout != time.Minute {
+		t.Errorf("expected the pooling options to be applied, got %d %d %s", tr.MaxIdleConns, tr.MaxConnsPerHost, tr.IdleConnTimeout)
+	}
+	if tr.MaxIdleConnsPerHost != config.NumOutlets {
+		t.Errorf("expected an idle connection per outlet, got %d", tr.MaxIdleConnsPerHost)
+	}
+
+	config.Adaptive, config.MaxOutlets = true, 16
+	if tr := NewHTTPTransport(config); tr.MaxIdleConnsPerHost != 16 {
+		t.Errorf("expected an idle connection per adaptive outlet, got %d", tr.MaxIdleConnsPerHost)
+	}
+	config.MaxIdleConnsPerHost = 2
+	if tr := NewHTTPTransport(config); tr.MaxIdleConnsPerHost != 2 {
+		t.Errorf("expected 2 idle connections per host, got %d", tr.MaxIdleConnsPerHost)
+	}
+}
+
+func TestHTTP2Modes(t *testing.T) {
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	h1 := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer h1.Close()
+
+	for _, tc := range []struct {
+		mode   int
+		server *httptest.Server
+		proto  int // 0 when the request should fail
+	}{
+		{HTTP2Auto, h2, 2},
+		{HTTP2Auto, h1, 1},
+		{HTTP2Force, h2, 2},
+		{HTTP2Force, h1, 0},
+		{HTTP2Disable, h2, 1},
+		{DefaultHTTP2, h2, 1},
+	} {
+		config := newTestConfig()
+		config.SkipVerify = true
+		config.HTTP2 = tc.mode
+		client := &http.Client{Transport: NewHTTPTransport(config)}
+
+		resp, err := client.Get(tc.server.URL)
+		if tc.proto == 0 {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("mode %d: expected an error", tc.mode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("mode %d: unexpected error: %s", tc.mode, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != tc.proto {
+			t.Errorf("mode %d: expected HTTP/%d, got %s", tc.mode, tc.proto, resp.Proto)
+		}
+	}
+}
+
+func TestOutletConnectionReuse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = ts.URL
+	config.DNSRefreshInterval = 50 * time.Millisecond
+	s := NewShuttle(config)
+	outlet := NewHTTPOutlet(s)
+	post := func() {
+		batch := NewBatch(config.BatchSize)
+		batch.Add(LogLine{line: []byte("Hello"), when: time.Now()})
+		outlet.retryPost(batch)
+	}
+	counts := func() (int64, int64) {
+		return outlet.connsNew.Count(), outlet.connsReused.Count()
+	}
+
+	post()
+	post()
+	if n, r := counts(); n != 1 || r != 1 {
+		t.Errorf("expected 1 new & 1 reused connection, got %d & %d", n, r)
+	}
+
+	// Refreshing closes the idle connection, so the next post opens a new one
+	stop := make(chan struct{})
+	go s.refreshConnections(stop)
+	time.Sleep(4 * config.DNSRefreshInterval)
+	close(stop)
+	post()
+	if n, r := counts(); n != 2 || r != 1 {
+		t.Errorf("expected 2 new & 1 reused connections, got %d & %d", n, r)
+	}
+}
+
+func TestDelivererConnectionReuse(t *testing.T) {
+	for k, v := range map[string]string{
+		"AWS_ACCESS_KEY_ID":           "AKIDCHAIN",
+		"AWS_SECRET_ACCESS_KEY":       "chain-secret",
+		"AWS_CONFIG_FILE":             os.DevNull,
+		"AWS_SHARED_CREDENTIALS_FILE": os.DevNull,
+	} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"FailedRecordCount":0,"Records":[{"SequenceNumber":"1","ShardId":"shardId-000000000000"}]}`))
+	}))
+	defer ts.Close()
+
+	config := newTestConfig()
+	config.LogsURL = "https://kinesis.eu-west-1.amazonaws.com/Stream"
+	config.Transport = NewHTTPTransport(config)
+	ff, err := NewKinesisFormatterFunc("eu-west-1", ts.URL, config.Transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.FormatterFunc = ff
+	outlet := NewHTTPOutlet(NewShuttle(config))
+	for i := 0; i < 2; i++ {
+		batch := NewBatch(1)
+		batch.Add(NewLogLine([]byte("hello")))
+		outlet.retryPost(batch)
+	}
+
+	if n, r := outlet.connsNew.Count(), outlet.connsReused.Count(); n != 1 || r != 1 {
+		t.Errorf("expected 1 new & 1 reused connection, got %d & %d", n, r)
+	}
+}